@@ -58,7 +58,19 @@ func (d *Daemon) Start() *cobra.Command {
 
 			withAuthEngine := e.Group("/v1",
 				middleware.KeyAuth(func(auth string, c echo.Context) (bool, error) {
-					return auth == currentConfig.HostToken, nil
+					if auth == currentConfig.HostToken {
+						c.Set(handler.TokenScopesContextKey, []string{handler.ScopeAdmin})
+						return true, nil
+					}
+
+					for _, token := range currentConfig.Tokens {
+						if token.Token != "" && auth == token.Token {
+							c.Set(handler.TokenScopesContextKey, token.Scopes)
+							return true, nil
+						}
+					}
+
+					return false, nil
 				}),
 			)
 
@@ -66,6 +78,10 @@ func (d *Daemon) Start() *cobra.Command {
 				return c.String(http.StatusOK, "OK\n")
 			})
 
+			// Every token reads, changes need the admin scope the host token carries
+			// unless a route accepts a narrower one
+			admin := handler.RequireScope(handler.ScopeAdmin)
+
 			// Initiate docker clients
 			cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 			if err != nil {
@@ -81,58 +97,223 @@ func (d *Daemon) Start() *cobra.Command {
 				return getConfig(d.configPath)
 			}
 
+			// Background workers are stopped through this context on shutdown
+			workerCtx, stopWorkers := context.WithCancel(context.Background())
+			defer stopWorkers()
+
+			// Retried POST and DELETE requests carrying an Idempotency-Key replay the first response
+			idempotency := handler.NewIdempotency(workerCtx, parseDurationOrDefault(currentConfig.Idempotency.TTL, 24*time.Hour), currentConfig.GetDataDir())
+			withAuthEngine.Use(idempotency.Middleware)
+
+			// Job endpoints
+			jobs := handler.NewJobs(workerCtx, parseDurationOrDefault(currentConfig.Jobs.Retention, 24*time.Hour))
+			withAuthEngine.GET("/jobs", jobs.List)
+			withAuthEngine.GET("/jobs/:id", jobs.Inspect)
+			withAuthEngine.GET("/jobs/:id/stream", jobs.Stream)
+			withAuthEngine.POST("/jobs/:id/cancel", jobs.Cancel, admin)
+			withAuthEngine.DELETE("/jobs/:id", jobs.Cancel, admin)
+
+			// Registry credential endpoints
+			registryCredentials := handler.NewRegistryCredentialStore(currentConfig.GetDataDir())
+			withAuthEngine.GET("/registry-credentials", registryCredentials.List)
+			withAuthEngine.POST("/registry-credentials", registryCredentials.Create, admin)
+			withAuthEngine.GET("/registry-credentials/:registry", registryCredentials.Inspect)
+			withAuthEngine.DELETE("/registry-credentials/:registry", registryCredentials.Remove, admin)
+
+			// Image verification applies to image pulls and container creations
+			var imageVerifier *handler.ImageVerifier
+			if currentConfig.ImageVerification.Enabled {
+				imageVerifier, err = handler.NewImageVerifier(cli, registryCredentials, handler.ImageVerifierOptions{
+					PublicKeys:         currentConfig.ImageVerification.PublicKeys,
+					InsecureRegistries: currentConfig.ImageVerification.InsecureRegistries,
+				})
+				if err != nil {
+					fmt.Println("Failed to load image verification keys:", err)
+					return
+				}
+			}
+
 			// Manager endpoints
 			managerHandler := handler.NewManager(editConfigWrapper, getConfigWrapper)
-			withAuthEngine.POST("/managers/claims", managerHandler.Claim)
+			withAuthEngine.POST("/managers/claims", managerHandler.Claim, admin)
 
 			// Network endpoints
 			networkHandler := handler.NewNetwork(cli)
 			withAuthEngine.GET("/networks", networkHandler.List)
-			withAuthEngine.POST("/networks", networkHandler.Create)
+			withAuthEngine.POST("/networks", networkHandler.Create, admin)
 			withAuthEngine.GET("/networks/:id", networkHandler.Inspect)
-			withAuthEngine.DELETE("/networks/:id", networkHandler.Remove)
-			withAuthEngine.POST("/networks/:id/connect", networkHandler.Connect)
-			withAuthEngine.POST("/networks/:id/disconnect", networkHandler.Disconnect)
-			withAuthEngine.POST("/networks/prune", networkHandler.Prune)
+			withAuthEngine.DELETE("/networks/:id", networkHandler.Remove, admin)
+			withAuthEngine.POST("/networks/:id/connect", networkHandler.Connect, admin)
+			withAuthEngine.POST("/networks/:id/disconnect", networkHandler.Disconnect, admin)
+			withAuthEngine.POST("/networks/prune", networkHandler.Prune, admin)
 
 			// Container endpoints
-			containerHandler := handler.NewContainer(cli)
+			managedContainerStore := handler.NewManagedContainerStore(currentConfig.GetDataDir())
+			containerHandler := handler.NewContainer(cli, managedContainerStore, registryCredentials, imageVerifier)
 			withAuthEngine.GET("/containers", containerHandler.List)
-			withAuthEngine.POST("/containers", containerHandler.Create)
+			withAuthEngine.POST("/containers", containerHandler.Create, admin)
+			withAuthEngine.POST("/containers/bulk", containerHandler.Bulk, admin)
 			withAuthEngine.GET("/containers/:id", containerHandler.Inspect)
-			withAuthEngine.POST("/containers/:id/start", containerHandler.Start)
+			withAuthEngine.POST("/containers/:id/start", containerHandler.Start, admin)
 			withAuthEngine.GET("/containers/:id/stats", containerHandler.Stats)
-			withAuthEngine.POST("/containers/:id/stop", containerHandler.Stop)
-			withAuthEngine.POST("/containers/:id/restart", containerHandler.Restart)
-			withAuthEngine.POST("/containers/:id/pause", containerHandler.Pause)
-			withAuthEngine.POST("/containers/:id/unpause", containerHandler.Unpause)
-			withAuthEngine.DELETE("/containers/:id", containerHandler.Remove)
+			withAuthEngine.POST("/containers/:id/stop", containerHandler.Stop, admin)
+			withAuthEngine.POST("/containers/:id/restart", containerHandler.Restart, admin)
+			withAuthEngine.POST("/containers/:id/pause", containerHandler.Pause, admin)
+			withAuthEngine.POST("/containers/:id/unpause", containerHandler.Unpause, admin)
+			withAuthEngine.DELETE("/containers/:id", containerHandler.Remove, admin)
 			withAuthEngine.GET("/containers/:id/logs", containerHandler.Logs)
-			withAuthEngine.POST("/containers/:id/exec", containerHandler.Exec)
+			withAuthEngine.POST("/containers/:id/exec", containerHandler.Exec, admin)
+			withAuthEngine.GET("/containers/:id/archive", containerHandler.CopyFrom)
+			withAuthEngine.PUT("/containers/:id/archive", containerHandler.CopyTo, admin)
+			withAuthEngine.GET("/containers/:id/archive/stat", containerHandler.StatPath)
+
+			// Managed container endpoints
+			reconcileInterval := parseDurationOrDefault(currentConfig.Reconciler.Interval, 30*time.Second)
+			reconciler := handler.NewReconciler(cli, managedContainerStore, containerHandler, reconcileInterval)
+			go reconciler.Run(workerCtx)
+			withAuthEngine.GET("/managed-containers", reconciler.List)
+			withAuthEngine.GET("/managed-containers/:name", reconciler.Inspect)
+			withAuthEngine.DELETE("/managed-containers/:name", reconciler.Unmanage, admin)
+
+			// Auto-heal endpoints
+			if currentConfig.AutoHeal.Enabled {
+				autoHeal := handler.NewAutoHeal(cli, autoHealOptions(currentConfig.AutoHeal))
+				go autoHeal.Run(workerCtx)
+				withAuthEngine.GET("/autoheal", autoHeal.Status)
+				withAuthEngine.GET("/autoheal/actions", autoHeal.Actions)
+			}
 
 			// Volume endpoints
-			volumeHandler := handler.NewVolume(cli)
+			volumeHandler := handler.NewVolume(cli, registryCredentials, imageVerifier, volumeHelperImage(currentConfig.VolumeBackup))
 			withAuthEngine.GET("/volumes", volumeHandler.List)
-			withAuthEngine.POST("/volumes", volumeHandler.Create)
+			withAuthEngine.POST("/volumes", volumeHandler.Create, admin)
 			withAuthEngine.GET("/volumes/:name", volumeHandler.Inspect)
-			withAuthEngine.DELETE("/volumes/:name", volumeHandler.Remove)
-			withAuthEngine.POST("/volumes/prune", volumeHandler.Prune)
+			withAuthEngine.DELETE("/volumes/:name", volumeHandler.Remove, admin)
+			withAuthEngine.POST("/volumes/prune", volumeHandler.Prune, admin)
+			withAuthEngine.GET("/volumes/:name/backup", volumeHandler.Backup)
+			withAuthEngine.POST("/volumes/:name/restore", volumeHandler.Restore, admin)
+			withAuthEngine.GET("/volumes/:name/files", volumeHandler.ListFiles)
+			withAuthEngine.GET("/volumes/:name/files/stat", volumeHandler.StatFile)
+			withAuthEngine.GET("/volumes/:name/files/content", volumeHandler.DownloadFile)
+			withAuthEngine.PUT("/volumes/:name/files/content", volumeHandler.UploadFile, handler.RequireScope(handler.ScopeVolumesWrite))
+			withAuthEngine.POST("/volumes/:name/files/directories", volumeHandler.CreateDirectory, handler.RequireScope(handler.ScopeVolumesWrite))
+			withAuthEngine.DELETE("/volumes/:name/files", volumeHandler.DeleteFile, handler.RequireScope(handler.ScopeVolumesWrite))
+
+			// Volume snapshot endpoints
+			if len(currentConfig.VolumeSnapshots) > 0 {
+				volumeSnapshots, err := handler.NewVolumeSnapshots(volumeHandler, jobs, volumeSnapshotPolicies(currentConfig.VolumeSnapshots), currentConfig.GetDataDir())
+				if err != nil {
+					fmt.Println("Failed to load volume snapshot policies:", err)
+					return
+				}
+				go volumeSnapshots.Run(workerCtx)
+				withAuthEngine.GET("/volumes/:name/restore-points", volumeSnapshots.RestorePoints)
+				withAuthEngine.GET("/volume-snapshots", volumeSnapshots.List)
+				withAuthEngine.GET("/volume-snapshots/policies", volumeSnapshots.Policies)
+				withAuthEngine.POST("/volume-snapshots/policies/:name/runs", volumeSnapshots.Trigger, admin)
+				withAuthEngine.POST("/volume-snapshots/:id/restore", volumeSnapshots.Restore, admin)
+			}
 
 			// Image endpoints
-			imageHandler := handler.NewImage(cli)
+			imageHandler := handler.NewImage(cli, jobs, registryCredentials, imageVerifier, currentConfig.RegistryMirror.PullThrough)
 			withAuthEngine.GET("/images", imageHandler.List)
-			withAuthEngine.POST("/images", imageHandler.Create)
-			withAuthEngine.POST("/images/pull", imageHandler.Pull)
+			withAuthEngine.GET("/images/inventory", imageHandler.Inventory)
+			withAuthEngine.POST("/images", imageHandler.Create, admin)
+			withAuthEngine.POST("/images/pull", imageHandler.Pull, admin)
+			withAuthEngine.POST("/images/build", imageHandler.Build, admin)
+			withAuthEngine.POST("/images/push", imageHandler.Push, admin)
+			withAuthEngine.GET("/images/save", imageHandler.Save)
+			withAuthEngine.POST("/images/load", imageHandler.Load, admin)
+			withAuthEngine.POST("/images/import", imageHandler.Import, admin)
 			withAuthEngine.GET("/images/:id", imageHandler.Inspect)
-			withAuthEngine.DELETE("/images/:id", imageHandler.Remove)
-			withAuthEngine.POST("/images/:id/tag", imageHandler.Tag)
+			withAuthEngine.DELETE("/images/:id", imageHandler.Remove, admin)
+			withAuthEngine.POST("/images/:id/tag", imageHandler.Tag, admin)
 			withAuthEngine.GET("/images/:id/history", imageHandler.History)
-			withAuthEngine.POST("/images/prune", imageHandler.Prune)
+			withAuthEngine.POST("/images/prune", imageHandler.Prune, admin)
+			withAuthEngine.POST("/containers/:id/commit", imageHandler.Commit, admin)
+			withAuthEngine.GET("/containers/:id/export", imageHandler.Export)
+
+			// Image garbage collection endpoints
+			if currentConfig.ImageGC.Enabled {
+				imageGC := handler.NewImageGC(cli, imageGCOptions(currentConfig.ImageGC), currentConfig.GetDataDir())
+				go imageGC.Run(workerCtx)
+				withAuthEngine.GET("/image-gc", imageGC.Status)
+				withAuthEngine.GET("/image-gc/runs", imageGC.Runs)
+				withAuthEngine.POST("/image-gc/runs", imageGC.Trigger, admin)
+			}
+
+			// Registry mirror, docker speaks to it without the API key but may log in with a token
+			if currentConfig.RegistryMirror.Enabled {
+				mirrorOptions := registryMirrorOptions(currentConfig.RegistryMirror)
+				mirrorOptions.Authorize = func(token string) bool {
+					return validAPIToken(*currentConfig, token)
+				}
+
+				registryMirror, err := handler.NewRegistryMirror(registryCredentials, mirrorOptions, currentConfig.GetDataDir())
+				if err != nil {
+					fmt.Println("Failed to initiate registry mirror:", err)
+					return
+				}
+				e.GET("/v2/*", registryMirror.Serve)
+				e.HEAD("/v2/*", registryMirror.Serve)
+				withAuthEngine.GET("/registry-mirror", registryMirror.Status)
+			}
+
+			// Stack endpoints
+			stackHandler := handler.NewStack(cli, registryCredentials, imageVerifier, currentConfig.GetDataDir())
+			withAuthEngine.GET("/stacks", stackHandler.List)
+			withAuthEngine.POST("/stacks", stackHandler.Deploy, admin)
+			withAuthEngine.GET("/stacks/:name", stackHandler.Inspect)
+			withAuthEngine.PUT("/stacks/:name", stackHandler.Deploy, admin)
+			withAuthEngine.DELETE("/stacks/:name", stackHandler.Remove, admin)
+
+			// Event endpoints
+			eventHandler := handler.NewEvent(cli)
+			withAuthEngine.GET("/events", eventHandler.Stream)
+			withAuthEngine.GET("/events/ws", eventHandler.WebSocket)
+
+			// Webhook endpoints
+			webhookHandler := handler.NewWebhook(cli, currentConfig.Webhooks, getConfigWrapper, currentConfig.GetDataDir())
+			if len(currentConfig.Webhooks) > 0 {
+				go webhookHandler.Run(workerCtx)
+			}
+			withAuthEngine.GET("/webhooks", webhookHandler.List)
+			withAuthEngine.GET("/webhooks/queue", webhookHandler.Queue)
+			withAuthEngine.POST("/webhooks/queue/flush", webhookHandler.Flush, admin)
+
+			// Tunnel endpoints
+			var tunnel *handler.Tunnel
+			if currentConfig.Tunnel.Enabled {
+				tunnel = handler.NewTunnel(handler.TunnelOptions{
+					ManagerURL: currentConfig.Tunnel.ManagerURL,
+					HostToken:  currentConfig.HostToken,
+					ClientCert: currentConfig.Tunnel.ClientCert,
+					ClientKey:  currentConfig.Tunnel.ClientKey,
+					CACert:     currentConfig.Tunnel.CACert,
+				}, e)
+				withAuthEngine.GET("/tunnel", tunnel.Status)
+			}
+
+			// Heartbeat endpoints
+			if currentConfig.Heartbeat.Enabled {
+				heartbeat := handler.NewHeartbeat(cli, handler.HeartbeatOptions{
+					URL:           currentConfig.Heartbeat.URL,
+					Interval:      parseDurationOrDefault(currentConfig.Heartbeat.Interval, 30*time.Second),
+					DaemonVersion: Version,
+				}, getConfigWrapper, currentConfig.GetDataDir())
+				go heartbeat.Run(workerCtx)
+				withAuthEngine.GET("/heartbeat", heartbeat.Status)
+			}
 
 			// Node endpoints
 			nodeHandler := handler.NewNode()
 			withAuthEngine.GET("/nodes/specs", nodeHandler.Specs)
 
+			// The tunnel serves the same router, start it once every route is registered
+			if tunnel != nil {
+				go tunnel.Run(workerCtx)
+			}
+
 			// Start the server in a goroutine
 			go func() {
 				port := "30000"
@@ -150,6 +331,7 @@ func (d *Daemon) Start() *cobra.Command {
 			signal.Notify(quit, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 			<-quit
 			fmt.Printf("\nShutting down the server...\n")
+			stopWorkers()
 
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			defer cancel()
@@ -2,6 +2,10 @@ package cmd
 
 import "github.com/spf13/cobra"
 
+// Version of the daemon, set at build time with
+// `-ldflags "-X github.com/insomnius/agent/cmd.Version=..."`.
+var Version = "dev"
+
 type Root struct{}
 
 func NewRoot() *Root {
@@ -10,8 +14,9 @@ func NewRoot() *Root {
 
 func (r *Root) Cconnector() *cobra.Command {
 	return &cobra.Command{
-		Use:   "cconector",
-		Short: "Host container connector",
+		Use:     "cconector",
+		Short:   "Host container connector",
+		Version: Version,
 		Run: func(cmd *cobra.Command, args []string) {
 			cmd.Help()
 		},
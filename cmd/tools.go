@@ -8,8 +8,10 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/insomnius/agent/entity"
+	"github.com/insomnius/agent/handler"
 	"gopkg.in/yaml.v2"
 )
 
@@ -155,3 +157,133 @@ func generateBearerToken(length int) (string, error) {
 
 	return token, nil
 }
+
+// parseDurationOrDefault parses a config duration, falling back to the default
+// when it is empty or malformed.
+func parseDurationOrDefault(value string, defaultValue time.Duration) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return defaultValue
+	}
+
+	return duration
+}
+
+func autoHealOptions(config entity.AutoHealConfig) handler.AutoHealOptions {
+	options := handler.AutoHealOptions{
+		Threshold:     config.Threshold,
+		MaxRestarts:   config.MaxRestarts,
+		Window:        parseDurationOrDefault(config.Window, time.Hour),
+		BackoffBase:   parseDurationOrDefault(config.BackoffBase, 10*time.Second),
+		BackoffMax:    parseDurationOrDefault(config.BackoffMax, 5*time.Minute),
+		RecheckPeriod: 10 * time.Second,
+	}
+
+	if options.Threshold <= 0 {
+		options.Threshold = 3
+	}
+	if options.MaxRestarts <= 0 {
+		options.MaxRestarts = 5
+	}
+
+	return options
+}
+
+func imageGCOptions(config entity.ImageGCConfig) handler.ImageGCOptions {
+	options := handler.ImageGCOptions{
+		Interval:        parseDurationOrDefault(config.Interval, 5*time.Minute),
+		HighWatermark:   config.HighWatermark,
+		LowWatermark:    config.LowWatermark,
+		MinAge:          parseDurationOrDefault(config.MinAge, 24*time.Hour),
+		KeepLastTags:    config.KeepLastTags,
+		ProtectedLabels: config.ProtectedLabels,
+		ProtectedRefs:   config.ProtectedRefs,
+	}
+
+	if options.HighWatermark <= 0 {
+		options.HighWatermark = 85
+	}
+	if options.LowWatermark <= 0 || options.LowWatermark > options.HighWatermark {
+		options.LowWatermark = min(70, options.HighWatermark)
+	}
+	if options.KeepLastTags <= 0 {
+		options.KeepLastTags = 3
+	}
+
+	return options
+}
+
+func registryMirrorOptions(config entity.RegistryMirrorConfig) handler.RegistryMirrorOptions {
+	options := handler.RegistryMirrorOptions{
+		MaxBytes:             config.CacheSizeMB << 20,
+		AllowedNetworks:      config.AllowedNetworks,
+		CredentialRegistries: config.CredentialRegistries,
+	}
+
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = 10240 << 20
+	}
+	if len(options.AllowedNetworks) == 0 {
+		options.AllowedNetworks = []string{"127.0.0.0/8", "::1/128"}
+	}
+
+	return options
+}
+
+// validAPIToken reports whether token is the host token or one of the extra
+// API tokens.
+func validAPIToken(config entity.CconnectorConfig, token string) bool {
+	if token == "" {
+		return false
+	}
+	if token == config.HostToken {
+		return true
+	}
+
+	for _, apiToken := range config.Tokens {
+		if apiToken.Token == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+func volumeHelperImage(config entity.VolumeBackupConfig) string {
+	if config.HelperImage == "" {
+		return "busybox:latest"
+	}
+
+	return config.HelperImage
+}
+
+func volumeSnapshotPolicies(configs []entity.VolumeSnapshotConfig) []handler.VolumeSnapshotPolicy {
+	policies := make([]handler.VolumeSnapshotPolicy, 0, len(configs))
+
+	for _, config := range configs {
+		policy := handler.VolumeSnapshotPolicy{
+			Name:            config.Name,
+			Schedule:        config.Schedule,
+			Volumes:         config.Volumes,
+			Selector:        config.Selector,
+			Dir:             config.Dir,
+			KeepDaily:       config.KeepDaily,
+			KeepWeekly:      config.KeepWeekly,
+			KeepMonthly:     config.KeepMonthly,
+			PauseContainers: config.PauseContainers,
+		}
+		if config.S3 != nil {
+			policy.S3 = &handler.S3TargetOptions{
+				Endpoint:  config.S3.Endpoint,
+				Region:    config.S3.Region,
+				Bucket:    config.S3.Bucket,
+				Prefix:    config.S3.Prefix,
+				AccessKey: config.S3.AccessKey,
+				SecretKey: config.S3.SecretKey,
+			}
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies
+}
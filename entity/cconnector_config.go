@@ -3,4 +3,181 @@ package entity
 type CconnectorConfig struct {
 	HostToken    string `yaml:"host_token"`
 	ManagerToken string `yaml:"manager_token"`
+
+	// Tokens are extra API tokens. They read everything, changes need the
+	// `admin` scope, or a narrower one on the routes accepting it, e.g.
+	// `volumes:write` for the volume file browser.
+	Tokens []APITokenConfig `yaml:"tokens,omitempty"`
+
+	// DataDir is where the daemon persists its state, defaults to /var/lib/cconnector
+	DataDir string `yaml:"data_dir,omitempty"`
+
+	Reconciler  ReconcilerConfig  `yaml:"reconciler,omitempty"`
+	AutoHeal    AutoHealConfig    `yaml:"auto_heal,omitempty"`
+	Webhooks    []WebhookConfig   `yaml:"webhooks,omitempty"`
+	Tunnel      TunnelConfig      `yaml:"tunnel,omitempty"`
+	Heartbeat   HeartbeatConfig   `yaml:"heartbeat,omitempty"`
+	Jobs        JobsConfig        `yaml:"jobs,omitempty"`
+	Idempotency IdempotencyConfig `yaml:"idempotency,omitempty"`
+	ImageGC     ImageGCConfig     `yaml:"image_gc,omitempty"`
+
+	ImageVerification ImageVerificationConfig `yaml:"image_verification,omitempty"`
+	RegistryMirror    RegistryMirrorConfig    `yaml:"registry_mirror,omitempty"`
+	VolumeBackup      VolumeBackupConfig      `yaml:"volume_backup,omitempty"`
+	VolumeSnapshots   []VolumeSnapshotConfig  `yaml:"volume_snapshots,omitempty"`
+}
+
+type APITokenConfig struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes,omitempty"`
+}
+
+type ReconcilerConfig struct {
+	// Interval between two reconciliation runs (ns|us|ms|s|m|h), defaults to 30s
+	Interval string `yaml:"interval,omitempty"`
+}
+
+type AutoHealConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Consecutive failed health probes before a restart, defaults to 3
+	Threshold int `yaml:"threshold,omitempty"`
+	// Maximum restarts of one container within Window, defaults to 5
+	MaxRestarts int `yaml:"max_restarts,omitempty"`
+	// Window for MaxRestarts (ns|us|ms|s|m|h), defaults to 1h
+	Window string `yaml:"window,omitempty"`
+	// Delay after the first restart, doubled up to BackoffMax, defaults to 10s
+	BackoffBase string `yaml:"backoff_base,omitempty"`
+	// Upper bound of the restart delay, defaults to 5m
+	BackoffMax string `yaml:"backoff_max,omitempty"`
+}
+
+type WebhookConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Events to deliver as `<type>.<action>`, e.g. `container.die`, `container.oom`,
+	// `container.health_status`, `image.pull` or `container.*`
+	Events []string `yaml:"events"`
+}
+
+type TunnelConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Manager tunnel endpoint, e.g. wss://manager.example.com/v1/tunnels
+	ManagerURL string `yaml:"manager_url"`
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+	CACert     string `yaml:"ca_cert,omitempty"`
+}
+
+type HeartbeatConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Manager heartbeat endpoint, e.g. https://manager.example.com/v1/heartbeats
+	URL string `yaml:"url"`
+	// Interval between two heartbeats (ns|us|ms|s|m|h), defaults to 30s
+	Interval string `yaml:"interval,omitempty"`
+}
+
+type JobsConfig struct {
+	// How long finished jobs are kept (ns|us|ms|s|m|h), defaults to 24h
+	Retention string `yaml:"retention,omitempty"`
+}
+
+type IdempotencyConfig struct {
+	// How long responses are kept for replay (ns|us|ms|s|m|h), defaults to 24h
+	TTL string `yaml:"ttl,omitempty"`
+}
+
+type ImageGCConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// How often disk usage is checked (ns|us|ms|s|m|h), defaults to 5m
+	Interval string `yaml:"interval,omitempty"`
+	// Disk used percent starting a collection, defaults to 85
+	HighWatermark float64 `yaml:"high_watermark,omitempty"`
+	// Disk used percent a collection stops at, defaults to 70
+	LowWatermark float64 `yaml:"low_watermark,omitempty"`
+	// Images younger than this are never removed (ns|us|ms|s|m|h), defaults to 24h
+	MinAge string `yaml:"min_age,omitempty"`
+	// Newest tagged images kept per repository, defaults to 3
+	KeepLastTags int `yaml:"keep_last_tags,omitempty"`
+	// Images with one of these labels are kept, `key` or `key=value` where value may contain `*`
+	ProtectedLabels []string `yaml:"protected_labels,omitempty"`
+	// Images with a reference matching one of these patterns are kept, e.g. `postgres:*`
+	ProtectedRefs []string `yaml:"protected_refs,omitempty"`
+}
+
+type ImageVerificationConfig struct {
+	// Reject pulls and container creations of images not signed by one of PublicKeys
+	Enabled bool `yaml:"enabled"`
+	// Paths of PEM encoded ECDSA or ed25519 public keys, as produced by `cosign generate-key-pair`
+	PublicKeys []string `yaml:"public_keys,omitempty"`
+	// Registries whose signatures are fetched over plain http, e.g. localhost:5000
+	InsecureRegistries []string `yaml:"insecure_registries,omitempty"`
+}
+
+type RegistryMirrorConfig struct {
+	// Serve a pull-through cache of upstream registries under /v2 for peers
+	Enabled bool `yaml:"enabled"`
+	// Size cap of the cached blobs in megabytes, defaults to 10240
+	CacheSizeMB int64 `yaml:"cache_size_mb,omitempty"`
+	// CIDRs of the peers allowed to pull public images without a token, defaults
+	// to loopback. Other peers log in with an API token as password,
+	// `docker login <host>:<port>`.
+	AllowedNetworks []string `yaml:"allowed_networks,omitempty"`
+	// Upstream registries fetched with the stored registry credentials, e.g.
+	// ghcr.io. Pulling from them always needs an API token, other registries
+	// are fetched anonymously.
+	CredentialRegistries []string `yaml:"credential_registries,omitempty"`
+	// `host:port` of a cconnector mirror image pulls go through, falling back to
+	// the upstream registry when unreachable. Peers serving over plain http must
+	// be listed in the docker daemon `insecure-registries`, and must list this
+	// host in their AllowedNetworks unless docker is logged in to them.
+	PullThrough string `yaml:"pull_through,omitempty"`
+}
+
+type VolumeBackupConfig struct {
+	// Image of the helper containers mounting volumes, the file browser runs
+	// `find`, `rm` and `sh` in it, defaults to busybox:latest. It must be signed
+	// when image verification is enabled.
+	HelperImage string `yaml:"helper_image,omitempty"`
+}
+
+type VolumeSnapshotConfig struct {
+	Name string `yaml:"name"`
+	// Cron expression `minute hour day-of-month month day-of-week` in local
+	// time, or @hourly, @daily, @weekly, @monthly
+	Schedule string `yaml:"schedule"`
+	// Volumes snapshotted by name
+	Volumes []string `yaml:"volumes,omitempty"`
+	// Volumes snapshotted by label, e.g. `backup=true,tier!=cache`
+	Selector string `yaml:"selector,omitempty"`
+	// Local directory snapshots are written to, unless S3 is set
+	Dir string                  `yaml:"dir,omitempty"`
+	S3  *VolumeSnapshotS3Config `yaml:"s3,omitempty"`
+	// Newest snapshot kept for each of the last N days, weeks and months
+	// having one, every snapshot is kept when all are 0
+	KeepDaily   int `yaml:"keep_daily,omitempty"`
+	KeepWeekly  int `yaml:"keep_weekly,omitempty"`
+	KeepMonthly int `yaml:"keep_monthly,omitempty"`
+	// Pause the running containers mounting a volume while it is read
+	PauseContainers bool `yaml:"pause_containers,omitempty"`
+}
+
+type VolumeSnapshotS3Config struct {
+	// e.g. https://s3.eu-west-1.amazonaws.com or http://minio.local:9000
+	Endpoint string `yaml:"endpoint"`
+	// Defaults to us-east-1
+	Region    string `yaml:"region,omitempty"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix,omitempty"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// GetDataDir returns the configured data dir or its default.
+func (c CconnectorConfig) GetDataDir() string {
+	if c.DataDir == "" {
+		return "/var/lib/cconnector"
+	}
+
+	return c.DataDir
 }
@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	AutoHealLabel          = "cconnector.autoheal"
+	AutoHealThresholdLabel = "cconnector.autoheal.threshold"
+
+	maxAutoHealActions = 500
+)
+
+type AutoHealOptions struct {
+	Threshold     int           // Consecutive failed health probes before restarting
+	MaxRestarts   int           // Maximum restarts of one container per window
+	Window        time.Duration // Window used for MaxRestarts
+	BackoffBase   time.Duration // Delay after the first restart, doubled on each following restart
+	BackoffMax    time.Duration
+	RecheckPeriod time.Duration // How often still unhealthy containers are inspected again
+}
+
+type AutoHealAction struct {
+	Time          time.Time `json:"time"`
+	ContainerID   string    `json:"container_id"`
+	ContainerName string    `json:"container_name"`
+	Action        string    `json:"action"` // restarted, skipped or failed
+	Reason        string    `json:"reason"`
+	FailingStreak int       `json:"failing_streak"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type autoHealState struct {
+	ContainerID   string      `json:"container_id"`
+	ContainerName string      `json:"container_name"`
+	Unhealthy     bool        `json:"unhealthy"`
+	FailingStreak int         `json:"failing_streak"`
+	Restarts      []time.Time `json:"restarts"`
+	NextAllowed   time.Time   `json:"next_allowed"`
+	CapReached    bool        `json:"cap_reached"`
+}
+
+// AutoHeal restarts containers labeled with `cconnector.autoheal=true` once
+// they have been unhealthy for enough consecutive health probes.
+type AutoHeal struct {
+	dockerClient *client.Client
+	options      AutoHealOptions
+
+	mu      sync.Mutex
+	states  map[string]*autoHealState
+	actions []AutoHealAction
+}
+
+func NewAutoHeal(dockerClient *client.Client, options AutoHealOptions) *AutoHeal {
+	return &AutoHeal{
+		dockerClient: dockerClient,
+		options:      options,
+		states:       map[string]*autoHealState{},
+		actions:      []AutoHealAction{},
+	}
+}
+
+// Run follows the docker events stream until ctx is done.
+func (a *AutoHeal) Run(ctx context.Context) {
+	go func() {
+		recheck := time.NewTicker(a.options.RecheckPeriod)
+		defer recheck.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-recheck.C:
+				a.recheck(ctx)
+			}
+		}
+	}()
+
+	followDockerEvents(ctx, a.dockerClient, filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("event", string(events.ActionHealthStatus)),
+		filters.Arg("event", string(events.ActionDestroy)),
+		filters.Arg("label", AutoHealLabel+"=true"),
+	), func(message events.Message) {
+		a.handle(ctx, message)
+	})
+}
+
+func (a *AutoHeal) handle(ctx context.Context, message events.Message) {
+	containerID := message.Actor.ID
+
+	switch {
+	case message.Action == events.ActionDestroy:
+		a.mu.Lock()
+		delete(a.states, containerID)
+		a.mu.Unlock()
+	case message.Action == events.ActionHealthStatusUnhealthy:
+		a.check(ctx, containerID)
+	case strings.HasPrefix(string(message.Action), string(events.ActionHealthStatus)):
+		a.mu.Lock()
+		if state, ok := a.states[containerID]; ok {
+			state.Unhealthy = false
+			state.FailingStreak = 0
+		}
+		a.mu.Unlock()
+	}
+}
+
+// recheck inspects containers that are still unhealthy. Docker only emits a
+// health event when the status changes, so the failing streak has to be
+// polled to notice it growing past the threshold.
+func (a *AutoHeal) recheck(ctx context.Context) {
+	a.mu.Lock()
+	unhealthy := []string{}
+	for containerID, state := range a.states {
+		if state.Unhealthy {
+			unhealthy = append(unhealthy, containerID)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, containerID := range unhealthy {
+		a.check(ctx, containerID)
+	}
+}
+
+func (a *AutoHeal) check(ctx context.Context, containerID string) {
+	containerJson, err := a.dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			a.mu.Lock()
+			delete(a.states, containerID)
+			a.mu.Unlock()
+			return
+		}
+
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("autoheal").Str("container_inspect")).
+			Str("container_id", containerID).
+			Msg("error inspecting unhealthy container")
+		return
+	}
+
+	if containerJson.Config == nil || containerJson.Config.Labels[AutoHealLabel] != "true" {
+		return
+	}
+
+	threshold := a.options.Threshold
+	if labelThreshold, err := strconv.Atoi(containerJson.Config.Labels[AutoHealThresholdLabel]); err == nil && labelThreshold > 0 {
+		threshold = labelThreshold
+	}
+
+	a.mu.Lock()
+	state, ok := a.states[containerID]
+	if !ok {
+		state = &autoHealState{ContainerID: containerID}
+		a.states[containerID] = state
+	}
+	state.ContainerName = strings.TrimPrefix(containerJson.Name, "/")
+
+	health := containerJson.State.Health
+	if health == nil || health.Status != types.Unhealthy {
+		state.Unhealthy = false
+		state.FailingStreak = 0
+		a.mu.Unlock()
+		return
+	}
+
+	state.Unhealthy = true
+	state.FailingStreak = health.FailingStreak
+	if state.FailingStreak < threshold {
+		a.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, restartedAt := range state.Restarts {
+		if now.Sub(restartedAt) < a.options.Window {
+			recent = append(recent, restartedAt)
+		}
+	}
+	state.Restarts = recent
+
+	action := AutoHealAction{
+		Time:          now,
+		ContainerID:   containerID,
+		ContainerName: state.ContainerName,
+		FailingStreak: state.FailingStreak,
+	}
+
+	if len(state.Restarts) >= a.options.MaxRestarts {
+		// Only record the first skip of a window to keep the log readable.
+		alreadyReached := state.CapReached
+		state.CapReached = true
+		a.mu.Unlock()
+		if alreadyReached {
+			return
+		}
+		action.Action = "skipped"
+		action.Reason = "restart cap reached for the current window"
+		a.record(action)
+		return
+	}
+
+	if now.Before(state.NextAllowed) {
+		a.mu.Unlock()
+		return
+	}
+
+	state.CapReached = false
+	state.Restarts = append(state.Restarts, now)
+	shift := len(state.Restarts) - 1
+	if shift > 16 {
+		shift = 16
+	}
+	state.NextAllowed = now.Add(minDuration(a.options.BackoffBase<<shift, a.options.BackoffMax))
+	a.mu.Unlock()
+
+	action.Reason = "failing streak reached threshold of " + strconv.Itoa(threshold)
+	timeout := 10
+	if err := a.dockerClient.ContainerRestart(ctx, containerID, container.StopOptions{Timeout: &timeout}); err != nil {
+		action.Action = "failed"
+		action.Error = err.Error()
+	} else {
+		action.Action = "restarted"
+	}
+	a.record(action)
+}
+
+func (a *AutoHeal) record(action AutoHealAction) {
+	event := log.Info()
+	if action.Error != "" {
+		event = log.Error().Str("error", action.Error)
+	}
+	event.
+		Array("tags", zerolog.Arr().Str("autoheal").Str(action.Action)).
+		Str("container_id", action.ContainerID).
+		Str("container_name", action.ContainerName).
+		Int("failing_streak", action.FailingStreak).
+		Str("reason", action.Reason).
+		Msg("autoheal action")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.actions = append(a.actions, action)
+	if len(a.actions) > maxAutoHealActions {
+		a.actions = a.actions[len(a.actions)-maxAutoHealActions:]
+	}
+}
+
+func (a *AutoHeal) Status(c echo.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	states := []autoHealState{}
+	for _, containerID := range sortedKeys(a.states) {
+		states = append(states, *a.states[containerID])
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": map[string]any{
+			"threshold":    a.options.Threshold,
+			"max_restarts": a.options.MaxRestarts,
+			"window":       a.options.Window.String(),
+			"backoff_base": a.options.BackoffBase.String(),
+			"backoff_max":  a.options.BackoffMax.String(),
+			"containers":   states,
+		},
+	})
+}
+
+// Actions lists the most recent actions, newest first. `container` narrows
+// the list down to one container id or name.
+func (a *AutoHeal) Actions(c echo.Context) error {
+	containerRef := c.QueryParam("container")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	actions := []AutoHealAction{}
+	for i := len(a.actions) - 1; i >= 0; i-- {
+		action := a.actions[i]
+		if containerRef != "" && action.ContainerName != containerRef && !strings.HasPrefix(action.ContainerID, containerRef) {
+			continue
+		}
+		actions = append(actions, action)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": actions,
+	})
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+
+	return b
+}
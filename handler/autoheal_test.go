@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+)
+
+// testAutoHealDocker serves one container, "web", with the health it is set
+// to, and records its restarts.
+type testAutoHealDocker struct {
+	mu            sync.Mutex
+	labels        map[string]string
+	status        string
+	failingStreak int
+	restarts      int
+}
+
+func (d *testAutoHealDocker) setHealth(status string, failingStreak int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+	d.failingStreak = failingStreak
+}
+
+func (d *testAutoHealDocker) restarted() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.restarts
+}
+
+func newTestAutoHeal(t *testing.T, options AutoHealOptions, labels map[string]string) (*AutoHeal, *testAutoHealDocker) {
+	t.Helper()
+
+	docker := &testAutoHealDocker{labels: labels, status: types.Healthy}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/web/json", func(w http.ResponseWriter, r *http.Request) {
+		docker.mu.Lock()
+		defer docker.mu.Unlock()
+		json.NewEncoder(w).Encode(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   "web",
+				Name: "/web",
+				State: &types.ContainerState{
+					Status: "running",
+					Health: &types.Health{Status: docker.status, FailingStreak: docker.failingStreak},
+				},
+			},
+			Config: &container.Config{Labels: docker.labels},
+		})
+	})
+	mux.HandleFunc("POST /containers/web/restart", func(w http.ResponseWriter, r *http.Request) {
+		docker.mu.Lock()
+		defer docker.mu.Unlock()
+		docker.restarts++
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"No such container"}`))
+	})
+
+	return NewAutoHeal(newTestDockerClient(t, mux), options), docker
+}
+
+// allowRestart ends the backoff of the container.
+func allowRestart(autoHeal *AutoHeal, containerID string) {
+	autoHeal.mu.Lock()
+	defer autoHeal.mu.Unlock()
+	autoHeal.states[containerID].NextAllowed = time.Time{}
+}
+
+func autoHealActions(autoHeal *AutoHeal) []string {
+	autoHeal.mu.Lock()
+	defer autoHeal.mu.Unlock()
+
+	actions := []string{}
+	for _, action := range autoHeal.actions {
+		actions = append(actions, action.Action)
+	}
+	return actions
+}
+
+func TestAutoHealThreshold(t *testing.T) {
+	tests := []struct {
+		name          string
+		labels        map[string]string
+		status        string
+		failingStreak int
+		wantRestarts  int
+	}{
+		{name: "healthy", labels: map[string]string{AutoHealLabel: "true"}, status: types.Healthy, wantRestarts: 0},
+		{name: "below threshold", labels: map[string]string{AutoHealLabel: "true"}, status: types.Unhealthy, failingStreak: 2, wantRestarts: 0},
+		{name: "threshold reached", labels: map[string]string{AutoHealLabel: "true"}, status: types.Unhealthy, failingStreak: 3, wantRestarts: 1},
+		{name: "label threshold", labels: map[string]string{AutoHealLabel: "true", AutoHealThresholdLabel: "5"}, status: types.Unhealthy, failingStreak: 4, wantRestarts: 0},
+		{name: "invalid label threshold", labels: map[string]string{AutoHealLabel: "true", AutoHealThresholdLabel: "0"}, status: types.Unhealthy, failingStreak: 3, wantRestarts: 1},
+		{name: "not opted in", labels: map[string]string{}, status: types.Unhealthy, failingStreak: 10, wantRestarts: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			autoHeal, docker := newTestAutoHeal(t, AutoHealOptions{Threshold: 3, MaxRestarts: 3, Window: time.Hour, BackoffBase: time.Hour, BackoffMax: time.Hour}, tt.labels)
+			docker.setHealth(tt.status, tt.failingStreak)
+
+			autoHeal.check(context.Background(), "web")
+
+			if restarts := docker.restarted(); restarts != tt.wantRestarts {
+				t.Errorf("restarts = %d, want %d", restarts, tt.wantRestarts)
+			}
+		})
+	}
+}
+
+func TestAutoHealBackoff(t *testing.T) {
+	autoHeal, docker := newTestAutoHeal(t, AutoHealOptions{Threshold: 1, MaxRestarts: 10, Window: time.Hour, BackoffBase: time.Minute, BackoffMax: 3 * time.Minute}, map[string]string{AutoHealLabel: "true"})
+	docker.setHealth(types.Unhealthy, 1)
+	ctx := context.Background()
+
+	// The delay doubles after each restart, up to BackoffMax.
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		startedAt := time.Now()
+		autoHeal.check(ctx, "web")
+		autoHeal.check(ctx, "web")
+		if restarts := docker.restarted(); restarts != i+1 {
+			t.Fatalf("restarts = %d, want %d", restarts, i+1)
+		}
+
+		autoHeal.mu.Lock()
+		delay := autoHeal.states["web"].NextAllowed.Sub(startedAt)
+		autoHeal.mu.Unlock()
+		if delay < want || delay > want+time.Second {
+			t.Errorf("restart %d: next allowed after %v, want %v", i+1, delay, want)
+		}
+
+		allowRestart(autoHeal, "web")
+	}
+
+	// Recovering resets the failing streak, not the backoff.
+	autoHeal.handle(ctx, events.Message{Action: events.ActionHealthStatusHealthy, Actor: events.Actor{ID: "web"}})
+	autoHeal.mu.Lock()
+	state := *autoHeal.states["web"]
+	autoHeal.mu.Unlock()
+	if state.Unhealthy || state.FailingStreak != 0 || len(state.Restarts) != 4 {
+		t.Errorf("state = %+v, want healthy with the restarts kept", state)
+	}
+}
+
+func TestAutoHealRestartCap(t *testing.T) {
+	autoHeal, docker := newTestAutoHeal(t, AutoHealOptions{Threshold: 1, MaxRestarts: 2, Window: time.Hour, BackoffBase: time.Minute, BackoffMax: time.Minute}, map[string]string{AutoHealLabel: "true"})
+	docker.setHealth(types.Unhealthy, 1)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		autoHeal.check(ctx, "web")
+		allowRestart(autoHeal, "web")
+	}
+
+	// Only the first skip of the window is recorded.
+	want := []string{"restarted", "restarted", "skipped"}
+	if got := autoHealActions(autoHeal); !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+	if restarts := docker.restarted(); restarts != 2 {
+		t.Errorf("restarts = %d, want 2", restarts)
+	}
+
+	// Restarts that left the window no longer count towards the cap.
+	autoHeal.mu.Lock()
+	state := autoHeal.states["web"]
+	for i := range state.Restarts {
+		state.Restarts[i] = state.Restarts[i].Add(-2 * time.Hour)
+	}
+	autoHeal.mu.Unlock()
+
+	autoHeal.check(ctx, "web")
+	want = append(want, "restarted")
+	if got := autoHealActions(autoHeal); !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+}
+
+func TestAutoHealForgetsRemovedContainers(t *testing.T) {
+	autoHeal, docker := newTestAutoHeal(t, AutoHealOptions{Threshold: 3, MaxRestarts: 1, Window: time.Hour, BackoffBase: time.Minute, BackoffMax: time.Minute}, map[string]string{AutoHealLabel: "true"})
+	docker.setHealth(types.Unhealthy, 1)
+	ctx := context.Background()
+
+	autoHeal.check(ctx, "web")
+	autoHeal.handle(ctx, events.Message{Action: events.ActionDestroy, Actor: events.Actor{ID: "web"}})
+	autoHeal.mu.Lock()
+	autoHeal.states["missing"] = &autoHealState{ContainerID: "missing", Unhealthy: true}
+	autoHeal.mu.Unlock()
+
+	autoHeal.recheck(ctx)
+
+	autoHeal.mu.Lock()
+	defer autoHeal.mu.Unlock()
+	if len(autoHeal.states) != 0 {
+		t.Errorf("states = %v, want none", sortedKeys(autoHeal.states))
+	}
+}
@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strconv"
@@ -23,6 +25,24 @@ func UnprocessableEntityResponseBody(message string) map[string]any {
 	}
 }
 
+func NotFoundResponseBody(message string) map[string]any {
+	return map[string]any{
+		"message": fmt.Sprintf("Resource not found: `%s`", message),
+	}
+}
+
+func PayloadTooLargeResponseBody(message string) map[string]any {
+	return map[string]any{
+		"message": fmt.Sprintf("Payload too large: `%s`", message),
+	}
+}
+
+func ForbiddenResponseBody(message string) map[string]any {
+	return map[string]any{
+		"message": fmt.Sprintf("Forbidden: `%s`", message),
+	}
+}
+
 func InternalServerErrorResponseBody() map[string]any {
 	return map[string]any{
 		"message": "Internal server error",
@@ -140,3 +160,11 @@ func getMachineSpecs() (MachineSpec, error) {
 
 	return specs, nil
 }
+
+// newRandomID returns a random 128 bit hex identifier.
+func newRandomID() string {
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+
+	return hex.EncodeToString(raw)
+}
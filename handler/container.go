@@ -1,17 +1,21 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-connections/nat"
 	"github.com/labstack/echo/v4"
 	v1 "github.com/moby/docker-image-spec/specs-go/v1"
@@ -53,6 +57,7 @@ type ContainerCreationRequest struct {
 		Name              string `json:"name"`                // no, always, unless-stopped, on-failure
 		MaximumRetryCount int    `json:"maximum_retry_count"` // Maximum number of retries (only for on-failure)
 	} `json:"restart_policy"`
+	Managed bool `json:"managed"` // Keep the container converged to this spec by the reconciler
 }
 
 type ContainerStartRequest struct {
@@ -73,11 +78,14 @@ type ContainerExecRequest struct {
 // Handler
 
 type Container struct {
-	dockerClient *client.Client
+	dockerClient      *client.Client
+	managedContainers *ManagedContainerStore
+	credentials       *RegistryCredentialStore
+	verifier          *ImageVerifier // Nil when image verification is disabled
 }
 
-func NewContainer(dockerClient *client.Client) *Container {
-	return &Container{dockerClient: dockerClient}
+func NewContainer(dockerClient *client.Client, managedContainers *ManagedContainerStore, credentials *RegistryCredentialStore, verifier *ImageVerifier) *Container {
+	return &Container{dockerClient: dockerClient, managedContainers: managedContainers, credentials: credentials, verifier: verifier}
 }
 
 func (c *Container) Start(echoContext echo.Context) error {
@@ -91,6 +99,15 @@ func (c *Container) Start(echoContext echo.Context) error {
 		_ = echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot empty"))
 	}
 
+	if err := c.managedContainers.SetDesiredState(containerID, ManagedStateRunning); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("start").Str("managed_state")).
+			Stack().
+			Msg("error persisting managed container state")
+		_ = echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+		return err
+	}
+
 	err := c.dockerClient.ContainerStart(echoContext.Request().Context(), containerID, container.StartOptions{})
 	if err != nil {
 		log.Err(err).
@@ -128,7 +145,86 @@ func (c *Container) Create(echoContext echo.Context) error {
 		return err
 	}
 
+	if creationRequest.Managed {
+		if creationRequest.Name == "" {
+			return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("managed container must have a name"))
+		}
+
+		if creationRequest.Labels == nil {
+			creationRequest.Labels = Label{}
+		}
+		creationRequest.Labels[ManagedContainerLabel] = "true"
+	}
+
+	// Images missing on the host are pulled with the registry credentials stored on the daemon
 	imageRef := fmt.Sprintf("%s:%s", creationRequest.ImageSource, creationRequest.ImageTag)
+	pinnedRef, err := ensureImage(echoContext.Request().Context(), c.dockerClient, c.credentials, c.verifier, imageRef)
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("create").Str("image_pull")).
+			Str("image", imageRef).
+			Stack().
+			Msg("error ensuring image of container")
+		_ = echoContext.JSON(imageErrorResponse(err))
+		return err
+	}
+
+	createResp, err := createContainer(echoContext.Request().Context(), c.dockerClient, creationRequest, pinnedRef)
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("create").Str("container_create")).
+			Stack().
+			Msg("error creating container")
+		_ = echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+		return err
+	}
+
+	containerJson, err := c.dockerClient.ContainerInspect(echoContext.Request().Context(), createResp.ID)
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("create").Str("container_inspect")).
+			Stack().
+			Msg("error inspecting newly created container")
+		_ = echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+		return err
+	}
+
+	if creationRequest.Managed {
+		if err := c.managedContainers.Save(ManagedContainerSpec{
+			Name:         creationRequest.Name,
+			ContainerID:  createResp.ID,
+			Request:      creationRequest,
+			ImageDigest:  containerJson.Image,
+			CreatedAt:    time.Now(),
+			DesiredState: ManagedStateStopped, // Not started until asked to
+		}); err != nil {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("container").Str("create").Str("managed_save")).
+				Stack().
+				Msg("error persisting managed container spec")
+			_ = echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+			return err
+		}
+	}
+
+	_ = echoContext.JSON(http.StatusOK, containerJson)
+	return nil
+}
+
+// create is the create endpoint without the http layer.
+func (c *Container) create(ctx context.Context, creationRequest ContainerCreationRequest) (container.CreateResponse, error) {
+	imageRef := fmt.Sprintf("%s:%s", creationRequest.ImageSource, creationRequest.ImageTag)
+	pinnedRef, err := ensureImage(ctx, c.dockerClient, c.credentials, c.verifier, imageRef)
+	if err != nil {
+		return container.CreateResponse{}, fmt.Errorf("image %s: %w", imageRef, err)
+	}
+
+	return createContainer(ctx, c.dockerClient, creationRequest, pinnedRef)
+}
+
+// createContainer translates a creation request into docker configs and
+// creates the container from imageRef, as returned by ensureImage.
+func createContainer(ctx context.Context, dockerClient *client.Client, creationRequest ContainerCreationRequest, imageRef string) (container.CreateResponse, error) {
 
 	envVariables := []string{}
 	for _, env := range creationRequest.Environments {
@@ -157,14 +253,9 @@ func (c *Container) Create(echoContext echo.Context) error {
 	networkEndpointConfigs := map[string]*network.EndpointSettings{}
 	for _, n := range creationRequest.Networks {
 		if _, ok := networkEndpointConfigs[n]; !ok {
-			networkResp, err := c.dockerClient.NetworkInspect(echoContext.Request().Context(), n, types.NetworkInspectOptions{Verbose: true})
+			networkResp, err := dockerClient.NetworkInspect(ctx, n, types.NetworkInspectOptions{Verbose: true})
 			if err != nil {
-				log.Err(err).
-					Array("tags", zerolog.Arr().Str("container").Str("create").Str("network").Str("network_inspect")).
-					Stack().
-					Msg("error creating container")
-				_ = echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
-				return err
+				return container.CreateResponse{}, fmt.Errorf("inspecting network %s: %w", n, err)
 			}
 			networkEndpointConfigs[n] = &network.EndpointSettings{
 				NetworkID: networkResp.ID,
@@ -181,13 +272,13 @@ func (c *Container) Create(echoContext echo.Context) error {
 		Labels: creationRequest.Labels,
 	}
 
-	healthcheck, err := c.parseHealthcheck(creationRequest)
+	healthcheck, err := parseHealthcheck(creationRequest)
 	if err == nil {
 		containerConfig.Healthcheck = &healthcheck
 	}
 
-	createResp, err := c.dockerClient.ContainerCreate(
-		echoContext.Request().Context(),
+	return dockerClient.ContainerCreate(
+		ctx,
 		containerConfig,
 		&container.HostConfig{
 			Binds:        volumeBinds,
@@ -203,39 +294,103 @@ func (c *Container) Create(echoContext echo.Context) error {
 		nil,
 		creationRequest.Name,
 	)
+}
+
+func (c *Container) List(echoContext echo.Context) error {
+	filterArgs := filters.NewArgs()
+
+	if filterStr := echoContext.QueryParam("filters"); filterStr != "" {
+		var filterMap map[string][]string
+		if err := json.Unmarshal([]byte(filterStr), &filterMap); err != nil {
+			return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("filters contains invalid json format"))
+		}
+		for key, values := range filterMap {
+			for _, val := range values {
+				filterArgs.Add(key, val)
+			}
+		}
+	}
+
+	selector, err := ParseLabelSelector(echoContext.QueryParam("label_selector"))
 	if err != nil {
-		log.Err(err).
-			Array("tags", zerolog.Arr().Str("container").Str("create").Str("container_create")).
-			Stack().
-			Msg("error creating container")
-		_ = echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
-		return err
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
 	}
 
-	containerJson, err := c.dockerClient.ContainerInspect(echoContext.Request().Context(), createResp.ID)
+	page, err := parsePageRequest(echoContext)
 	if err != nil {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	containers, err := c.dockerClient.ContainerList(echoContext.Request().Context(), container.ListOptions{
+		All:     echoContext.QueryParam("all") == "true",
+		Filters: filterArgs,
+	})
+	if err != nil {
+		if errdefs.IsInvalidParameter(err) {
+			return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+		}
+
 		log.Err(err).
-			Array("tags", zerolog.Arr().Str("container").Str("create").Str("container_inspect")).
+			Array("tags", zerolog.Arr().Str("container").Str("list").Str("container_list")).
 			Stack().
-			Msg("error inspecting newly created container")
-		_ = echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
-		return err
+			Msg("error listing containers")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
 	}
 
-	_ = echoContext.JSON(http.StatusOK, containerJson)
-	return nil
-}
+	matched := []types.Container{}
+	for _, ctr := range containers {
+		if selector.Matches(ctr.Labels) {
+			matched = append(matched, ctr)
+		}
+	}
 
-func (c *Container) List(echoContext echo.Context) error {
-	containers, err := c.dockerClient.ContainerList(echoContext.Request().Context(), container.ListOptions{})
-	if err != nil {
-		return echoContext.JSON(http.StatusInternalServerError, map[any]any{
-			"message": "internal server error",
+	// Newest first, the same order docker uses, with the id as tie breaker
+	// so the cursor stays stable.
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Created != matched[j].Created {
+			return matched[i].Created > matched[j].Created
+		}
+		return matched[i].ID < matched[j].ID
+	})
+
+	start := 0
+	if page.after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return matched[i].Created < page.after.created ||
+				(matched[i].Created == page.after.created && matched[i].ID > page.after.id)
 		})
 	}
 
-	// TODO: use json api standard
-	return echoContext.JSON(http.StatusOK, containers)
+	end := start + page.limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	pageItems := matched[start:end]
+
+	nextCursor := ""
+	if end < len(matched) {
+		last := pageItems[len(pageItems)-1]
+		nextCursor = encodeListCursor(listCursor{created: last.Created, id: last.ID})
+	}
+
+	data, err := projectFields(pageItems, page.fields)
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("list").Str("projection")).
+			Stack().
+			Msg("error projecting container fields")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return echoContext.JSON(http.StatusOK, map[string]any{
+		"data": data,
+		"meta": PageMeta{
+			Count:      len(pageItems),
+			Total:      len(matched),
+			Limit:      page.limit,
+			NextCursor: nextCursor,
+		},
+	})
 }
 
 func (c *Container) Stop(echoContext echo.Context) error {
@@ -249,6 +404,15 @@ func (c *Container) Stop(echoContext echo.Context) error {
 		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot be empty"))
 	}
 
+	// Recorded first so the reconciler does not start it again meanwhile
+	if err := c.managedContainers.SetDesiredState(containerID, ManagedStateStopped); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("stop").Str("managed_state")).
+			Stack().
+			Msg("error persisting managed container state")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
 	// Use a default timeout of 10 seconds
 	timeout := int(10 * time.Second)
 	err := c.dockerClient.ContainerStop(echoContext.Request().Context(), containerID, container.StopOptions{Timeout: &timeout})
@@ -292,6 +456,15 @@ func (c *Container) Remove(echoContext echo.Context) error {
 		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
 	}
 
+	// Removing through the API is an explicit intent, the reconciler must not
+	// bring the container back.
+	if err := c.managedContainers.Forget(containerID); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("remove").Str("managed_forget")).
+			Stack().
+			Msg("error forgetting managed container spec")
+	}
+
 	return echoContext.JSON(http.StatusOK, map[string]interface{}{
 		"message": "Container removed successfully",
 		"id":      containerID,
@@ -534,6 +707,14 @@ func (c *Container) Restart(echoContext echo.Context) error {
 		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot be empty"))
 	}
 
+	if err := c.managedContainers.SetDesiredState(containerID, ManagedStateRunning); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("restart").Str("managed_state")).
+			Stack().
+			Msg("error persisting managed container state")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
 	// Default timeout of 10 seconds
 	timeout := int(10 * time.Second)
 	err := c.dockerClient.ContainerRestart(echoContext.Request().Context(), containerID, container.StopOptions{Timeout: &timeout})
@@ -586,7 +767,7 @@ func (c *Container) Stats(echoContext echo.Context) error {
 	return echoContext.JSON(http.StatusOK, containerStats)
 }
 
-func (c *Container) parseHealthcheck(request ContainerCreationRequest) (v1.HealthcheckConfig, error) {
+func parseHealthcheck(request ContainerCreationRequest) (v1.HealthcheckConfig, error) {
 	interval, err := time.ParseDuration(request.Healthcheck.Interval)
 	if err != nil {
 		return v1.HealthcheckConfig{}, err
@@ -0,0 +1,343 @@
+package handler
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// MaxArchiveTransferSize caps the number of bytes that can be copied in or
+// out of a container through the archive endpoints.
+var MaxArchiveTransferSize int64 = 512 * 1024 * 1024
+
+var ErrInvalidContainerPath = errors.New("invalid container path")
+var ErrArchiveTooLarge = errors.New("archive exceeds maximum transfer size")
+
+// validateContainerPath makes sure the path is absolute and does not try to
+// escape its parent with `..` elements.
+func validateContainerPath(p string) (string, error) {
+	if p == "" || !strings.HasPrefix(p, "/") || strings.ContainsRune(p, 0) {
+		return "", ErrInvalidContainerPath
+	}
+
+	for _, element := range strings.Split(p, "/") {
+		if element == ".." {
+			return "", ErrInvalidContainerPath
+		}
+	}
+
+	return path.Clean(p), nil
+}
+
+// validateArchiveFilename makes sure the name is a single path element.
+func validateArchiveFilename(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return ErrInvalidContainerPath
+	}
+
+	return nil
+}
+
+func (c *Container) StatPath(echoContext echo.Context) error {
+	containerID := echoContext.Param("id")
+
+	if len(containerID) == 0 {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot be empty"))
+	}
+
+	containerPath, err := validateContainerPath(echoContext.QueryParam("path"))
+	if err != nil {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("path must be an absolute path without `..`"))
+	}
+
+	stat, err := c.dockerClient.ContainerStatPath(echoContext.Request().Context(), containerID, containerPath)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return echoContext.JSON(http.StatusNotFound, NotFoundResponseBody("path or container not found"))
+		}
+
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("stat_path")).
+			Str("path", containerPath).
+			Stack().
+			Msg("error getting container path stat")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return echoContext.JSON(http.StatusOK, map[string]any{
+		"data": map[string]any{
+			"name":        stat.Name,
+			"size":        stat.Size,
+			"mode":        stat.Mode.String(),
+			"is_dir":      stat.Mode.IsDir(),
+			"mtime":       stat.Mtime,
+			"link_target": stat.LinkTarget,
+		},
+	})
+}
+
+// CopyFrom downloads a path from the container. Regular files are returned raw
+// unless `format=tar` is given, directories are streamed as tar or, with
+// `format=tar.gz`, as a gzip compressed tar.
+func (c *Container) CopyFrom(echoContext echo.Context) error {
+	containerID := echoContext.Param("id")
+
+	if len(containerID) == 0 {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot be empty"))
+	}
+
+	containerPath, err := validateContainerPath(echoContext.QueryParam("path"))
+	if err != nil {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("path must be an absolute path without `..`"))
+	}
+
+	format := echoContext.QueryParam("format")
+	if format != "" && format != "raw" && format != "tar" && format != "tar.gz" {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("format must be one of raw, tar or tar.gz"))
+	}
+
+	rc, stat, err := c.dockerClient.CopyFromContainer(echoContext.Request().Context(), containerID, containerPath)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return echoContext.JSON(http.StatusNotFound, NotFoundResponseBody("path or container not found"))
+		}
+
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("copy_from_container")).
+			Str("path", containerPath).
+			Stack().
+			Msg("error copying from container")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer rc.Close()
+
+	if !stat.Mode.IsDir() && stat.Size > MaxArchiveTransferSize {
+		return echoContext.JSON(http.StatusRequestEntityTooLarge, PayloadTooLargeResponseBody(ErrArchiveTooLarge.Error()))
+	}
+
+	if stat.Mode.IsDir() && format == "raw" {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("directories can only be downloaded as tar or tar.gz"))
+	}
+
+	if stat.Mode.IsRegular() && (format == "" || format == "raw") {
+		return c.writeRawFile(echoContext, rc, stat)
+	}
+
+	return c.writeArchive(echoContext, rc, stat, format == "tar.gz")
+}
+
+func (c *Container) writeRawFile(echoContext echo.Context, rc io.Reader, stat types.ContainerPathStat) error {
+	tarReader := tar.NewReader(rc)
+
+	header, err := tarReader.Next()
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("tar_read")).
+			Stack().
+			Msg("error reading archive header")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(stat.Name))
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+
+	echoContext.Response().Header().Set(echo.HeaderContentType, contentType)
+	echoContext.Response().Header().Set(echo.HeaderContentLength, fmt.Sprintf("%d", header.Size))
+	echoContext.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": stat.Name}))
+	echoContext.Response().WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(echoContext.Response(), tarReader); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("stream")).
+			Stack().
+			Msg("error streaming file from container")
+	}
+
+	return nil
+}
+
+// writeArchive spools the tar first so an archive over MaxArchiveTransferSize,
+// counted uncompressed, is rejected before the response starts.
+func (c *Container) writeArchive(echoContext echo.Context, rc io.Reader, stat types.ContainerPathStat, compress bool) error {
+	spool, err := os.CreateTemp("", "cconnector-archive-*")
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("spool")).
+			Stack().
+			Msg("error creating spool file")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, io.LimitReader(rc, MaxArchiveTransferSize+1))
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("spool")).
+			Stack().
+			Msg("error reading archive from container")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	if size > MaxArchiveTransferSize {
+		return echoContext.JSON(http.StatusRequestEntityTooLarge, PayloadTooLargeResponseBody(ErrArchiveTooLarge.Error()))
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	filename := stat.Name + ".tar"
+	contentType := "application/x-tar"
+	if compress {
+		filename += ".gz"
+		contentType = "application/gzip"
+	} else {
+		echoContext.Response().Header().Set(echo.HeaderContentLength, fmt.Sprintf("%d", size))
+	}
+
+	echoContext.Response().Header().Set(echo.HeaderContentType, contentType)
+	echoContext.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	echoContext.Response().WriteHeader(http.StatusOK)
+
+	var w io.Writer = echoContext.Response()
+	if compress {
+		gzipWriter := gzip.NewWriter(echoContext.Response())
+		defer gzipWriter.Close()
+		w = gzipWriter
+	}
+
+	if _, err := io.Copy(w, spool); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("stream")).
+			Stack().
+			Msg("error streaming archive from container")
+	}
+
+	return nil
+}
+
+// CopyTo uploads content into a directory of the container. Tar bodies
+// (optionally gzip compressed) are extracted as-is, any other body is stored
+// as a single file named by the `filename` query param.
+func (c *Container) CopyTo(echoContext echo.Context) error {
+	containerID := echoContext.Param("id")
+
+	if len(containerID) == 0 {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot be empty"))
+	}
+
+	containerPath, err := validateContainerPath(echoContext.QueryParam("path"))
+	if err != nil {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("path must be an absolute path without `..`"))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(echoContext.Request().Header.Get(echo.HeaderContentType))
+	isArchive := mediaType == "application/x-tar" || mediaType == "application/gzip" || mediaType == "application/x-gzip"
+
+	filename := echoContext.QueryParam("filename")
+	if !isArchive {
+		if err := validateArchiveFilename(filename); err != nil {
+			return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("filename must be a single path element when uploading a raw file"))
+		}
+	}
+
+	// Compressed archives are spooled decompressed, the cap applies to what
+	// ends up in the container and not to the compressed size.
+	body := bufio.NewReader(echoContext.Request().Body)
+	var upload io.Reader = body
+	if magic, _ := body.Peek(2); isArchive && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("body is not a valid gzip stream"))
+		}
+		defer gzipReader.Close()
+		upload = gzipReader
+	}
+
+	// Spool the body to disk first so oversized uploads are rejected before
+	// anything is written into the container.
+	spool, err := os.CreateTemp("", "cconnector-archive-*")
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("spool")).
+			Stack().
+			Msg("error creating spool file")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, io.LimitReader(upload, MaxArchiveTransferSize+1))
+	if err != nil {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("failed to read request body"))
+	}
+	if size > MaxArchiveTransferSize {
+		return echoContext.JSON(http.StatusRequestEntityTooLarge, PayloadTooLargeResponseBody(ErrArchiveTooLarge.Error()))
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	var content io.Reader = spool
+	if !isArchive {
+		pr, pw := io.Pipe()
+		go func() {
+			tarWriter := tar.NewWriter(pw)
+			err := tarWriter.WriteHeader(&tar.Header{
+				Name:     filename,
+				Mode:     0644,
+				Size:     size,
+				Typeflag: tar.TypeReg,
+			})
+			if err == nil {
+				_, err = io.Copy(tarWriter, spool)
+			}
+			if err == nil {
+				err = tarWriter.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		content = pr
+	}
+
+	err = c.dockerClient.CopyToContainer(echoContext.Request().Context(), containerID, containerPath, content, types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: echoContext.QueryParam("overwrite_dir_with_file") == "true",
+		CopyUIDGID:                echoContext.QueryParam("copy_uid_gid") == "true",
+	})
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return echoContext.JSON(http.StatusNotFound, NotFoundResponseBody("path or container not found"))
+		}
+
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("archive").Str("copy_to_container")).
+			Str("path", containerPath).
+			Stack().
+			Msg("error copying to container")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return echoContext.JSON(http.StatusOK, map[string]any{
+		"message": "Content copied successfully",
+		"id":      containerID,
+		"path":    containerPath,
+		"size":    size,
+	})
+}
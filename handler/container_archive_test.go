@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/labstack/echo/v4"
+)
+
+func TestValidateContainerPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/etc/hosts", want: "/etc/hosts"},
+		{path: "/var//log/", want: "/var/log"},
+		{path: "/a/./b", want: "/a/b"},
+		{path: "/", want: "/"},
+		{path: "", wantErr: true},
+		{path: "etc/hosts", wantErr: true},
+		{path: "/etc/../root", wantErr: true},
+		{path: "/..", wantErr: true},
+		{path: "/etc/hosts\x00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := validateContainerPath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateContainerPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("validateContainerPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidateArchiveFilename(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b", "a\x00"} {
+		if err := validateArchiveFilename(name); err == nil {
+			t.Errorf("validateArchiveFilename(%q) accepted", name)
+		}
+	}
+	if err := validateArchiveFilename("notes.txt"); err != nil {
+		t.Errorf("validateArchiveFilename(notes.txt) = %v", err)
+	}
+}
+
+func testDirectoryArchive(t *testing.T, size int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "data/zeros", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(size)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tarWriter.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCopyFromDirectoryCap(t *testing.T) {
+	archive := testDirectoryArchive(t, 64*1024)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/app/archive", func(w http.ResponseWriter, r *http.Request) {
+		setPathStat(t, w, types.ContainerPathStat{Name: "data", Mode: os.ModeDir | 0755})
+		w.Write(archive)
+	})
+	container := NewContainer(newTestDockerClient(t, mux), nil, nil, nil)
+
+	defer func(limit int64) { MaxArchiveTransferSize = limit }(MaxArchiveTransferSize)
+
+	tests := []struct {
+		name   string
+		format string
+		limit  int64
+		want   int
+	}{
+		{name: "tar within cap", format: "tar", limit: int64(len(archive)), want: http.StatusOK},
+		{name: "tar over cap", format: "tar", limit: int64(len(archive)) - 1, want: http.StatusRequestEntityTooLarge},
+		// Zeros compress far below the cap, which counts uncompressed bytes.
+		{name: "tar.gz over cap", format: "tar.gz", limit: int64(len(archive)) - 1, want: http.StatusRequestEntityTooLarge},
+		{name: "tar.gz within cap", format: "tar.gz", limit: int64(len(archive)), want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxArchiveTransferSize = tt.limit
+
+			request := httptest.NewRequest(http.MethodGet, "/?path=/data&format="+tt.format, nil)
+			recorder := httptest.NewRecorder()
+			c := echo.New().NewContext(request, recorder)
+			c.SetParamNames("id")
+			c.SetParamValues("app")
+
+			if err := container.CopyFrom(c); err != nil {
+				t.Fatal(err)
+			}
+			if recorder.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.want, recorder.Body.String())
+			}
+			if tt.want == http.StatusOK && tt.format == "tar" && !bytes.Equal(recorder.Body.Bytes(), archive) {
+				t.Fatalf("archive changed in transit")
+			}
+		})
+	}
+}
+
+func TestCopyToCapsDecompressedSize(t *testing.T) {
+	var copied []byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /containers/app/archive", func(w http.ResponseWriter, r *http.Request) {
+		copied, _ = io.ReadAll(r.Body)
+	})
+	container := NewContainer(newTestDockerClient(t, mux), nil, nil, nil)
+
+	// A few KB of zeros once compressed.
+	plain := testTarball(t, []testTarEntry{{name: "zeros.bin", body: string(make([]byte, 256*1024))}}, false)
+	compressed := testTarball(t, []testTarEntry{{name: "zeros.bin", body: string(make([]byte, 256*1024))}}, true)
+
+	defer func(limit int64) { MaxArchiveTransferSize = limit }(MaxArchiveTransferSize)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		limit       int64
+		want        int
+	}{
+		{name: "tar within cap", contentType: "application/x-tar", body: plain, limit: int64(len(plain)), want: http.StatusOK},
+		{name: "tar over cap", contentType: "application/x-tar", body: plain, limit: int64(len(plain)) - 1, want: http.StatusRequestEntityTooLarge},
+		{name: "tar.gz within cap", contentType: "application/gzip", body: compressed, limit: int64(len(plain)), want: http.StatusOK},
+		{name: "tar.gz decompressing over cap", contentType: "application/gzip", body: compressed, limit: int64(len(compressed)) * 2, want: http.StatusRequestEntityTooLarge},
+		// Sent as a plain tar, still decompressed before counting.
+		{name: "gzip sent as tar", contentType: "application/x-tar", body: compressed, limit: int64(len(compressed)) * 2, want: http.StatusRequestEntityTooLarge},
+		{name: "truncated gzip", contentType: "application/gzip", body: compressed[:len(compressed)/2], limit: int64(len(plain)), want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxArchiveTransferSize = tt.limit
+			copied = nil
+
+			request := httptest.NewRequest(http.MethodPut, "/?path=/data", bytes.NewReader(tt.body))
+			request.Header.Set(echo.HeaderContentType, tt.contentType)
+			recorder := httptest.NewRecorder()
+			c := echo.New().NewContext(request, recorder)
+			c.SetParamNames("id")
+			c.SetParamValues("app")
+
+			if err := container.CopyTo(c); err != nil {
+				t.Fatal(err)
+			}
+			if recorder.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.want, recorder.Body.String())
+			}
+			if tt.want == http.StatusOK && !bytes.Equal(copied, plain) {
+				t.Errorf("copied %d bytes, want the %d bytes of the uncompressed tar", len(copied), len(plain))
+			}
+			if tt.want != http.StatusOK && copied != nil {
+				t.Errorf("content was copied into the container")
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultBulkConcurrency = 4
+	maxBulkConcurrency     = 16
+)
+
+var bulkActions = []string{"start", "stop", "restart", "pause", "unpause", "remove", "kill"}
+
+type ContainerBulkRequest struct {
+	Action        string   `json:"action"`         // start, stop, restart, pause, unpause, remove or kill
+	IDs           []string `json:"ids"`            // Container ids or names, takes precedence over label_selector
+	LabelSelector string   `json:"label_selector"` // Kubernetes-style selector, e.g. `app=web,tier!=db`
+	DryRun        bool     `json:"dry_run"`
+	Concurrency   int      `json:"concurrency"`
+	Timeout       *int     `json:"timeout"` // Seconds to wait before killing on stop and restart
+	Signal        string   `json:"signal"`  // Signal sent on kill, defaults to SIGKILL
+	Force         bool     `json:"force"`   // Force removal of running containers
+	RemoveVolumes bool     `json:"remove_volumes"`
+}
+
+type ContainerBulkResult struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	State  string `json:"state,omitempty"`
+	Status string `json:"status"` // ok, error, not_found, or planned on dry run
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkTarget struct {
+	id    string
+	name  string
+	state string
+	err   error // Why an explicitly given container cannot be acted on
+}
+
+func (c *Container) Bulk(echoContext echo.Context) error {
+	var bulkRequest ContainerBulkRequest
+	if err := json.NewDecoder(echoContext.Request().Body).Decode(&bulkRequest); err != nil {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("body contains invalid json format"))
+	}
+
+	if !containsString(bulkActions, bulkRequest.Action) {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("action must be one of "+strings.Join(bulkActions, ", ")))
+	}
+
+	if len(bulkRequest.IDs) == 0 && bulkRequest.LabelSelector == "" {
+		return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody("either ids or label_selector must be given"))
+	}
+
+	concurrency := bulkRequest.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultBulkConcurrency
+	}
+	if concurrency > maxBulkConcurrency {
+		concurrency = maxBulkConcurrency
+	}
+
+	targets, err := c.resolveBulkTargets(echoContext.Request().Context(), bulkRequest)
+	if err != nil {
+		if errors.Is(err, ErrInvalidLabelSelector) {
+			return echoContext.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+		}
+
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("container").Str("bulk").Str("resolve_targets")).
+			Stack().
+			Msg("error resolving bulk targets")
+		return echoContext.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	results := make([]ContainerBulkResult, len(targets))
+	for i, target := range targets {
+		results[i] = ContainerBulkResult{ID: target.id, Name: target.name, State: target.state, Status: "planned"}
+		if target.err != nil {
+			results[i].Status = "error"
+			if errdefs.IsNotFound(target.err) {
+				results[i].Status = "not_found"
+			}
+			results[i].Error = target.err.Error()
+		}
+	}
+
+	if !bulkRequest.DryRun {
+		semaphore := make(chan struct{}, concurrency)
+		wg := sync.WaitGroup{}
+
+		for i := range targets {
+			if targets[i].err != nil {
+				continue
+			}
+
+			wg.Add(1)
+			semaphore <- struct{}{}
+
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-semaphore }()
+
+				if err := c.runBulkAction(echoContext.Request().Context(), bulkRequest, targets[i].id); err != nil {
+					log.Err(err).
+						Array("tags", zerolog.Arr().Str("container").Str("bulk").Str(bulkRequest.Action)).
+						Str("container_id", targets[i].id).
+						Msg("error running bulk action")
+					results[i].Status = "error"
+					results[i].Error = err.Error()
+					return
+				}
+				results[i].Status = "ok"
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Status == "error" || result.Status == "not_found" {
+			failed++
+		}
+	}
+
+	return echoContext.JSON(http.StatusOK, map[string]any{
+		"data": results,
+		"meta": map[string]any{
+			"action":    bulkRequest.Action,
+			"dry_run":   bulkRequest.DryRun,
+			"total":     len(results),
+			"failed":    failed,
+			"succeeded": len(results) - failed,
+		},
+	})
+}
+
+// resolveBulkTargets returns the explicitly given containers, or every
+// container, stopped ones included, matching the label selector.
+func (c *Container) resolveBulkTargets(ctx context.Context, bulkRequest ContainerBulkRequest) ([]bulkTarget, error) {
+	targets := []bulkTarget{}
+
+	if len(bulkRequest.IDs) > 0 {
+		seen := map[string]bool{}
+		for _, id := range bulkRequest.IDs {
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			target := bulkTarget{id: id}
+			containerJson, err := c.dockerClient.ContainerInspect(ctx, id)
+			if err != nil {
+				target.err = err
+				targets = append(targets, target)
+				continue
+			}
+
+			target.name = strings.TrimPrefix(containerJson.Name, "/")
+			if containerJson.State != nil {
+				target.state = containerJson.State.Status
+			}
+			targets = append(targets, target)
+		}
+
+		return targets, nil
+	}
+
+	selector, err := ParseLabelSelector(bulkRequest.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := c.dockerClient.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ctr := range containers {
+		if !selector.Matches(ctr.Labels) {
+			continue
+		}
+
+		target := bulkTarget{id: ctr.ID, state: ctr.State}
+		if len(ctr.Names) > 0 {
+			target.name = strings.TrimPrefix(ctr.Names[0], "/")
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+func (c *Container) runBulkAction(ctx context.Context, bulkRequest ContainerBulkRequest, containerID string) error {
+	timeout := 10
+	if bulkRequest.Timeout != nil {
+		timeout = *bulkRequest.Timeout
+	}
+
+	switch bulkRequest.Action {
+	case "start":
+		if err := c.managedContainers.SetDesiredState(containerID, ManagedStateRunning); err != nil {
+			return err
+		}
+		return c.dockerClient.ContainerStart(ctx, containerID, container.StartOptions{})
+	case "stop":
+		if err := c.managedContainers.SetDesiredState(containerID, ManagedStateStopped); err != nil {
+			return err
+		}
+		return c.dockerClient.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &timeout})
+	case "restart":
+		if err := c.managedContainers.SetDesiredState(containerID, ManagedStateRunning); err != nil {
+			return err
+		}
+		return c.dockerClient.ContainerRestart(ctx, containerID, container.StopOptions{Timeout: &timeout})
+	case "pause":
+		return c.dockerClient.ContainerPause(ctx, containerID)
+	case "unpause":
+		return c.dockerClient.ContainerUnpause(ctx, containerID)
+	case "remove":
+		if err := c.dockerClient.ContainerRemove(ctx, containerID, container.RemoveOptions{
+			Force:         bulkRequest.Force,
+			RemoveVolumes: bulkRequest.RemoveVolumes,
+		}); err != nil {
+			return err
+		}
+		return c.managedContainers.Forget(containerID)
+	case "kill":
+		signal := bulkRequest.Signal
+		if signal == "" {
+			signal = "SIGKILL"
+		}
+		return c.dockerClient.ContainerKill(ctx, containerID, signal)
+	}
+
+	return errors.New("unsupported action")
+}
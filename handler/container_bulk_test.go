@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestBulkContainer serves web (running, app=web), worker (exited,
+// app=worker) and broken (exited, app=web, failing every action), and
+// records the mutating calls.
+func newTestBulkContainer(t *testing.T) (*Container, func() []string) {
+	t.Helper()
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+
+	containers := []types.Container{
+		{ID: "web", Names: []string{"/web"}, State: "running", Labels: map[string]string{"app": "web", "tier": "front"}},
+		{ID: "worker", Names: []string{"/worker"}, State: "exited", Labels: map[string]string{"app": "worker"}},
+		{ID: "broken", Names: []string{"/broken"}, State: "exited", Labels: map[string]string{"app": "web"}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(containers)
+	})
+	mux.HandleFunc("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		for _, ctr := range containers {
+			if ctr.ID == r.PathValue("id") {
+				json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+					ID:    ctr.ID,
+					Name:  ctr.Names[0],
+					State: &types.ContainerState{Status: ctr.State},
+				}})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"No such container"}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		if strings.HasPrefix(r.URL.Path, "/containers/broken/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message":"cannot stop container"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cli := newTestDockerClient(t, mux)
+	return NewContainer(cli, NewManagedContainerStore(t.TempDir()), nil, nil), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(calls)
+		return append([]string{}, calls...)
+	}
+}
+
+type testBulkResponse struct {
+	Data []ContainerBulkResult `json:"data"`
+	Meta struct {
+		Total     int `json:"total"`
+		Failed    int `json:"failed"`
+		Succeeded int `json:"succeeded"`
+	} `json:"meta"`
+}
+
+func runTestBulk(t *testing.T, containers *Container, body string) testBulkResponse {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, "/containers/bulk", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	if err := containers.Bulk(echo.New().NewContext(request, recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+
+	var response testBulkResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func bulkStatuses(results []ContainerBulkResult) string {
+	statuses := []string{}
+	for _, result := range results {
+		statuses = append(statuses, result.ID+"="+result.Status)
+	}
+	return strings.Join(statuses, ",")
+}
+
+func TestContainerBulkDryRun(t *testing.T) {
+	containers, calls := newTestBulkContainer(t)
+
+	response := runTestBulk(t, containers, `{"action":"stop","ids":["web","missing","web"],"dry_run":true}`)
+
+	// Duplicates are dropped, missing containers are reported, not planned.
+	if got := bulkStatuses(response.Data); got != "web=planned,missing=not_found" {
+		t.Errorf("results = %s", got)
+	}
+	if response.Data[0].Name != "web" || response.Data[0].State != "running" {
+		t.Errorf("web = %+v, want its name and state", response.Data[0])
+	}
+	if response.Data[1].Error == "" {
+		t.Errorf("missing = %+v, want the error", response.Data[1])
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("calls = %v, want none on dry run", got)
+	}
+}
+
+func TestContainerBulkLabelSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{selector: "app=web", want: "web=planned,broken=planned"},
+		{selector: "app=web,tier=front", want: "web=planned"},
+		{selector: "app!=web", want: "worker=planned"},
+		{selector: "tier", want: "web=planned"},
+		{selector: "app in (worker,db)", want: "worker=planned"},
+		{selector: "app=db", want: ""},
+	}
+
+	for _, tt := range tests {
+		containers, _ := newTestBulkContainer(t)
+
+		body, _ := json.Marshal(ContainerBulkRequest{Action: "restart", LabelSelector: tt.selector, DryRun: true})
+		response := runTestBulk(t, containers, string(body))
+		if got := bulkStatuses(response.Data); got != tt.want {
+			t.Errorf("selector %q: results = %s, want %s", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestContainerBulkInvalidSelector(t *testing.T) {
+	containers, _ := newTestBulkContainer(t)
+
+	request := httptest.NewRequest(http.MethodPost, "/containers/bulk", strings.NewReader(`{"action":"stop","label_selector":"env in (prod"}`))
+	recorder := httptest.NewRecorder()
+	if err := containers.Bulk(echo.New().NewContext(request, recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestContainerBulkAggregatesResults(t *testing.T) {
+	containers, calls := newTestBulkContainer(t)
+
+	response := runTestBulk(t, containers, `{"action":"stop","ids":["web","worker","broken","missing"],"concurrency":2}`)
+
+	if got := bulkStatuses(response.Data); got != "web=ok,worker=ok,broken=error,missing=not_found" {
+		t.Errorf("results = %s", got)
+	}
+	if !strings.Contains(response.Data[2].Error, "cannot stop container") {
+		t.Errorf("broken = %+v, want the docker error", response.Data[2])
+	}
+	if response.Meta.Total != 4 || response.Meta.Failed != 2 || response.Meta.Succeeded != 2 {
+		t.Errorf("meta = %+v, want 2 of 4 failed", response.Meta)
+	}
+
+	// Nothing is sent for the missing container.
+	want := "POST /containers/broken/stop,POST /containers/web/stop,POST /containers/worker/stop"
+	if got := strings.Join(calls(), ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestResolveBulkTargetsIgnoresEmptyIDs(t *testing.T) {
+	containers, _ := newTestBulkContainer(t)
+
+	targets, err := containers.resolveBulkTargets(context.Background(), ContainerBulkRequest{IDs: []string{"", "worker", ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].id != "worker" || targets[0].state != "exited" || targets[0].err != nil {
+		t.Errorf("targets = %+v, want worker only", targets)
+	}
+}
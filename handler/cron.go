@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCronSchedule = errors.New("invalid cron schedule")
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	cronDayNames   = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+// CronSchedule is a parsed standard cron expression, `minute hour
+// day-of-month month day-of-week`, evaluated in local time.
+type CronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64 // Bit i set when value i matches
+
+	// As in cron, when both day fields are restricted either one matching is
+	// enough.
+	dayOfMonthAny, dayOfWeekAny bool
+}
+
+// ParseCronSchedule parses a five field cron expression, fields accept `*`,
+// lists, ranges, steps and month or day names, or one of the `@hourly`,
+// `@daily`, `@weekly`, `@monthly` and `@yearly` macros.
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields, got %d", ErrInvalidCronSchedule, len(fields))
+	}
+
+	// Like in cron a day field starting with `*`, `*/2` included, does not
+	// restrict the days on its own.
+	schedule := &CronSchedule{
+		dayOfMonthAny: strings.HasPrefix(fields[2], "*") || fields[2] == "?",
+		dayOfWeekAny:  strings.HasPrefix(fields[4], "*") || fields[4] == "?",
+	}
+
+	var err error
+	if schedule.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if schedule.dayOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, err
+	}
+	// 7 is sunday too.
+	if schedule.dayOfWeek, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, err
+	}
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%w: invalid step in %q", ErrInvalidCronSchedule, part)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" && rangePart != "?" {
+			low, high, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			if start, err = parseCronValue(low, names); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = parseCronValue(high, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%w: %q out of range %d-%d", ErrInvalidCronSchedule, part, min, max)
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+
+	return bits, nil
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if number, ok := names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid value %q", ErrInvalidCronSchedule, value)
+	}
+
+	return number, nil
+}
+
+// Next returns the first matching minute strictly after t, or the zero time
+// when nothing matches within five years, e.g. `0 0 30 2 *`.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+
+	if s.dayOfMonthAny || s.dayOfWeekAny {
+		return dayOfMonth && dayOfWeek
+	}
+
+	return dayOfMonth || dayOfWeek
+}
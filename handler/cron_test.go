@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{spec: "* * * * *", from: "2024-01-01 10:07", want: "2024-01-01 10:08"},
+		{spec: "*/15 * * * *", from: "2024-01-01 10:07", want: "2024-01-01 10:15"},
+		{spec: "*/15 * * * *", from: "2024-01-01 10:45", want: "2024-01-01 11:00"},
+		{spec: "5-10/2 * * * *", from: "2024-01-01 10:06", want: "2024-01-01 10:07"},
+		{spec: "7/20 * * * *", from: "2024-01-01 10:28", want: "2024-01-01 10:47"},
+		{spec: "0,30 9-17 * * *", from: "2024-01-01 17:30", want: "2024-01-02 09:00"},
+		{spec: "0 */6 * * *", from: "2024-01-01 07:00", want: "2024-01-01 12:00"},
+		{spec: "59 23 31 12 *", from: "2024-06-01 00:00", want: "2024-12-31 23:59"},
+
+		// Month and day names, any case, and 7 as sunday.
+		{spec: "0 0 1 jan,JUL *", from: "2024-02-10 00:00", want: "2024-07-01 00:00"},
+		{spec: "30 2 * * mon-fri", from: "2024-01-06 00:00", want: "2024-01-08 02:30"},
+		{spec: "0 0 * * 7", from: "2024-01-01 00:00", want: "2024-01-07 00:00"},
+		{spec: "0 0 * * Sun", from: "2024-01-01 00:00", want: "2024-01-07 00:00"},
+
+		// Both day fields restricted, either one matching is enough.
+		{spec: "0 0 13 * fri", from: "2024-01-01 00:00", want: "2024-01-05 00:00"},
+		{spec: "0 0 13 * fri", from: "2024-01-12 00:00", want: "2024-01-13 00:00"},
+		// A day field starting with `*` restricts nothing on its own, both
+		// have to match: odd days which are mondays.
+		{spec: "0 0 */2 * mon", from: "2024-01-01 00:00", want: "2024-01-15 00:00"},
+		{spec: "0 0 1 * */2", from: "2024-01-01 00:00", want: "2024-02-01 00:00"},
+		{spec: "0 0 ? * mon", from: "2024-01-02 00:00", want: "2024-01-08 00:00"},
+
+		// Leap day and day 31 only match in the months having them.
+		{spec: "0 12 29 2 *", from: "2024-03-01 00:00", want: "2028-02-29 12:00"},
+		{spec: "0 0 31 * *", from: "2024-04-01 00:00", want: "2024-05-31 00:00"},
+
+		{spec: "@hourly", from: "2024-01-01 10:07", want: "2024-01-01 11:00"},
+		{spec: "@daily", from: "2024-01-01 10:07", want: "2024-01-02 00:00"},
+		{spec: "@weekly", from: "2024-01-01 10:07", want: "2024-01-07 00:00"},
+		{spec: "@monthly", from: "2024-01-15 10:07", want: "2024-02-01 00:00"},
+		{spec: "@yearly", from: "2024-01-15 10:07", want: "2025-01-01 00:00"},
+	}
+
+	for _, tt := range tests {
+		schedule, err := ParseCronSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("ParseCronSchedule(%q) = %v", tt.spec, err)
+			continue
+		}
+
+		if got := schedule.Next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q.Next(%s) = %s, want %s", tt.spec, tt.from, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+func TestCronScheduleNextNeverMatching(t *testing.T) {
+	schedule, err := ParseCronSchedule("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := schedule.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("Next() = %s, want the zero time", got)
+	}
+}
+
+func TestParseCronScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"10-5 * * * *",
+		"1,,2 * * * *",
+		"* * * foo *",
+		"* * * * funday",
+		"@fortnightly",
+	} {
+		if _, err := ParseCronSchedule(spec); !errors.Is(err, ErrInvalidCronSchedule) {
+			t.Errorf("ParseCronSchedule(%q) error = %v, want %v", spec, err, ErrInvalidCronSchedule)
+		}
+	}
+}
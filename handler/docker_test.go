@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// newTestDockerClient returns a docker client talking to mux, routes are
+// registered without the API version prefix.
+func newTestDockerClient(t *testing.T, mux *http.ServeMux) *client.Client {
+	t.Helper()
+
+	server := httptest.NewServer(http.StripPrefix("/v1.45", mux))
+	t.Cleanup(server.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+
+	return cli
+}
+
+// setPathStat sets the header docker describes archive paths with.
+func setPathStat(t *testing.T, w http.ResponseWriter, stat types.ContainerPathStat) {
+	t.Helper()
+
+	encoded, err := json.Marshal(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(encoded))
+}
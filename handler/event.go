@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+const eventKeepAliveInterval = 15 * time.Second
+
+// NormalizedEvent is the schema every relayed docker event is converted to.
+// Container labels are part of the actor attributes, as reported by docker.
+type NormalizedEvent struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	TimeNano int64           `json:"time_nano"`
+	Type     string          `json:"type"`   // container, image, network, volume, ...
+	Action   string          `json:"action"` // e.g. start, die, oom, health_status
+	Status   string          `json:"status,omitempty"`
+	Scope    string          `json:"scope,omitempty"`
+	Actor    NormalizedActor `json:"actor"`
+}
+
+type NormalizedActor struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name,omitempty"`
+	Image      string            `json:"image,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// normalizeEvent flattens a docker event. Actions carrying a status, like
+// `health_status: unhealthy` or `exec_start: sh`, are split into action and
+// status.
+func normalizeEvent(message events.Message) NormalizedEvent {
+	action, status, _ := strings.Cut(string(message.Action), ":")
+
+	timeNano := message.TimeNano
+	if timeNano == 0 {
+		timeNano = message.Time * int64(time.Second)
+	}
+
+	normalized := NormalizedEvent{
+		ID:       fmt.Sprintf("%d-%s", timeNano, message.Actor.ID),
+		Time:     time.Unix(0, timeNano).UTC(),
+		TimeNano: timeNano,
+		Type:     string(message.Type),
+		Action:   strings.TrimSpace(action),
+		Status:   strings.TrimSpace(status),
+		Scope:    message.Scope,
+		Actor: NormalizedActor{
+			ID:         message.Actor.ID,
+			Name:       message.Actor.Attributes["name"],
+			Image:      message.Actor.Attributes["image"],
+			Attributes: map[string]string{},
+		},
+	}
+
+	for key, value := range message.Actor.Attributes {
+		switch key {
+		case "name", "image":
+		default:
+			normalized.Actor.Attributes[key] = value
+		}
+	}
+
+	return normalized
+}
+
+type Event struct {
+	dockerClient *client.Client
+}
+
+func NewEvent(dockerClient *client.Client) *Event {
+	return &Event{dockerClient: dockerClient}
+}
+
+// Stream relays docker events as server-sent events. Filters are given as
+// query params: `type`, `action`, `label`, `container`, `image`, `network`
+// and `volume`, each comma separated or repeated. `since` and `until` accept
+// unix timestamps or RFC3339 dates, `Last-Event-ID` resumes after a given
+// event.
+func (e *Event) Stream(c echo.Context) error {
+	options, err := eventsOptionsFromRequest(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	messages, errs := e.dockerClient.Events(ctx, options)
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+	c.Response().Header().Set(echo.HeaderConnection, "keep-alive")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(c.Response(), ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			c.Response().Flush()
+		case message := <-messages:
+			normalized := normalizeEvent(message)
+			raw, err := json.Marshal(normalized)
+			if err != nil {
+				log.Err(err).Msg("error encoding event")
+				continue
+			}
+
+			if _, err := fmt.Fprintf(c.Response(), "id: %s\nevent: %s\ndata: %s\n\n", normalized.ID, normalized.Type, raw); err != nil {
+				return nil
+			}
+			c.Response().Flush()
+		case err := <-errs:
+			if ctx.Err() == nil {
+				log.Err(err).Msg("error reading docker events")
+				fmt.Fprintf(c.Response(), "event: error\ndata: %q\n\n", "docker events stream interrupted")
+				c.Response().Flush()
+			}
+			return nil
+		}
+	}
+}
+
+// WebSocket relays docker events as json text frames, with the same filters
+// as Stream.
+func (e *Event) WebSocket(c echo.Context) error {
+	options, err := eventsOptionsFromRequest(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	server := websocket.Server{
+		// The default handshake rejects requests without an Origin header,
+		// which API clients other than browsers do not send. Requests are
+		// authenticated by token instead.
+		Handshake: func(config *websocket.Config, r *http.Request) (err error) {
+			config.Origin, err = websocket.Origin(config, r)
+			return err
+		},
+	}
+	server.Handler = func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+
+		// The client is not expected to send anything, reading only detects
+		// when it goes away.
+		go func() {
+			defer cancel()
+			var discard string
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		messages, errs := e.dockerClient.Events(ctx, options)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message := <-messages:
+				if err := websocket.JSON.Send(ws, normalizeEvent(message)); err != nil {
+					return
+				}
+			case err := <-errs:
+				if ctx.Err() == nil {
+					log.Err(err).Msg("error reading docker events")
+				}
+				return
+			}
+		}
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+func eventsOptionsFromRequest(c echo.Context) (types.EventsOptions, error) {
+	filterArgs := filters.NewArgs()
+	query := c.QueryParams()
+
+	filterKeys := map[string]string{
+		"type":      "type",
+		"action":    "event",
+		"label":     "label",
+		"container": "container",
+		"image":     "image",
+		"network":   "network",
+		"volume":    "volume",
+	}
+	for queryKey, filterKey := range filterKeys {
+		for _, value := range query[queryKey] {
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					filterArgs.Add(filterKey, item)
+				}
+			}
+		}
+	}
+
+	since := c.QueryParam("since")
+	if lastEventID := c.Request().Header.Get("Last-Event-ID"); lastEventID != "" {
+		timeNanoStr, _, _ := strings.Cut(lastEventID, "-")
+		timeNano, err := strconv.ParseInt(timeNanoStr, 10, 64)
+		if err != nil {
+			return types.EventsOptions{}, errors.New("last event id is invalid")
+		}
+		// Docker accepts fractional unix timestamps, resume right after
+		// the last delivered event.
+		next := timeNano + 1
+		since = fmt.Sprintf("%d.%09d", next/int64(time.Second), next%int64(time.Second))
+	}
+
+	for _, value := range []string{since, c.QueryParam("until")} {
+		if value == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			return types.EventsOptions{}, errors.New("since and until must be unix timestamps or RFC3339 dates")
+		}
+	}
+
+	return types.EventsOptions{
+		Since:   since,
+		Until:   c.QueryParam("until"),
+		Filters: filterArgs,
+	}, nil
+}
+
+// followDockerEvents calls handle for every docker event matching filterArgs
+// until ctx is done. The stream is resumed from the last seen event with
+// backoff whenever it breaks.
+func followDockerEvents(ctx context.Context, dockerClient *client.Client, filterArgs filters.Args, handle func(events.Message)) {
+	since := time.Now()
+	backoff := time.Second
+
+	for {
+		streamCtx, cancel := context.WithCancel(ctx)
+		messages, errs := dockerClient.Events(streamCtx, types.EventsOptions{
+			Since:   fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+			Filters: filterArgs,
+		})
+
+	stream:
+		for {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case message := <-messages:
+				backoff = time.Second
+				since = time.Unix(0, message.TimeNano+1)
+				handle(message)
+			case err := <-errs:
+				log.Err(err).
+					Dur("backoff", backoff).
+					Msg("docker events stream interrupted, reconnecting")
+				break stream
+			}
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = minDuration(backoff*2, time.Minute)
+	}
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestEventWebSocketWithoutOrigin(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Type":"container","Action":"health_status: unhealthy","Actor":{"ID":"abc","Attributes":{"name":"web"}},"timeNano":1700000000000000000}` + "\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	e := echo.New()
+	e.GET("/events/ws", NewEvent(newTestDockerClient(t, mux)).WebSocket)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// A plain client handshake, without the Origin header browsers add.
+	handshake := "GET /events/ws?type=container HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", response.StatusCode)
+	}
+
+	// Unmasked text frame from the server, short enough for a 16 bit length.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x81 {
+		t.Fatalf("frame header = %#x, want a final text frame", header[0])
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			t.Fatal(err)
+		}
+		length = int(extended[0])<<8 | int(extended[1])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var event NormalizedEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatalf("decoding %s: %v", payload, err)
+	}
+	if event.Action != "health_status" || event.Status != "unhealthy" || event.Actor.Name != "web" {
+		t.Errorf("event = %+v", event)
+	}
+	if !strings.HasPrefix(event.ID, "1700000000000000000-") {
+		t.Errorf("event id = %s", event.ID)
+	}
+}
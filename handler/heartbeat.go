@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/insomnius/agent/entity"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const maxBufferedHeartbeats = 100
+
+type HeartbeatOptions struct {
+	URL           string
+	Interval      time.Duration
+	DaemonVersion string
+}
+
+// HeartbeatPayload is posted to the manager on every heartbeat. The first
+// heartbeat after the daemon starts is sent with the `register` kind.
+type HeartbeatPayload struct {
+	Kind             string         `json:"kind"` // register or heartbeat
+	Sequence         uint64         `json:"sequence"`
+	SentAt           time.Time      `json:"sent_at"`
+	DaemonVersion    string         `json:"daemon_version"`
+	DockerVersion    string         `json:"docker_version"`
+	DockerAPIVersion string         `json:"docker_api_version"`
+	MachineSpecs     MachineSpec    `json:"machine_specs"`
+	Containers       map[string]int `json:"containers"` // Count by state, plus `total`
+}
+
+type heartbeatStatus struct {
+	URL        string    `json:"url"`
+	Registered bool      `json:"registered"`
+	LastSent   time.Time `json:"last_sent,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	Buffered   int       `json:"buffered"`
+}
+
+// Heartbeat periodically reports the node state to the manager. Heartbeats
+// that cannot be delivered are buffered on disk and replayed, oldest first,
+// once the manager is reachable again.
+type Heartbeat struct {
+	dockerClient      *client.Client
+	options           HeartbeatOptions
+	getConfigFunction func() (*entity.CconnectorConfig, error)
+	httpClient        *http.Client
+	bufferPath        string
+
+	mu       sync.Mutex
+	sequence uint64
+	status   heartbeatStatus
+}
+
+func NewHeartbeat(dockerClient *client.Client, options HeartbeatOptions, getConfigFunction func() (*entity.CconnectorConfig, error), dataDir string) *Heartbeat {
+	return &Heartbeat{
+		dockerClient:      dockerClient,
+		options:           options,
+		getConfigFunction: getConfigFunction,
+		httpClient:        &http.Client{Timeout: 10 * time.Second},
+		bufferPath:        filepath.Join(dataDir, "heartbeat_buffer.json"),
+		status:            heartbeatStatus{URL: options.URL},
+	}
+}
+
+// Run sends heartbeats until ctx is done. Until the daemon is registered,
+// the registration is retried with backoff instead of waiting a full interval.
+func (h *Heartbeat) Run(ctx context.Context) {
+	backoff := time.Second
+
+	for {
+		wait := h.options.Interval
+		if err := h.beat(ctx); err != nil {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("heartbeat").Str("send")).
+				Str("url", h.options.URL).
+				Msg("error sending heartbeat")
+
+			h.mu.Lock()
+			registered := h.status.Registered
+			h.mu.Unlock()
+			if !registered {
+				wait = minDuration(backoff, h.options.Interval)
+				backoff *= 2
+			}
+		} else {
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (h *Heartbeat) beat(ctx context.Context) error {
+	config, err := h.getConfigFunction()
+	if err != nil {
+		return err
+	}
+	if config.ManagerToken == "" {
+		// Not claimed yet, there is no manager to report to.
+		return nil
+	}
+
+	h.mu.Lock()
+	kind := "heartbeat"
+	if !h.status.Registered {
+		kind = "register"
+	}
+	h.sequence++
+	sequence := h.sequence
+	h.mu.Unlock()
+
+	payload, err := h.collect(ctx, kind, sequence)
+	if err != nil {
+		return err
+	}
+
+	buffered := []HeartbeatPayload{}
+	if err := readJSONFile(h.bufferPath, &buffered); err != nil {
+		return err
+	}
+
+	// Replay missed heartbeats first so the manager sees them in order.
+	pending := coalesceRegistrations(append(buffered, payload))
+	for i, next := range pending {
+		if err := h.send(ctx, config, next); err != nil {
+			return h.buffer(pending[i:], err)
+		}
+	}
+
+	if len(buffered) > 0 {
+		if err := writeJSONFile(h.bufferPath, []HeartbeatPayload{}); err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	h.status.Registered = true
+	h.status.LastSent = payload.SentAt
+	h.status.LastError = ""
+	h.status.Buffered = 0
+	h.mu.Unlock()
+
+	return nil
+}
+
+func (h *Heartbeat) collect(ctx context.Context, kind string, sequence uint64) (HeartbeatPayload, error) {
+	payload := HeartbeatPayload{
+		Kind:          kind,
+		Sequence:      sequence,
+		SentAt:        time.Now().UTC(),
+		DaemonVersion: h.options.DaemonVersion,
+		Containers:    map[string]int{"total": 0},
+	}
+
+	specs, err := getMachineSpecs()
+	if err != nil {
+		return payload, err
+	}
+	payload.MachineSpecs = specs
+
+	version, err := h.dockerClient.ServerVersion(ctx)
+	if err != nil {
+		return payload, err
+	}
+	payload.DockerVersion = version.Version
+	payload.DockerAPIVersion = version.APIVersion
+
+	containers, err := h.dockerClient.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return payload, err
+	}
+	for _, ctr := range containers {
+		payload.Containers[ctr.State]++
+		payload.Containers["total"]++
+	}
+
+	return payload, nil
+}
+
+func (h *Heartbeat) send(ctx context.Context, config *entity.CconnectorConfig, payload HeartbeatPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, h.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	request.Header.Set(echo.HeaderAuthorization, "Bearer "+config.HostToken)
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(config.ManagerToken, timestamp, body))
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+
+	response, err := h.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("manager responded with status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// coalesceRegistrations keeps only the latest of the pending registrations,
+// in place of the first one. Until the daemon is registered every attempt is
+// a registration, the manager only needs the current one.
+func coalesceRegistrations(pending []HeartbeatPayload) []HeartbeatPayload {
+	latest := -1
+	for i, payload := range pending {
+		if payload.Kind == "register" {
+			latest = i
+		}
+	}
+
+	coalesced := make([]HeartbeatPayload, 0, len(pending))
+	placed := false
+	for _, payload := range pending {
+		if payload.Kind != "register" {
+			coalesced = append(coalesced, payload)
+			continue
+		}
+		if !placed {
+			coalesced = append(coalesced, pending[latest])
+			placed = true
+		}
+	}
+
+	return coalesced
+}
+
+func (h *Heartbeat) buffer(pending []HeartbeatPayload, cause error) error {
+	if len(pending) > maxBufferedHeartbeats {
+		pending = pending[len(pending)-maxBufferedHeartbeats:]
+	}
+
+	h.mu.Lock()
+	h.status.LastError = cause.Error()
+	h.status.Buffered = len(pending)
+	h.mu.Unlock()
+
+	if err := writeJSONFile(h.bufferPath, pending); err != nil {
+		return err
+	}
+
+	return cause
+}
+
+func (h *Heartbeat) Status(c echo.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": h.status,
+	})
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/insomnius/agent/entity"
+)
+
+// testManager records the heartbeats it receives, refusing them while down.
+type testManager struct {
+	mu       sync.Mutex
+	down     bool
+	received []HeartbeatPayload
+}
+
+func (m *testManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var payload HeartbeatPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m.received = append(m.received, payload)
+}
+
+func (m *testManager) setDown(down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down = down
+}
+
+func (m *testManager) take() []HeartbeatPayload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	received := m.received
+	m.received = nil
+	return received
+}
+
+func newTestHeartbeat(t *testing.T) (*Heartbeat, *testManager) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Version":"26.1.4","ApiVersion":"1.45"}`))
+	})
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"Id":"web","State":"running"},{"Id":"db","State":"exited"}]`))
+	})
+
+	manager := &testManager{}
+	server := httptest.NewServer(manager)
+	t.Cleanup(server.Close)
+
+	config := &entity.CconnectorConfig{HostToken: "host-token", ManagerToken: "manager-token"}
+	heartbeat := NewHeartbeat(newTestDockerClient(t, mux), HeartbeatOptions{URL: server.URL, DaemonVersion: "1.0.0"}, func() (*entity.CconnectorConfig, error) {
+		return config, nil
+	}, t.TempDir())
+
+	return heartbeat, manager
+}
+
+func bufferedHeartbeats(t *testing.T, heartbeat *Heartbeat) []HeartbeatPayload {
+	t.Helper()
+
+	buffered := []HeartbeatPayload{}
+	if err := readJSONFile(heartbeat.bufferPath, &buffered); err != nil {
+		t.Fatal(err)
+	}
+	return buffered
+}
+
+type heartbeatSummary struct {
+	Kind     string
+	Sequence uint64
+}
+
+func summarizeHeartbeats(payloads []HeartbeatPayload) []heartbeatSummary {
+	summaries := []heartbeatSummary{}
+	for _, payload := range payloads {
+		summaries = append(summaries, heartbeatSummary{Kind: payload.Kind, Sequence: payload.Sequence})
+	}
+	return summaries
+}
+
+func TestHeartbeatKeepsOneRegistration(t *testing.T) {
+	heartbeat, manager := newTestHeartbeat(t)
+	ctx := context.Background()
+
+	manager.setDown(true)
+	for i := 0; i < 3; i++ {
+		if err := heartbeat.beat(ctx); err == nil {
+			t.Fatal("beat() succeeded with the manager down")
+		}
+	}
+
+	want := []heartbeatSummary{{Kind: "register", Sequence: 3}}
+	if got := summarizeHeartbeats(bufferedHeartbeats(t, heartbeat)); !reflect.DeepEqual(got, want) {
+		t.Errorf("buffered = %v, want %v", got, want)
+	}
+
+	manager.setDown(false)
+	if err := heartbeat.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manager is registered with the current state, once.
+	want = []heartbeatSummary{{Kind: "register", Sequence: 4}}
+	if got := summarizeHeartbeats(manager.take()); !reflect.DeepEqual(got, want) {
+		t.Errorf("received = %v, want %v", got, want)
+	}
+	if !heartbeat.status.Registered || heartbeat.status.Buffered != 0 || len(bufferedHeartbeats(t, heartbeat)) != 0 {
+		t.Errorf("status = %+v, want registered with nothing buffered", heartbeat.status)
+	}
+}
+
+func TestHeartbeatReplaysInOrder(t *testing.T) {
+	heartbeat, manager := newTestHeartbeat(t)
+	ctx := context.Background()
+
+	if err := heartbeat.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	registration := manager.take()
+	if len(registration) != 1 || registration[0].Kind != "register" || registration[0].Containers["total"] != 2 {
+		t.Fatalf("received = %+v, want the registration", registration)
+	}
+
+	manager.setDown(true)
+	for i := 0; i < 3; i++ {
+		if err := heartbeat.beat(ctx); err == nil {
+			t.Fatal("beat() succeeded with the manager down")
+		}
+	}
+	if heartbeat.status.Buffered != 3 || heartbeat.status.LastError == "" {
+		t.Errorf("status = %+v, want 3 buffered and the error", heartbeat.status)
+	}
+
+	manager.setDown(false)
+	if err := heartbeat.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []heartbeatSummary{{"heartbeat", 2}, {"heartbeat", 3}, {"heartbeat", 4}, {"heartbeat", 5}}
+	if got := summarizeHeartbeats(manager.take()); !reflect.DeepEqual(got, want) {
+		t.Errorf("received = %v, want %v", got, want)
+	}
+	if len(bufferedHeartbeats(t, heartbeat)) != 0 {
+		t.Errorf("buffer not emptied after the replay")
+	}
+}
+
+func TestHeartbeatBufferIsCapped(t *testing.T) {
+	heartbeat, manager := newTestHeartbeat(t)
+	ctx := context.Background()
+
+	if err := heartbeat.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	manager.take()
+
+	manager.setDown(true)
+	for i := 0; i < maxBufferedHeartbeats+5; i++ {
+		if err := heartbeat.beat(ctx); err == nil {
+			t.Fatal("beat() succeeded with the manager down")
+		}
+	}
+
+	// The oldest are dropped.
+	buffered := bufferedHeartbeats(t, heartbeat)
+	if len(buffered) != maxBufferedHeartbeats || buffered[0].Sequence != 7 || buffered[len(buffered)-1].Sequence != maxBufferedHeartbeats+6 {
+		t.Errorf("buffered %d heartbeats, %d to %d", len(buffered), buffered[0].Sequence, buffered[len(buffered)-1].Sequence)
+	}
+	if heartbeat.status.Buffered != maxBufferedHeartbeats {
+		t.Errorf("status buffered = %d", heartbeat.status.Buffered)
+	}
+}
+
+func TestHeartbeatWithoutManagerToken(t *testing.T) {
+	heartbeat, manager := newTestHeartbeat(t)
+	heartbeat.getConfigFunction = func() (*entity.CconnectorConfig, error) {
+		return &entity.CconnectorConfig{HostToken: "host-token"}, nil
+	}
+
+	if err := heartbeat.beat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if received := manager.take(); len(received) != 0 {
+		t.Errorf("received = %v, want nothing before the daemon is claimed", received)
+	}
+	if len(bufferedHeartbeats(t, heartbeat)) != 0 {
+		t.Errorf("heartbeat buffered before the daemon is claimed")
+	}
+}
+
+func TestCoalesceRegistrations(t *testing.T) {
+	payloads := func(kinds ...string) []HeartbeatPayload {
+		list := []HeartbeatPayload{}
+		for i, kind := range kinds {
+			list = append(list, HeartbeatPayload{Kind: kind, Sequence: uint64(i + 1)})
+		}
+		return list
+	}
+
+	tests := []struct {
+		pending []HeartbeatPayload
+		want    []heartbeatSummary
+	}{
+		{pending: payloads(), want: []heartbeatSummary{}},
+		{pending: payloads("heartbeat", "heartbeat"), want: []heartbeatSummary{{"heartbeat", 1}, {"heartbeat", 2}}},
+		{pending: payloads("register", "register", "register"), want: []heartbeatSummary{{"register", 3}}},
+		{pending: payloads("register", "heartbeat", "register"), want: []heartbeatSummary{{"register", 3}, {"heartbeat", 2}}},
+	}
+
+	for _, tt := range tests {
+		if got := summarizeHeartbeats(coalesceRegistrations(tt.pending)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("coalesceRegistrations(%v) = %v, want %v", summarizeHeartbeats(tt.pending), got, tt.want)
+		}
+	}
+}
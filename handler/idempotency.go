@@ -0,0 +1,338 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	maxIdempotentResponseBody = 1 << 20
+
+	// Oldest responses are dropped once the stored ones take more than this.
+	maxIdempotencyStoreSize = 256 << 20
+)
+
+type idempotencyRecord struct {
+	RequestHash string    `json:"request_hash"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// idempotencyEntry is what is kept in memory of a stored record.
+type idempotencyEntry struct {
+	requestHash string
+	createdAt   time.Time
+	size        int64
+}
+
+// Idempotency replays the stored response of POST and DELETE requests sent
+// again with the same `Idempotency-Key` header, so clients can safely retry
+// after a network failure. Keys are scoped to the API token of the request.
+// Responses are kept on disk for the TTL, one file per key.
+type Idempotency struct {
+	ttl time.Duration
+	dir string
+
+	mu        sync.Mutex
+	entries   map[string]idempotencyEntry // By record id
+	totalSize int64
+	inFlight  map[string]bool // Record ids of requests still running
+}
+
+func NewIdempotency(ctx context.Context, ttl time.Duration, dataDir string) *Idempotency {
+	idempotency := &Idempotency{
+		ttl:      ttl,
+		dir:      filepath.Join(dataDir, "idempotency"),
+		entries:  map[string]idempotencyEntry{},
+		inFlight: map[string]bool{},
+	}
+
+	if err := idempotency.load(); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("idempotency").Str("load")).
+			Msg("error reading idempotency keys, starting empty")
+	}
+	go idempotency.janitor(ctx)
+
+	return idempotency
+}
+
+// Middleware must be registered before the routes it applies to.
+func (i *Idempotency) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		method := c.Request().Method
+		key := c.Request().Header.Get(IdempotencyKeyHeader)
+		if key == "" || (method != http.MethodPost && method != http.MethodDelete) {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody("idempotency key must be at most 255 characters"))
+		}
+
+		id := idempotencyRecordID(c.Request().Header.Get(echo.HeaderAuthorization), key)
+
+		// The body is hashed while streamed, uploads of any size are never
+		// buffered.
+		body := &hashingReader{ReadCloser: c.Request().Body, hash: sha256.New()}
+		body.hash.Write([]byte(method + " " + c.Request().URL.RequestURI() + "\n"))
+		c.Request().Body = body
+		defer body.ReadCloser.Close()
+
+		i.mu.Lock()
+		entry, found := i.entries[id]
+		if found && time.Since(entry.createdAt) > i.ttl {
+			found = false
+		}
+		running := i.inFlight[id]
+		if !found && !running {
+			i.inFlight[id] = true
+		}
+		i.mu.Unlock()
+
+		switch {
+		case found:
+			if body.sum() != entry.requestHash {
+				return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody("idempotency key was already used with a different request"))
+			}
+			return i.replay(c, id)
+		case running:
+			return c.JSON(http.StatusConflict, map[string]any{
+				"message": "A request with the same idempotency key is still being processed",
+			})
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		err := next(c)
+		c.Response().Writer = recorder.ResponseWriter
+
+		// Errors returned to echo are written by its error handler after this
+		// middleware, and server errors are worth retrying, keep neither.
+		status := c.Response().Status
+		if err != nil || !c.Response().Committed || status >= http.StatusInternalServerError || recorder.truncated {
+			i.mu.Lock()
+			delete(i.inFlight, id)
+			i.mu.Unlock()
+			return err
+		}
+
+		i.save(id, idempotencyRecord{
+			RequestHash: body.sum(),
+			Status:      status,
+			ContentType: c.Response().Header().Get(echo.HeaderContentType),
+			Body:        recorder.body.Bytes(),
+			CreatedAt:   time.Now().UTC(),
+		})
+
+		return nil
+	}
+}
+
+func (i *Idempotency) replay(c echo.Context, id string) error {
+	record := idempotencyRecord{}
+	raw, err := os.ReadFile(i.recordPath(id))
+	if err == nil {
+		err = json.Unmarshal(raw, &record)
+	}
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("idempotency").Str("replay")).
+			Msg("error reading idempotency record")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	c.Response().Header().Set(IdempotentReplayedHeader, "true")
+	return c.Blob(record.Status, record.ContentType, record.Body)
+}
+
+// save writes the record while the key is still in flight, so it is on disk
+// before any retry can look for it, then evicts the oldest records over the
+// size cap.
+func (i *Idempotency) save(id string, record idempotencyRecord) {
+	size := int64(len(record.Body))
+	err := writeJSONFile(i.recordPath(id), record)
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("idempotency").Str("save")).
+			Msg("error persisting idempotency key")
+	}
+
+	i.mu.Lock()
+	delete(i.inFlight, id)
+	if err == nil {
+		if previous, ok := i.entries[id]; ok {
+			i.totalSize -= previous.size
+		}
+		i.entries[id] = idempotencyEntry{requestHash: record.RequestHash, createdAt: record.CreatedAt, size: size}
+		i.totalSize += size
+	}
+	evicted := i.evict(func(_ idempotencyEntry) bool { return i.totalSize > maxIdempotencyStoreSize })
+	i.mu.Unlock()
+
+	i.remove(evicted)
+}
+
+// evict drops entries, oldest first, while drop says so and returns their
+// ids. Must be called with the lock held.
+func (i *Idempotency) evict(drop func(entry idempotencyEntry) bool) []string {
+	ids := make([]string, 0, len(i.entries))
+	for id := range i.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return i.entries[ids[a]].createdAt.Before(i.entries[ids[b]].createdAt) })
+
+	evicted := []string{}
+	for _, id := range ids {
+		if !drop(i.entries[id]) {
+			break
+		}
+		i.totalSize -= i.entries[id].size
+		delete(i.entries, id)
+		evicted = append(evicted, id)
+	}
+
+	return evicted
+}
+
+func (i *Idempotency) remove(ids []string) {
+	for _, id := range ids {
+		if err := os.Remove(i.recordPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("idempotency").Str("remove")).
+				Msg("error removing idempotency record")
+		}
+	}
+}
+
+func (i *Idempotency) load() error {
+	files, err := os.ReadDir(i.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || file.IsDir() {
+			continue
+		}
+
+		record := idempotencyRecord{}
+		if err := readJSONFile(i.recordPath(id), &record); err != nil {
+			i.remove([]string{id})
+			continue
+		}
+		i.entries[id] = idempotencyEntry{requestHash: record.RequestHash, createdAt: record.CreatedAt, size: int64(len(record.Body))}
+		i.totalSize += int64(len(record.Body))
+	}
+
+	return nil
+}
+
+// janitor drops records once they are older than the TTL.
+func (i *Idempotency) janitor(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		i.mu.Lock()
+		expired := i.evict(func(entry idempotencyEntry) bool { return time.Since(entry.createdAt) > i.ttl })
+		i.mu.Unlock()
+
+		i.remove(expired)
+	}
+}
+
+func (i *Idempotency) recordPath(id string) string {
+	return filepath.Join(i.dir, id+".json")
+}
+
+// idempotencyRecordID scopes the key to the credentials of the request, so
+// two tokens using the same key do not see each other's responses.
+func idempotencyRecordID(authorization, key string) string {
+	sum := sha256.Sum256([]byte(authorization + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashingReader hashes the request body as the handler reads it. Closing is
+// left to the middleware, which reads what the handler did not to finish the
+// hash.
+type hashingReader struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) Close() error {
+	return nil
+}
+
+func (r *hashingReader) sum() string {
+	_, _ = io.Copy(io.Discard, r)
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response body while it is written.
+// Bodies larger than maxIdempotentResponseBody, like streamed image pulls,
+// are not kept.
+type responseRecorder struct {
+	http.ResponseWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.truncated {
+		if r.body.Len()+len(b) > maxIdempotentResponseBody {
+			r.truncated = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
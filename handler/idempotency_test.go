@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newTestIdempotency(t *testing.T, handler echo.HandlerFunc) (*echo.Echo, *Idempotency) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	idempotency := NewIdempotency(ctx, time.Hour, t.TempDir())
+	e := echo.New()
+	e.Use(idempotency.Middleware)
+	e.POST("/things", handler)
+
+	return e, idempotency
+}
+
+func idempotentRequest(e *echo.Echo, token, key string, body []byte) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/things", bytes.NewReader(body))
+	request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	request.Header.Set(IdempotencyKeyHeader, key)
+
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestIdempotencyReplayAndConflict(t *testing.T) {
+	var calls atomic.Int32
+	e, _ := newTestIdempotency(t, func(c echo.Context) error {
+		body, _ := io.ReadAll(c.Request().Body)
+		return c.JSON(http.StatusCreated, map[string]any{"call": calls.Add(1), "size": len(body)})
+	})
+
+	first := idempotentRequest(e, "token-a", "key-1", []byte(`{"name":"web"}`))
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first status = %d", first.Code)
+	}
+
+	replayed := idempotentRequest(e, "token-a", "key-1", []byte(`{"name":"web"}`))
+	if replayed.Code != http.StatusCreated || replayed.Body.String() != first.Body.String() || replayed.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("replay = %d %s %v", replayed.Code, replayed.Body.String(), replayed.Header())
+	}
+
+	conflict := idempotentRequest(e, "token-a", "key-1", []byte(`{"name":"db"}`))
+	if conflict.Code != http.StatusUnprocessableEntity {
+		t.Errorf("different body status = %d, want 422", conflict.Code)
+	}
+
+	// Keys are scoped by token.
+	other := idempotentRequest(e, "token-b", "key-1", []byte(`{"name":"db"}`))
+	if other.Code != http.StatusCreated || other.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("other token = %d %v", other.Code, other.Header())
+	}
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("handler calls = %d, want 2", got)
+	}
+}
+
+func TestIdempotencyHashesBodyNotReadByHandler(t *testing.T) {
+	e, _ := newTestIdempotency(t, func(c echo.Context) error {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("rejected before reading"))
+	})
+
+	if got := idempotentRequest(e, "token", "key", []byte("aaaa")).Code; got != http.StatusBadRequest {
+		t.Fatalf("status = %d", got)
+	}
+	if got := idempotentRequest(e, "token", "key", []byte("aaaa")); got.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("same body not replayed: %d", got.Code)
+	}
+	if got := idempotentRequest(e, "token", "key", []byte("bbbb")).Code; got != http.StatusUnprocessableEntity {
+		t.Errorf("different body status = %d, want 422", got)
+	}
+}
+
+func TestIdempotencyStreamsLargeBodies(t *testing.T) {
+	e, _ := newTestIdempotency(t, func(c echo.Context) error {
+		n, err := io.Copy(io.Discard, c.Request().Body)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]any{"size": n})
+	})
+
+	body := make([]byte, 16<<20)
+	recorder := idempotentRequest(e, "token", "upload", body)
+	if recorder.Code != http.StatusOK || !bytes.Contains(recorder.Body.Bytes(), []byte(strconv.Itoa(len(body)))) {
+		t.Errorf("upload = %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	e, _ := newTestIdempotency(t, func(c echo.Context) error {
+		close(started)
+		<-release
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	done := make(chan int)
+	go func() { done <- idempotentRequest(e, "token", "slow", nil).Code }()
+	<-started
+
+	if got := idempotentRequest(e, "token", "slow", nil).Code; got != http.StatusConflict {
+		t.Errorf("concurrent status = %d, want 409", got)
+	}
+	close(release)
+	if got := <-done; got != http.StatusNoContent {
+		t.Errorf("first status = %d", got)
+	}
+}
+
+func TestIdempotencyPersistsAndEvicts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+
+	idempotency := NewIdempotency(ctx, time.Hour, dir)
+	now := time.Now()
+	idempotency.save("old", idempotencyRecord{RequestHash: "a", Status: 200, Body: []byte("old"), CreatedAt: now.Add(-time.Minute)})
+	idempotency.save("new", idempotencyRecord{RequestHash: "b", Status: 200, Body: []byte("newer"), CreatedAt: now})
+
+	reloaded := NewIdempotency(ctx, time.Hour, dir)
+	if len(reloaded.entries) != 2 || reloaded.totalSize != 8 {
+		t.Fatalf("reloaded entries = %v, size %d", reloaded.entries, reloaded.totalSize)
+	}
+
+	evicted := reloaded.evict(func(_ idempotencyEntry) bool { return reloaded.totalSize > 5 })
+	reloaded.remove(evicted)
+	if len(evicted) != 1 || evicted[0] != "old" || reloaded.totalSize != 5 {
+		t.Errorf("evicted = %v, size %d", evicted, reloaded.totalSize)
+	}
+	if again := NewIdempotency(ctx, time.Hour, dir); len(again.entries) != 1 {
+		t.Errorf("entries after eviction = %v", again.entries)
+	}
+}
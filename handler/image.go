@@ -1,15 +1,22 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 )
@@ -23,19 +30,51 @@ type ImagePullRequest struct {
 	Reference string              `json:"reference"`
 	Platform  string              `json:"platform,omitempty"`
 	Auth      registry.AuthConfig `json:"auth,omitempty"`
+	Mirror    *bool               `json:"mirror,omitempty"` // Pull through the configured mirror, defaults to true when one is set
+}
+
+type ImagePushRequest struct {
+	Reference string              `json:"reference"`
+	All       bool                `json:"all,omitempty"` // Push every tag of the repository
+	Auth      registry.AuthConfig `json:"auth,omitempty"`
+}
+
+// ImagePushResult is the last message of a push stream.
+type ImagePushResult struct {
+	Reference string `json:"reference"`
+	Tag       string `json:"tag,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	Size      int    `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
 type ImageTagRequest struct {
 	TargetRef string `json:"target_ref"`
 }
 
+type ImageCommitRequest struct {
+	Author  string   `json:"author"`
+	Message string   `json:"message"`
+	Changes []string `json:"changes"` // Dockerfile instructions applied to the image, e.g. `ENV DEBUG=true`
+	Tag     string   `json:"tag"`     // Target reference, e.g. `postmortem/api:2024-01-01`
+	Pause   *bool    `json:"pause"`   // Pause the container while committing, defaults to true
+}
+
 type Image struct {
 	dockerClient *client.Client
+	jobs         *Jobs
+	credentials  *RegistryCredentialStore
+	verifier     *ImageVerifier // Nil when image verification is disabled
+	mirror       string         // `host:port` of the cconnector mirror pulls go through, empty when none
 }
 
-func NewImage(dockerClient *client.Client) *Image {
+func NewImage(dockerClient *client.Client, jobs *Jobs, credentials *RegistryCredentialStore, verifier *ImageVerifier, mirror string) *Image {
 	return &Image{
 		dockerClient: dockerClient,
+		jobs:         jobs,
+		credentials:  credentials,
+		verifier:     verifier,
+		mirror:       mirror,
 	}
 }
 
@@ -48,6 +87,25 @@ func (i *Image) Create(c echo.Context) error {
 	}
 
 	refFormat := fmt.Sprintf("%s:%s", createOptions.Source, createOptions.Tag)
+
+	progressFormat := c.QueryParam("progress")
+	if progressFormat != "" && progressFormat != PullProgressNDJSON && progressFormat != PullProgressSSE {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(ErrInvalidPullProgressFormat.Error()))
+	}
+
+	if c.QueryParam("async") == "true" {
+		job := i.jobs.Submit("image_create", func(ctx context.Context, job *Job) (any, error) {
+			rc, err := i.dockerClient.ImageCreate(ctx, refFormat, image.CreateOptions{})
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+
+			return map[string]any{"reference": refFormat}, job.CopyProgress(rc)
+		})
+		return i.jobs.Accepted(c, job)
+	}
+
 	rc, err := i.dockerClient.ImageCreate(c.Request().Context(), refFormat, image.CreateOptions{})
 	if err != nil {
 		log.Err(err).
@@ -61,6 +119,10 @@ func (i *Image) Create(c echo.Context) error {
 	}
 	defer rc.Close()
 
+	if progressFormat != "" {
+		return writePullProgress(c, rc, refFormat, progressFormat)
+	}
+
 	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	c.Response().WriteHeader(http.StatusOK)
 
@@ -132,21 +194,68 @@ func (i *Image) Pull(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("image reference cannot be empty"))
 	}
 
+	// Structured progress instead of the raw docker stream, see writePullProgress
+	progressFormat := c.QueryParam("progress")
+	if progressFormat != "" && progressFormat != PullProgressNDJSON && progressFormat != PullProgressSSE {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(ErrInvalidPullProgressFormat.Error()))
+	}
+
 	options := image.PullOptions{
 		Platform: pullRequest.Platform,
 	}
 
-	// Add authentication if provided
-	if pullRequest.Auth.Username != "" || pullRequest.Auth.Password != "" {
-		encodedAuth, err := json.Marshal(pullRequest.Auth)
+	// Add authentication if provided, stored registry credentials otherwise
+	encodedAuth, err := i.registryAuth(pullRequest.Reference, pullRequest.Auth)
+	if err != nil {
+		log.Err(err).
+			Str("reference", pullRequest.Reference).
+			Msg("error resolving registry auth")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	options.RegistryAuth = encodedAuth
+
+	// With verification enabled the verified digest is pulled, then tagged
+	plan := imagePullPlan{reference: pullRequest.Reference, options: options}
+	var verification *ImageVerification
+	if i.verifier != nil {
+		verified, err := i.verifier.Verify(c.Request().Context(), pullRequest.Reference, inlineAuth(pullRequest.Auth))
 		if err != nil {
-			log.Err(err).Msg("error encoding auth config")
-			return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+			log.Err(err).
+				Str("reference", pullRequest.Reference).
+				Msg("image verification failed")
+			return c.JSON(imageErrorResponse(err))
+		}
+		verification = &verified
+		plan.reference = verified.PinnedReference
+		plan.tag = verified.Reference
+	}
+
+	// References the mirror cannot name, e.g. of registries with a port, are
+	// pulled directly.
+	if i.mirror != "" && (pullRequest.Mirror == nil || *pullRequest.Mirror) {
+		if mirrored, err := plan.throughMirror(i.mirror, pullRequest.Reference); err == nil {
+			plan = mirrored
 		}
-		options.RegistryAuth = string(encodedAuth)
 	}
 
-	rc, err := i.dockerClient.ImagePull(c.Request().Context(), pullRequest.Reference, options)
+	if c.QueryParam("async") == "true" {
+		job := i.jobs.Submit("image_pull", func(ctx context.Context, job *Job) (any, error) {
+			rc, plan, err := i.startPull(ctx, plan)
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+
+			if err := job.CopyProgress(rc); err != nil {
+				return nil, err
+			}
+
+			return map[string]any{"reference": pullRequest.Reference, "verification": verification}, i.finishPull(ctx, plan)
+		})
+		return i.jobs.Accepted(c, job)
+	}
+
+	rc, plan, err := i.startPull(c.Request().Context(), plan)
 	if err != nil {
 		log.Err(err).
 			Str("reference", pullRequest.Reference).
@@ -155,32 +264,131 @@ func (i *Image) Pull(c echo.Context) error {
 	}
 	defer rc.Close()
 
-	// Stream the pull output to the client
+	if progressFormat != "" {
+		// A failed pull is reported in the summary, nothing is tagged.
+		if err := writePullProgress(c, rc, pullRequest.Reference, progressFormat); err != nil {
+			return nil
+		}
+		if err := i.finishPull(c.Request().Context(), plan); err != nil {
+			log.Err(err).Msg("error tagging pulled image")
+		}
+		return nil
+	}
+
+	// Stream the pull output to the client as it is read, the messages are
+	// only decoded to tell whether the pull failed.
 	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	c.Response().WriteHeader(http.StatusOK)
 
-	buf := make([]byte, 4096)
-	for {
-		n, err := rc.Read(buf)
-		if n > 0 {
-			if _, err := c.Response().Write(buf[:n]); err != nil {
-				log.Err(err).Msg("error writing chunk")
+	err = decodeJSONMessages(io.TeeReader(rc, c.Response()), func(json.RawMessage) error {
+		c.Response().Flush()
+		return nil
+	}, func(json.RawMessage) {})
+	if err != nil {
+		c.Response().Flush()
+		log.Err(err).
+			Str("reference", pullRequest.Reference).
+			Msg("error reading pull response")
+		return nil
+	}
+
+	if err := i.finishPull(c.Request().Context(), plan); err != nil {
+		log.Err(err).Msg("error tagging pulled image")
+	}
+
+	return nil
+}
+
+// Push pushes an image to its registry. Progress is streamed as newline
+// delimited json messages followed by an ImagePushResult carrying the digest.
+func (i *Image) Push(c echo.Context) error {
+	var pushRequest ImagePushRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&pushRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("body contains invalid json format"))
+	}
+
+	if pushRequest.Reference == "" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("image reference cannot be empty"))
+	}
+
+	encodedAuth, err := i.registryAuth(pushRequest.Reference, pushRequest.Auth)
+	if err != nil {
+		log.Err(err).
+			Str("reference", pushRequest.Reference).
+			Msg("error resolving registry auth")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	if encodedAuth == "" {
+		// Docker expects the header even for anonymous pushes.
+		encodedAuth, _ = registry.EncodeAuthConfig(registry.AuthConfig{})
+	}
+	options := image.PushOptions{
+		All:          pushRequest.All,
+		RegistryAuth: encodedAuth,
+	}
+
+	if c.QueryParam("async") == "true" {
+		job := i.jobs.Submit("image_push", func(ctx context.Context, job *Job) (any, error) {
+			return i.push(ctx, pushRequest.Reference, options, func(message json.RawMessage) error {
+				job.AddProgress(message)
 				return nil
-			}
-			c.Response().Flush()
-		}
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Err(err).Msg("error reading pull response")
-			return nil
+			})
+		})
+		return i.jobs.Accepted(c, job)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Response())
+	result, err := i.push(c.Request().Context(), pushRequest.Reference, options, func(message json.RawMessage) error {
+		if err := encoder.Encode(message); err != nil {
+			return err
 		}
+		c.Response().Flush()
+		return nil
+	})
+	if err != nil {
+		log.Err(err).
+			Str("reference", pushRequest.Reference).
+			Msg("error pushing image")
+		result = ImagePushResult{Reference: pushRequest.Reference, Error: err.Error()}
 	}
 
+	if err := encoder.Encode(result); err != nil {
+		log.Err(err).Msg("error writing push result")
+	}
+	c.Response().Flush()
+
 	return nil
 }
 
+// push runs the push and hands every decoded progress message to emit. The
+// digest is taken from the `aux` message docker sends once a tag is pushed.
+func (i *Image) push(ctx context.Context, reference string, options image.PushOptions, emit func(json.RawMessage) error) (ImagePushResult, error) {
+	rc, err := i.dockerClient.ImagePush(ctx, reference, options)
+	if err != nil {
+		return ImagePushResult{}, err
+	}
+	defer rc.Close()
+
+	result := ImagePushResult{Reference: reference}
+
+	err = decodeJSONMessages(rc, emit, func(aux json.RawMessage) {
+		var pushResult types.PushResult
+		if err := json.Unmarshal(aux, &pushResult); err == nil && pushResult.Digest != "" {
+			result.Tag = pushResult.Tag
+			result.Digest = pushResult.Digest
+			result.Size = pushResult.Size
+		}
+	})
+	if err != nil {
+		return ImagePushResult{}, err
+	}
+
+	return result, nil
+}
+
 func (i *Image) Inspect(c echo.Context) error {
 	imageID := c.Param("id")
 
@@ -273,6 +481,21 @@ func (i *Image) Prune(c echo.Context) error {
 		}
 	}
 
+	if c.QueryParam("async") == "true" {
+		job := i.jobs.Submit("image_prune", func(ctx context.Context, job *Job) (any, error) {
+			report, err := i.dockerClient.ImagesPrune(ctx, filterArgs)
+			if err != nil {
+				return nil, err
+			}
+
+			return map[string]any{
+				"images_deleted":  report.ImagesDeleted,
+				"space_reclaimed": report.SpaceReclaimed,
+			}, nil
+		})
+		return i.jobs.Accepted(c, job)
+	}
+
 	report, err := i.dockerClient.ImagesPrune(c.Request().Context(), filterArgs)
 	if err != nil {
 		log.Err(err).Msg("error pruning images")
@@ -304,3 +527,232 @@ func (i *Image) History(c echo.Context) error {
 		"data": history,
 	})
 }
+
+// Commit creates a new image from the container given in the `id` param.
+func (i *Image) Commit(c echo.Context) error {
+	containerID := c.Param("id")
+
+	if len(containerID) == 0 {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot be empty"))
+	}
+
+	var commitRequest ImageCommitRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&commitRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("body contains invalid json format"))
+	}
+
+	pause := true
+	if commitRequest.Pause != nil {
+		pause = *commitRequest.Pause
+	}
+
+	commitResp, err := i.dockerClient.ContainerCommit(c.Request().Context(), containerID, container.CommitOptions{
+		Reference: commitRequest.Tag,
+		Comment:   commitRequest.Message,
+		Author:    commitRequest.Author,
+		Changes:   commitRequest.Changes,
+		Pause:     pause,
+	})
+	if err != nil {
+		log.Err(err).
+			Str("container_id", containerID).
+			Any("commit_request", commitRequest).
+			Msg("error committing container")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	imageInspect, _, err := i.dockerClient.ImageInspectWithRaw(c.Request().Context(), commitResp.ID)
+	if err != nil {
+		log.Err(err).
+			Str("image_id", commitResp.ID).
+			Msg("error inspecting committed image")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Container committed successfully",
+		"data":    imageInspect,
+	})
+}
+
+// Export streams the filesystem of the container given in the `id` param as a
+// tarball.
+func (i *Image) Export(c echo.Context) error {
+	containerID := c.Param("id")
+
+	if len(containerID) == 0 {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("container id cannot be empty"))
+	}
+
+	rc, err := i.dockerClient.ContainerExport(c.Request().Context(), containerID)
+	if err != nil {
+		log.Err(err).
+			Str("container_id", containerID).
+			Msg("error exporting container")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer rc.Close()
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-tar")
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": containerID + ".tar"}))
+	c.Response().WriteHeader(http.StatusOK)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			if _, err := c.Response().Write(buf[:n]); err != nil {
+				log.Err(err).Msg("error writing export chunk")
+				return nil
+			}
+			c.Response().Flush()
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Err(err).Msg("error reading export response")
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// registryAuth encodes the auth given with a request, falling back to the
+// credentials stored for the registry of imageRef. It returns an empty string
+// when there is neither.
+func (i *Image) registryAuth(imageRef string, auth registry.AuthConfig) (string, error) {
+	if inline := inlineAuth(auth); inline != nil {
+		return registry.EncodeAuthConfig(*inline)
+	}
+
+	return i.credentials.EncodedAuth(imageRef)
+}
+
+// inlineAuth returns the auth given with a request, nil when none was given.
+func inlineAuth(auth registry.AuthConfig) *registry.AuthConfig {
+	if auth.Username == "" && auth.Password == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		return nil
+	}
+
+	return &auth
+}
+
+// imagePullPlan is what Pull actually pulls, and how the result is tagged.
+type imagePullPlan struct {
+	reference string
+	options   image.PullOptions
+	tag       string         // Reference the pulled image is tagged as, empty to keep it as is
+	untag     string         // Reference removed once tagged, the mirror one
+	direct    *imagePullPlan // Pulled instead when the mirror cannot be reached
+}
+
+// throughMirror routes the pull through the mirror, imageRef being the
+// reference the image is known by locally afterwards.
+func (p imagePullPlan) throughMirror(mirrorHost, imageRef string) (imagePullPlan, error) {
+	mirrored, err := mirrorReference(mirrorHost, p.reference)
+	if err != nil {
+		return p, err
+	}
+
+	direct := p
+	plan := imagePullPlan{reference: mirrored, options: p.options, tag: p.tag, direct: &direct}
+	// Credentials of the upstream registry are not handed to the mirror.
+	plan.options.RegistryAuth = ""
+
+	if plan.tag == "" {
+		named, err := reference.ParseNormalizedNamed(imageRef)
+		if err != nil {
+			return p, err
+		}
+		// An image pulled by digest only has no tag to carry over.
+		if tagged, ok := reference.TagNameOnly(named).(reference.Tagged); ok {
+			plan.tag = tagged.String()
+		}
+	}
+	if plan.tag != "" {
+		plan.untag = mirrored
+	}
+
+	return plan, nil
+}
+
+// startPull starts the pull, falling back to pulling directly when the
+// mirror fails before sending anything.
+func (i *Image) startPull(ctx context.Context, plan imagePullPlan) (io.ReadCloser, imagePullPlan, error) {
+	rc, err := i.dockerClient.ImagePull(ctx, plan.reference, plan.options)
+	if err != nil && plan.direct != nil {
+		log.Err(err).
+			Str("reference", plan.reference).
+			Msg("error pulling through mirror, pulling directly")
+		plan = *plan.direct
+		rc, err = i.dockerClient.ImagePull(ctx, plan.reference, plan.options)
+	}
+
+	return rc, plan, err
+}
+
+// finishPull tags the pulled image as planned.
+func (i *Image) finishPull(ctx context.Context, plan imagePullPlan) error {
+	if plan.tag == "" {
+		return nil
+	}
+	if err := i.dockerClient.ImageTag(ctx, plan.reference, plan.tag); err != nil {
+		return err
+	}
+	if plan.untag == "" {
+		return nil
+	}
+
+	_, err := i.dockerClient.ImageRemove(ctx, plan.untag, image.RemoveOptions{})
+	return err
+}
+
+// pullImage pulls imageRef to completion, authenticating with the credentials
+// stored for its registry.
+func pullImage(ctx context.Context, dockerClient *client.Client, credentials *RegistryCredentialStore, imageRef string) error {
+	encodedAuth, err := credentials.EncodedAuth(imageRef)
+	if err != nil {
+		return err
+	}
+
+	rc, err := dockerClient.ImagePull(ctx, imageRef, image.PullOptions{RegistryAuth: encodedAuth})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return decodeJSONMessages(rc, func(json.RawMessage) error { return nil }, func(json.RawMessage) {})
+}
+
+// decodeJSONMessages reads a docker progress stream, handing every message to
+// emit and the payload of `aux` messages to aux. An error reported inside the
+// stream is returned.
+func decodeJSONMessages(r io.Reader, emit func(json.RawMessage) error, aux func(json.RawMessage)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var message jsonmessage.JSONMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return err
+		}
+		if message.Error != nil {
+			return errors.New(message.Error.Message)
+		}
+		if message.Aux != nil {
+			aux(*message.Aux)
+		}
+
+		if err := emit(raw); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrBuildWithoutImageID = errors.New("build finished without reporting an image id")
+
+// ImageBuildRequest describes a build. It is the json body when building from
+// an inline Dockerfile, or the json encoded `options` query param when the
+// body is a tar build context.
+type ImageBuildRequest struct {
+	Dockerfile     string             `json:"dockerfile"`      // Inline Dockerfile content, json body only
+	DockerfilePath string             `json:"dockerfile_path"` // Dockerfile path inside the build context, defaults to Dockerfile
+	Tags           []string           `json:"tags"`
+	BuildArgs      map[string]*string `json:"build_args"`
+	Target         string             `json:"target"` // Stage of a multi-stage build
+	Labels         map[string]string  `json:"labels"`
+	NoCache        bool               `json:"no_cache"`
+	Pull           bool               `json:"pull"` // Always attempt to pull a newer version of the base images
+	Platform       string             `json:"platform"`
+}
+
+// ImageBuildResult is the last message of a build stream.
+type ImageBuildResult struct {
+	ImageID string   `json:"image_id,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Build builds an image. The body is either a tar build context (optionally
+// gzip compressed) with the build described in the `options` query param, or
+// a json ImageBuildRequest carrying an inline Dockerfile. Progress is streamed
+// as newline delimited json messages followed by an ImageBuildResult.
+func (i *Image) Build(c echo.Context) error {
+	var buildRequest ImageBuildRequest
+
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	isArchive := mediaType == "application/x-tar" || mediaType == "application/gzip" || mediaType == "application/x-gzip"
+
+	if isArchive {
+		if options := c.QueryParam("options"); options != "" {
+			if err := json.Unmarshal([]byte(options), &buildRequest); err != nil {
+				return c.JSON(http.StatusBadRequest, BadRequestResponseBody("options query param contains invalid json format"))
+			}
+		}
+		if buildRequest.Dockerfile != "" {
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody("inline dockerfile cannot be combined with a build context"))
+		}
+	} else {
+		if err := json.NewDecoder(c.Request().Body).Decode(&buildRequest); err != nil {
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody("body contains invalid json format"))
+		}
+		if buildRequest.Dockerfile == "" {
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody("dockerfile cannot be empty without a build context"))
+		}
+	}
+
+	// The context is spooled so it can outlive the request when building
+	// asynchronously, and oversized uploads are rejected up front.
+	spool, err := os.CreateTemp("", "cconnector-build-*")
+	if err != nil {
+		log.Err(err).Msg("error creating build context spool file")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	cleanup := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+
+	if isArchive {
+		size, err := io.Copy(spool, io.LimitReader(c.Request().Body, MaxArchiveTransferSize+1))
+		if err != nil {
+			cleanup()
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody("failed to read request body"))
+		}
+		if size > MaxArchiveTransferSize {
+			cleanup()
+			return c.JSON(http.StatusRequestEntityTooLarge, PayloadTooLargeResponseBody(ErrArchiveTooLarge.Error()))
+		}
+	} else {
+		buildRequest.DockerfilePath = "Dockerfile"
+		if err := writeDockerfileContext(spool, buildRequest.Dockerfile); err != nil {
+			cleanup()
+			log.Err(err).Msg("error writing build context")
+			return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+		}
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	if c.QueryParam("async") == "true" {
+		job := i.jobs.Submit("image_build", func(ctx context.Context, job *Job) (any, error) {
+			defer cleanup()
+
+			result, err := i.build(ctx, spool, buildRequest, func(message json.RawMessage) error {
+				job.AddProgress(message)
+				return nil
+			})
+
+			return result, err
+		})
+		return i.jobs.Accepted(c, job)
+	}
+	defer cleanup()
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Response())
+	result, err := i.build(c.Request().Context(), spool, buildRequest, func(message json.RawMessage) error {
+		if err := encoder.Encode(message); err != nil {
+			return err
+		}
+		c.Response().Flush()
+		return nil
+	})
+	if err != nil {
+		log.Err(err).
+			Strs("tags", buildRequest.Tags).
+			Msg("error building image")
+		result = ImageBuildResult{Error: err.Error()}
+	}
+
+	if err := encoder.Encode(result); err != nil {
+		log.Err(err).Msg("error writing build result")
+	}
+	c.Response().Flush()
+
+	return nil
+}
+
+// build runs the build and hands every decoded progress message to emit. The
+// image id is taken from the `aux` message docker sends once the build is
+// done.
+func (i *Image) build(ctx context.Context, buildContext io.Reader, buildRequest ImageBuildRequest, emit func(json.RawMessage) error) (ImageBuildResult, error) {
+	response, err := i.dockerClient.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:        buildRequest.Tags,
+		Dockerfile:  buildRequest.DockerfilePath,
+		BuildArgs:   buildRequest.BuildArgs,
+		Target:      buildRequest.Target,
+		Labels:      buildRequest.Labels,
+		NoCache:     buildRequest.NoCache,
+		PullParent:  buildRequest.Pull,
+		Platform:    buildRequest.Platform,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		return ImageBuildResult{}, err
+	}
+	defer response.Body.Close()
+
+	result := ImageBuildResult{Tags: buildRequest.Tags}
+
+	err = decodeJSONMessages(response.Body, emit, func(aux json.RawMessage) {
+		var buildResult types.BuildResult
+		if err := json.Unmarshal(aux, &buildResult); err == nil && buildResult.ID != "" {
+			result.ImageID = buildResult.ID
+		}
+	})
+	if err != nil {
+		return ImageBuildResult{}, err
+	}
+
+	if result.ImageID == "" {
+		return ImageBuildResult{}, ErrBuildWithoutImageID
+	}
+
+	return result, nil
+}
+
+// writeDockerfileContext writes a build context holding only the Dockerfile.
+func writeDockerfileContext(w io.Writer, dockerfile string) error {
+	tarWriter := tar.NewWriter(w)
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:     "Dockerfile",
+		Mode:     0644,
+		Size:     int64(len(dockerfile)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tarWriter, bytes.NewBufferString(dockerfile)); err != nil {
+		return fmt.Errorf("writing dockerfile: %w", err)
+	}
+
+	return tarWriter.Close()
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testBuildDocker records the build context and query of every build, and
+// answers with stream.
+type testBuildDocker struct {
+	query   url.Values
+	context []byte
+}
+
+func newTestBuildImage(t *testing.T, stream string) (*Image, *testBuildDocker) {
+	t.Helper()
+
+	docker := &testBuildDocker{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /build", func(w http.ResponseWriter, r *http.Request) {
+		docker.query = r.URL.Query()
+		docker.context, _ = io.ReadAll(r.Body)
+		w.Write([]byte(stream))
+	})
+
+	return NewImage(newTestDockerClient(t, mux), nil, NewRegistryCredentialStore(t.TempDir()), nil, ""), docker
+}
+
+// readTarFiles returns the content of every file of a tar archive by name.
+func readTarFiles(t *testing.T, archive []byte) map[string]string {
+	t.Helper()
+
+	files := map[string]string{}
+	tarReader := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(content)
+	}
+}
+
+const testBuildStream = `{"stream":"Step 1/2 : FROM alpine:3.20\n"}
+{"stream":"Step 2/2 : RUN true\n"}
+{"aux":{"ID":"sha256:9c7a54a9a43cca047013b82af109fe963fde787f63f9e016fdc3384500c2823d"}}
+{"stream":"Successfully built 9c7a54a9a43c\n"}
+`
+
+func runTestBuild(t *testing.T, images *Image, target string, contentType string, body io.Reader) (*httptest.ResponseRecorder, ImageBuildResult) {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, target, body)
+	request.Header.Set(echo.HeaderContentType, contentType)
+	recorder := httptest.NewRecorder()
+	if err := images.Build(echo.New().NewContext(request, recorder)); err != nil {
+		t.Fatal(err)
+	}
+
+	var result ImageBuildResult
+	if recorder.Code == http.StatusOK {
+		lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder, result
+}
+
+func TestImageBuildInlineDockerfile(t *testing.T) {
+	images, docker := newTestBuildImage(t, testBuildStream)
+
+	dockerfile := "FROM alpine:3.20\nRUN true\n"
+	// The path is ignored, the inline Dockerfile is always at the root.
+	body, _ := json.Marshal(ImageBuildRequest{Dockerfile: dockerfile, DockerfilePath: "docker/Dockerfile", Tags: []string{"app:1"}, Target: "runtime"})
+	recorder, result := runTestBuild(t, images, "/images/build", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+
+	files := readTarFiles(t, docker.context)
+	if len(files) != 1 || files["Dockerfile"] != dockerfile {
+		t.Errorf("build context = %v, want the Dockerfile only", files)
+	}
+	if docker.query.Get("dockerfile") != "Dockerfile" || docker.query.Get("t") != "app:1" || docker.query.Get("target") != "runtime" {
+		t.Errorf("query = %v", docker.query)
+	}
+	if result.ImageID != "sha256:9c7a54a9a43cca047013b82af109fe963fde787f63f9e016fdc3384500c2823d" || result.Error != "" {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestImageBuildContext(t *testing.T) {
+	images, docker := newTestBuildImage(t, testBuildStream)
+
+	var buildContext bytes.Buffer
+	tarWriter := tar.NewWriter(&buildContext)
+	for name, content := range map[string]string{"docker/Dockerfile": "FROM alpine:3.20\nCOPY main.go /\n", "main.go": "package main\n"} {
+		tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tarWriter.Write([]byte(content))
+	}
+	tarWriter.Close()
+
+	options := url.QueryEscape(`{"dockerfile_path":"docker/Dockerfile","tags":["app:1","app:latest"]}`)
+	recorder, result := runTestBuild(t, images, "/images/build?options="+options, "application/x-tar", bytes.NewReader(buildContext.Bytes()))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+
+	// The context is handed to docker as uploaded.
+	if !bytes.Equal(docker.context, buildContext.Bytes()) {
+		t.Errorf("build context changed, %d bytes sent for %d uploaded", len(docker.context), buildContext.Len())
+	}
+	if docker.query.Get("dockerfile") != "docker/Dockerfile" || strings.Join(docker.query["t"], ",") != "app:1,app:latest" {
+		t.Errorf("query = %v", docker.query)
+	}
+	if result.ImageID == "" || strings.Join(result.Tags, ",") != "app:1,app:latest" {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestImageBuildInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+	}{
+		{name: "inline dockerfile with a context", target: "/images/build?options=" + url.QueryEscape(`{"dockerfile":"FROM alpine"}`), contentType: "application/x-tar", body: "context"},
+		{name: "invalid options", target: "/images/build?options=%7B", contentType: "application/gzip", body: "context"},
+		{name: "no dockerfile", target: "/images/build", contentType: echo.MIMEApplicationJSON, body: `{"tags":["app:1"]}`},
+		{name: "invalid json", target: "/images/build", contentType: echo.MIMEApplicationJSON, body: `{`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images, docker := newTestBuildImage(t, testBuildStream)
+
+			recorder, _ := runTestBuild(t, images, tt.target, tt.contentType, strings.NewReader(tt.body))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", recorder.Code, http.StatusBadRequest)
+			}
+			if docker.query != nil {
+				t.Errorf("build started with %v", docker.query)
+			}
+		})
+	}
+}
+
+func TestImageBuildWithoutImageID(t *testing.T) {
+	images, _ := newTestBuildImage(t, `{"stream":"Step 1/1 : FROM alpine:3.20\n"}`+"\n")
+
+	recorder, result := runTestBuild(t, images, "/images/build", echo.MIMEApplicationJSON, strings.NewReader(`{"dockerfile":"FROM alpine:3.20"}`))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	if result.Error != ErrBuildWithoutImageID.Error() || result.ImageID != "" {
+		t.Errorf("result = %+v, want %q", result, ErrBuildWithoutImageID)
+	}
+}
@@ -0,0 +1,383 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const maxImageGCRuns = 100
+
+var ErrImageGCRunning = errors.New("image garbage collection is already running")
+
+type ImageGCOptions struct {
+	Interval        time.Duration // How often disk usage is checked
+	HighWatermark   float64       // Disk used percent starting a collection
+	LowWatermark    float64       // Disk used percent a collection stops at
+	MinAge          time.Duration // Images younger than this are never removed
+	KeepLastTags    int           // Newest tagged images kept per repository
+	ProtectedLabels []string      // `key` or `key=value`, values may contain `*`
+	ProtectedRefs   []string      // Reference patterns, e.g. `postgres:*` or `registry.example.com/*`
+}
+
+type ImageGCDeletion struct {
+	ID      string    `json:"id"`
+	Tags    []string  `json:"tags"`
+	Size    int64     `json:"size"` // Size not shared with other images
+	Created time.Time `json:"created"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type ImageGCRun struct {
+	ID                string            `json:"id"`
+	Trigger           string            `json:"trigger"` // schedule or manual
+	DryRun            bool              `json:"dry_run"`
+	StartedAt         time.Time         `json:"started_at"`
+	FinishedAt        time.Time         `json:"finished_at"`
+	DiskUsedBefore    float64           `json:"disk_used_percent_before"`
+	DiskUsedAfter     float64           `json:"disk_used_percent_after"`
+	Deleted           []ImageGCDeletion `json:"deleted"`
+	SpaceReclaimed    int64             `json:"space_reclaimed"`
+	CandidatesSkipped int               `json:"candidates_skipped"` // Candidates left once the low watermark was reached
+	Error             string            `json:"error,omitempty"`
+}
+
+// ImageGC removes unused images once disk usage crosses the high watermark,
+// until it drops under the low watermark. Dangling images go first, then the
+// oldest ones. Images used by any container, younger than MinAge, among the
+// KeepLastTags newest of their repository or matching a protected pattern are
+// kept.
+type ImageGC struct {
+	dockerClient *client.Client
+	options      ImageGCOptions
+	runsPath     string
+
+	running   sync.Mutex
+	mu        sync.Mutex
+	lastCheck time.Time
+	lastUsage float64
+}
+
+func NewImageGC(dockerClient *client.Client, options ImageGCOptions, dataDir string) *ImageGC {
+	return &ImageGC{
+		dockerClient: dockerClient,
+		options:      options,
+		runsPath:     filepath.Join(dataDir, "image_gc_runs.json"),
+	}
+}
+
+// Run checks disk usage every interval until ctx is done.
+func (g *ImageGC) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		run, err := g.collect(ctx, "schedule", false, false)
+		if err != nil && !errors.Is(err, ErrImageGCRunning) {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("image_gc").Str("collect")).
+				Msg("error collecting images")
+		}
+		if run != nil && run.Error != "" {
+			log.Error().
+				Array("tags", zerolog.Arr().Str("image_gc").Str("collect")).
+				Str("run_id", run.ID).
+				Str("error", run.Error).
+				Msg("image garbage collection failed")
+		}
+	}
+}
+
+// collect runs a collection when disk usage is above the high watermark, or
+// regardless of it when forced. It returns nil when there was nothing to do.
+func (g *ImageGC) collect(ctx context.Context, trigger string, force, dryRun bool) (*ImageGCRun, error) {
+	if !g.running.TryLock() {
+		return nil, ErrImageGCRunning
+	}
+	defer g.running.Unlock()
+
+	specs, err := getMachineSpecs()
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	g.lastCheck = time.Now().UTC()
+	g.lastUsage = specs.Storage.UsedPercent
+	g.mu.Unlock()
+
+	if !force && specs.Storage.UsedPercent < g.options.HighWatermark {
+		return nil, nil
+	}
+
+	run := &ImageGCRun{
+		ID:             newRandomID(),
+		Trigger:        trigger,
+		DryRun:         dryRun,
+		StartedAt:      time.Now().UTC(),
+		DiskUsedBefore: specs.Storage.UsedPercent,
+		DiskUsedAfter:  specs.Storage.UsedPercent,
+		Deleted:        []ImageGCDeletion{},
+	}
+
+	candidates, err := g.candidates(ctx)
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	for i, candidate := range candidates {
+		if run.DiskUsedAfter <= g.options.LowWatermark {
+			run.CandidatesSkipped = len(candidates) - i
+			break
+		}
+
+		deletion := ImageGCDeletion{
+			ID:      candidate.ID,
+			Tags:    candidate.RepoTags,
+			Size:    uniqueImageSize(candidate),
+			Created: time.Unix(candidate.Created, 0).UTC(),
+		}
+
+		if !dryRun {
+			_, err := g.dockerClient.ImageRemove(ctx, candidate.ID, image.RemoveOptions{Force: true, PruneChildren: true})
+			if err != nil {
+				deletion.Error = err.Error()
+				run.Deleted = append(run.Deleted, deletion)
+				continue
+			}
+
+			if specs, err := getMachineSpecs(); err == nil {
+				run.DiskUsedAfter = specs.Storage.UsedPercent
+			}
+		}
+
+		run.Deleted = append(run.Deleted, deletion)
+		run.SpaceReclaimed += deletion.Size
+	}
+	run.FinishedAt = time.Now().UTC()
+
+	if err := g.record(*run); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("image_gc").Str("record")).
+			Msg("error persisting image gc run")
+	}
+
+	return run, nil
+}
+
+// candidates lists the images that may be removed, in removal order.
+func (g *ImageGC) candidates(ctx context.Context) ([]image.Summary, error) {
+	images, err := g.dockerClient.ImageList(ctx, image.ListOptions{SharedSize: true})
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := g.dockerClient.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	inUse := map[string]bool{}
+	for _, ctr := range containers {
+		inUse[ctr.ImageID] = true
+	}
+
+	// Keep the newest tagged images of every repository.
+	kept := map[string]bool{}
+	byRepository := map[string][]image.Summary{}
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if tag == "<none>:<none>" {
+				continue
+			}
+			repository := tag
+			if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+				repository = tag[:i]
+			}
+			byRepository[repository] = append(byRepository[repository], img)
+		}
+	}
+	for _, repositoryImages := range byRepository {
+		sort.Slice(repositoryImages, func(i, j int) bool { return repositoryImages[i].Created > repositoryImages[j].Created })
+
+		seen := map[string]bool{}
+		for _, img := range repositoryImages {
+			if len(seen) >= g.options.KeepLastTags {
+				break
+			}
+			seen[img.ID] = true
+			kept[img.ID] = true
+		}
+	}
+
+	candidates := []image.Summary{}
+	for _, img := range images {
+		switch {
+		case inUse[img.ID], kept[img.ID]:
+		case time.Since(time.Unix(img.Created, 0)) < g.options.MinAge:
+		case g.protected(img):
+		default:
+			candidates = append(candidates, img)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		iDangling, jDangling := isDanglingImage(candidates[i]), isDanglingImage(candidates[j])
+		if iDangling != jDangling {
+			return iDangling
+		}
+		return candidates[i].Created < candidates[j].Created
+	})
+
+	return candidates, nil
+}
+
+func (g *ImageGC) protected(img image.Summary) bool {
+	for _, pattern := range g.options.ProtectedLabels {
+		key, value, hasValue := strings.Cut(pattern, "=")
+		labelValue, found := img.Labels[key]
+		if found && (!hasValue || globMatch(value, labelValue)) {
+			return true
+		}
+	}
+
+	for _, pattern := range g.options.ProtectedRefs {
+		for _, ref := range append(img.RepoTags, img.RepoDigests...) {
+			if globMatch(pattern, ref) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (g *ImageGC) record(run ImageGCRun) error {
+	runs := []ImageGCRun{}
+	if err := readJSONFile(g.runsPath, &runs); err != nil {
+		return err
+	}
+
+	runs = append(runs, run)
+	if len(runs) > maxImageGCRuns {
+		runs = runs[len(runs)-maxImageGCRuns:]
+	}
+
+	return writeJSONFile(g.runsPath, runs)
+}
+
+func (g *ImageGC) Status(c echo.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": map[string]any{
+			"interval":          g.options.Interval.String(),
+			"high_watermark":    g.options.HighWatermark,
+			"low_watermark":     g.options.LowWatermark,
+			"min_age":           g.options.MinAge.String(),
+			"keep_last_tags":    g.options.KeepLastTags,
+			"protected_labels":  g.options.ProtectedLabels,
+			"protected_refs":    g.options.ProtectedRefs,
+			"last_check":        g.lastCheck,
+			"disk_used_percent": g.lastUsage,
+		},
+	})
+}
+
+// Runs lists the recorded collections, newest first.
+func (g *ImageGC) Runs(c echo.Context) error {
+	runs := []ImageGCRun{}
+	if err := readJSONFile(g.runsPath, &runs); err != nil {
+		log.Err(err).Msg("error reading image gc runs")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	data := make([]ImageGCRun, 0, len(runs))
+	for i := len(runs) - 1; i >= 0; i-- {
+		data = append(data, runs[i])
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+// Trigger runs a collection right away. Without `force=true` nothing happens
+// while disk usage is under the high watermark. `dry_run=true` removes
+// nothing and reports every candidate, as disk usage cannot be projected.
+func (g *ImageGC) Trigger(c echo.Context) error {
+	run, err := g.collect(c.Request().Context(), "manual", c.QueryParam("force") == "true", c.QueryParam("dry_run") == "true")
+	if err != nil {
+		if errors.Is(err, ErrImageGCRunning) {
+			return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody(err.Error()))
+		}
+		log.Err(err).Msg("error collecting images")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	if run == nil {
+		return c.JSON(http.StatusOK, map[string]any{
+			"message": "Disk usage is under the high watermark, nothing to collect",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Image garbage collection finished",
+		"data":    run,
+	})
+}
+
+func isDanglingImage(img image.Summary) bool {
+	return len(img.RepoTags) == 0 || (len(img.RepoTags) == 1 && img.RepoTags[0] == "<none>:<none>")
+}
+
+// uniqueImageSize is the size freed by removing the image alone.
+func uniqueImageSize(img image.Summary) int64 {
+	if img.SharedSize > 0 {
+		return img.Size - img.SharedSize
+	}
+
+	return img.Size
+}
+
+// globMatch matches s against a pattern where `*` matches any sequence of
+// characters, `/` included.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+)
+
+func TestImageGCCandidates(t *testing.T) {
+	daysAgo := func(days int) int64 {
+		return time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	}
+
+	images := []image.Summary{
+		{ID: "nginx-1.25", RepoTags: []string{"nginx:1.25"}, Created: daysAgo(30)},
+		{ID: "nginx-1.26", RepoTags: []string{"nginx:1.26"}, Created: daysAgo(20)},
+		{ID: "nginx-1.27", RepoTags: []string{"nginx:1.27"}, Created: daysAgo(10)},
+		{ID: "app-old", RepoTags: []string{"registry.example.com:5000/app:1"}, Created: daysAgo(40)},
+		{ID: "app-new", RepoTags: []string{"registry.example.com:5000/app:2"}, Created: daysAgo(5)},
+		{ID: "postgres", RepoTags: []string{"postgres:16"}, Created: daysAgo(50)},
+		{ID: "labeled", RepoTags: []string{"tools:1"}, Created: daysAgo(60), Labels: map[string]string{"keep": "forever"}},
+		{ID: "dangling-old", RepoTags: []string{"<none>:<none>"}, Created: daysAgo(25)},
+		{ID: "dangling-new", Created: daysAgo(3)},
+		{ID: "dangling-fresh", Created: time.Now().Unix()},
+		{ID: "in-use", RepoTags: []string{"redis:7"}, Created: daysAgo(90)},
+		{ID: "redis-old", RepoTags: []string{"redis:6"}, Created: daysAgo(100)},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(images)
+	})
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]types.Container{{ID: "cache", ImageID: "in-use"}})
+	})
+	cli := newTestDockerClient(t, mux)
+
+	tests := []struct {
+		name    string
+		options ImageGCOptions
+		want    []string
+	}{
+		{
+			name:    "nothing kept",
+			options: ImageGCOptions{},
+			want:    []string{"dangling-old", "dangling-new", "dangling-fresh", "redis-old", "labeled", "postgres", "app-old", "nginx-1.25", "nginx-1.26", "nginx-1.27", "app-new"},
+		},
+		{
+			name:    "dangling first, then oldest",
+			options: ImageGCOptions{MinAge: 24 * time.Hour},
+			want:    []string{"dangling-old", "dangling-new", "redis-old", "labeled", "postgres", "app-old", "nginx-1.25", "nginx-1.26", "nginx-1.27", "app-new"},
+		},
+		{
+			name:    "newest tags of every repository",
+			options: ImageGCOptions{MinAge: 24 * time.Hour, KeepLastTags: 2},
+			want:    []string{"dangling-old", "dangling-new", "nginx-1.25"},
+		},
+		{
+			// The image in use still counts as the newest of redis.
+			name:    "newest tag of every repository",
+			options: ImageGCOptions{MinAge: 24 * time.Hour, KeepLastTags: 1},
+			want:    []string{"dangling-old", "dangling-new", "redis-old", "app-old", "nginx-1.25", "nginx-1.26"},
+		},
+		{
+			name:    "protected",
+			options: ImageGCOptions{MinAge: 24 * time.Hour, ProtectedLabels: []string{"keep=f*"}, ProtectedRefs: []string{"postgres:*", "registry.example.com:5000/*"}},
+			want:    []string{"dangling-old", "dangling-new", "redis-old", "nginx-1.25", "nginx-1.26", "nginx-1.27"},
+		},
+		{
+			name:    "protected label without value",
+			options: ImageGCOptions{MinAge: 24 * time.Hour, ProtectedLabels: []string{"keep"}},
+			want:    []string{"dangling-old", "dangling-new", "redis-old", "postgres", "app-old", "nginx-1.25", "nginx-1.26", "nginx-1.27", "app-new"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, err := NewImageGC(cli, tt.options, t.TempDir()).candidates(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, img := range candidates {
+				got = append(got, img.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{pattern: "postgres:16", s: "postgres:16", want: true},
+		{pattern: "postgres:16", s: "postgres:16.1", want: false},
+		{pattern: "postgres:*", s: "postgres:16", want: true},
+		{pattern: "postgres:*", s: "postgres", want: false},
+		{pattern: "*", s: "", want: true},
+		{pattern: "registry.example.com/*", s: "registry.example.com/team/app:1", want: true},
+		{pattern: "*/app:*", s: "registry.example.com/team/app:1", want: true},
+		{pattern: "*/app:*", s: "app:1", want: false},
+		{pattern: "a*b*c", s: "abc", want: true},
+		{pattern: "a*b*c", s: "acb", want: false},
+		{pattern: "ab*ba", s: "aba", want: false},
+		{pattern: "*-rc*", s: "app:1.0-rc1", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %t, want %t", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type ImageInventoryContainer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+// ImageInventoryTag is a tagged image the image was built from, as recorded
+// in its history.
+type ImageInventoryTag struct {
+	Tags      []string  `json:"tags"`
+	ImageID   string    `json:"image_id"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+type ImageInventoryItem struct {
+	ID          string                    `json:"id"`
+	Tags        []string                  `json:"tags"`
+	Digests     []string                  `json:"digests"`
+	Created     time.Time                 `json:"created"`
+	Size        int64                     `json:"size"`
+	SharedSize  int64                     `json:"shared_size"` // Size of the layers shared with other images
+	UniqueSize  int64                     `json:"unique_size"` // Size freed by removing this image alone
+	Dangling    bool                      `json:"dangling"`
+	Containers  []ImageInventoryContainer `json:"containers"`
+	InUse       bool                      `json:"in_use"`              // A container using it is running
+	LastUsed    *time.Time                `json:"last_used,omitempty"` // Last time a container using it ran, nil when never
+	TagHistory  []ImageInventoryTag       `json:"tag_history"`
+	Reclaimable bool                      `json:"reclaimable"` // No container, stopped or not, uses it
+}
+
+// ImageInventorySummary adds up the listed images.
+type ImageInventorySummary struct {
+	Images           int   `json:"images"`
+	Dangling         int   `json:"dangling"`
+	Unused           int   `json:"unused"`
+	LayersSize       int64 `json:"layers_size"`       // Disk used by all image layers, shared ones counted once
+	ReclaimableSize  int64 `json:"reclaimable_size"`  // Unique size of the images no container uses
+	DanglingSize     int64 `json:"dangling_size"`     // Unique size of the dangling images
+	SharedSize       int64 `json:"shared_size"`       // Sum of the images shared sizes
+	TotalUniqueSize  int64 `json:"total_unique_size"` // Sum of the images unique sizes
+	ContainersLinked int   `json:"containers_linked"` // Containers using one of the listed images
+}
+
+// Inventory lists the images joined with the containers using them and their
+// disk accounting, to decide what to clean up. `dangling=true|false` and
+// `unused=true` filter the list, `sort` orders it by `unique_size` (default),
+// `size`, `created` or `last_used`, largest or newest first.
+func (i *Image) Inventory(c echo.Context) error {
+	sortBy := c.QueryParam("sort")
+	switch sortBy {
+	case "":
+		sortBy = "unique_size"
+	case "unique_size", "size", "created", "last_used":
+	default:
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("sort must be one of unique_size, size, created or last_used"))
+	}
+
+	ctx := c.Request().Context()
+
+	diskUsage, err := i.dockerClient.DiskUsage(ctx, types.DiskUsageOptions{Types: []types.DiskUsageObject{types.ImageObject}})
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("image").Str("inventory")).
+			Str("sort", sortBy).
+			Msg("error getting image disk usage")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	containers, err := i.dockerClient.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("image").Str("inventory")).
+			Str("sort", sortBy).
+			Msg("error listing containers")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	// Containers are grouped by image and inspected once, not per image.
+	containersByImage := map[string][]types.Container{}
+	lastUsedByContainer := map[string]time.Time{}
+	for _, ctr := range containers {
+		containersByImage[ctr.ImageID] = append(containersByImage[ctr.ImageID], ctr)
+		lastUsedByContainer[ctr.ID] = i.containerLastUsed(ctx, ctr)
+	}
+
+	items := make([]ImageInventoryItem, 0, len(diskUsage.Images))
+	summary := ImageInventorySummary{LayersSize: diskUsage.LayersSize}
+	for _, img := range diskUsage.Images {
+		item := ImageInventoryItem{
+			ID:         img.ID,
+			Tags:       []string{},
+			Digests:    []string{},
+			Created:    time.Unix(img.Created, 0).UTC(),
+			Size:       img.Size,
+			SharedSize: max(img.SharedSize, 0),
+			UniqueSize: uniqueImageSize(*img),
+			Dangling:   isDanglingImage(*img),
+			Containers: []ImageInventoryContainer{},
+		}
+		for _, tag := range img.RepoTags {
+			if tag != "<none>:<none>" {
+				item.Tags = append(item.Tags, tag)
+			}
+		}
+		for _, repoDigest := range img.RepoDigests {
+			if repoDigest != "<none>@<none>" {
+				item.Digests = append(item.Digests, repoDigest)
+			}
+		}
+
+		for _, ctr := range containersByImage[img.ID] {
+			usage := ImageInventoryContainer{ID: ctr.ID, State: ctr.State}
+			if len(ctr.Names) > 0 {
+				usage.Name = strings.TrimPrefix(ctr.Names[0], "/")
+			}
+			item.Containers = append(item.Containers, usage)
+
+			lastUsed := lastUsedByContainer[ctr.ID]
+			if item.LastUsed == nil || lastUsed.After(*item.LastUsed) {
+				item.LastUsed = &lastUsed
+			}
+			if ctr.State == "running" {
+				item.InUse = true
+			}
+		}
+		item.Reclaimable = len(item.Containers) == 0
+
+		if c.QueryParam("dangling") == "true" && !item.Dangling ||
+			c.QueryParam("dangling") == "false" && item.Dangling ||
+			c.QueryParam("unused") == "true" && !item.Reclaimable {
+			continue
+		}
+
+		item.TagHistory = i.tagHistory(ctx, img.ID)
+
+		summary.Images++
+		summary.SharedSize += item.SharedSize
+		summary.TotalUniqueSize += item.UniqueSize
+		summary.ContainersLinked += len(item.Containers)
+		if item.Dangling {
+			summary.Dangling++
+			summary.DanglingSize += item.UniqueSize
+		}
+		if item.Reclaimable {
+			summary.Unused++
+			summary.ReclaimableSize += item.UniqueSize
+		}
+
+		items = append(items, item)
+	}
+
+	sort.SliceStable(items, func(a, b int) bool {
+		switch sortBy {
+		case "size":
+			return items[a].Size > items[b].Size
+		case "created":
+			return items[a].Created.After(items[b].Created)
+		case "last_used":
+			if items[a].LastUsed == nil || items[b].LastUsed == nil {
+				return items[b].LastUsed == nil && items[a].LastUsed != nil
+			}
+			return items[a].LastUsed.After(*items[b].LastUsed)
+		default:
+			return items[a].UniqueSize > items[b].UniqueSize
+		}
+	})
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data":    items,
+		"summary": summary,
+	})
+}
+
+// containerLastUsed is now for a running container, otherwise when it last
+// stopped, started or was created.
+func (i *Image) containerLastUsed(ctx context.Context, ctr types.Container) time.Time {
+	if ctr.State == "running" {
+		return time.Now().UTC()
+	}
+
+	lastUsed := time.Unix(ctr.Created, 0).UTC()
+
+	inspect, err := i.dockerClient.ContainerInspect(ctx, ctr.ID)
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("image").Str("inventory")).
+			Str("container_id", ctr.ID).
+			Msg("error inspecting container, using its creation time as last use")
+		return lastUsed
+	}
+	if inspect.State == nil {
+		return lastUsed
+	}
+	for _, value := range []string{inspect.State.FinishedAt, inspect.State.StartedAt} {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil && t.After(lastUsed) {
+			lastUsed = t.UTC()
+		}
+	}
+
+	return lastUsed
+}
+
+// tagHistory lists the tagged images found in the history of imageID, the
+// image itself first.
+func (i *Image) tagHistory(ctx context.Context, imageID string) []ImageInventoryTag {
+	history := []ImageInventoryTag{}
+
+	items, err := i.dockerClient.ImageHistory(ctx, imageID)
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("image").Str("inventory")).
+			Str("image_id", imageID).
+			Msg("error getting image history")
+		return history
+	}
+
+	for _, item := range items {
+		if len(item.Tags) == 0 {
+			continue
+		}
+		history = append(history, ImageInventoryTag{
+			Tags:      item.Tags,
+			ImageID:   item.ID,
+			Created:   time.Unix(item.Created, 0).UTC(),
+			CreatedBy: item.CreatedBy,
+		})
+	}
+
+	return history
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/labstack/echo/v4"
+)
+
+func TestImageInventoryInspectsContainersOnce(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inspects = map[string]int{}
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /system/df", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(types.DiskUsage{Images: []*image.Summary{
+			{ID: "sha256:app", RepoTags: []string{"app:v2"}, Size: 300, SharedSize: 100, Containers: 2},
+			{ID: "sha256:db", RepoTags: []string{"db:16"}, Size: 500, Containers: 1},
+			{ID: "sha256:old", RepoTags: []string{"<none>:<none>"}, Size: 200},
+		}})
+	})
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]types.Container{
+			{ID: "web", Names: []string{"/web"}, ImageID: "sha256:app", State: "running", Created: 1700000000},
+			{ID: "worker", Names: []string{"/worker"}, ImageID: "sha256:app", State: "exited", Created: 1700000000},
+			{ID: "postgres", Names: []string{"/postgres"}, ImageID: "sha256:db", State: "exited", Created: 1700000000},
+		})
+	})
+	mux.HandleFunc("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inspects[r.PathValue("id")]++
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    r.PathValue("id"),
+			State: &types.ContainerState{Status: "exited", FinishedAt: "2024-03-01T10:00:00Z"},
+		}})
+	})
+	mux.HandleFunc("GET /images/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+
+	images := &Image{dockerClient: newTestDockerClient(t, mux)}
+	recorder := httptest.NewRecorder()
+	if err := images.Inventory(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/images/inventory", nil), recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+
+	// Running containers are in use now, only stopped ones are inspected.
+	if len(inspects) != 2 || inspects["worker"] != 1 || inspects["postgres"] != 1 {
+		t.Errorf("inspects = %v, want worker and postgres once each", inspects)
+	}
+
+	var body struct {
+		Data    []ImageInventoryItem  `json:"data"`
+		Summary ImageInventorySummary `json:"summary"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	byID := map[string]ImageInventoryItem{}
+	for _, item := range body.Data {
+		byID[item.ID] = item
+	}
+	if app := byID["sha256:app"]; len(app.Containers) != 2 || !app.InUse || app.Reclaimable {
+		t.Errorf("app = %+v, want two containers, in use", app)
+	}
+	if db := byID["sha256:db"]; db.InUse || db.LastUsed == nil || db.LastUsed.Format("2006-01-02") != "2024-03-01" {
+		t.Errorf("db = %+v, want last used when postgres stopped", db)
+	}
+	if old := byID["sha256:old"]; !old.Dangling || !old.Reclaimable {
+		t.Errorf("old = %+v, want dangling and reclaimable", old)
+	}
+	if body.Summary.ContainersLinked != 3 || body.Summary.Unused != 1 {
+		t.Errorf("summary = %+v", body.Summary)
+	}
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/labstack/echo/v4"
+)
+
+// decodeRegistryAuth decodes an X-Registry-Auth value, which docker expects
+// to be base64url encoded.
+func decodeRegistryAuth(t *testing.T, encoded string) registry.AuthConfig {
+	t.Helper()
+
+	decoded, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("auth %q is not base64url: %v", encoded, err)
+	}
+
+	var auth registry.AuthConfig
+	if err := json.Unmarshal(decoded, &auth); err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestImageRegistryAuth(t *testing.T) {
+	credentials := NewRegistryCredentialStore(t.TempDir())
+	if _, err := credentials.Save(registry.AuthConfig{Username: "stored", Password: "stored-password", ServerAddress: "ghcr.io"}); err != nil {
+		t.Fatal(err)
+	}
+	images := NewImage(nil, nil, credentials, nil, "")
+
+	tests := []struct {
+		name         string
+		imageRef     string
+		auth         registry.AuthConfig
+		wantUsername string // Empty for no auth
+	}{
+		{name: "stored", imageRef: "ghcr.io/owner/app:1", wantUsername: "stored"},
+		{name: "inline", imageRef: "ghcr.io/owner/app:1", auth: registry.AuthConfig{Username: "inline", Password: "inline-password"}, wantUsername: "inline"},
+		{name: "inline token", imageRef: "nginx:1.27", auth: registry.AuthConfig{IdentityToken: "token"}},
+		{name: "server address only", imageRef: "ghcr.io/owner/app:1", auth: registry.AuthConfig{ServerAddress: "ghcr.io"}, wantUsername: "stored"},
+		{name: "none", imageRef: "nginx:1.27"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := images.registryAuth(tt.imageRef, tt.auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantUsername == "" && tt.auth.IdentityToken == "" {
+				if encoded != "" {
+					t.Errorf("registryAuth() = %q, want none", encoded)
+				}
+				return
+			}
+
+			auth := decodeRegistryAuth(t, encoded)
+			if auth.Username != tt.wantUsername || auth.IdentityToken != tt.auth.IdentityToken {
+				t.Errorf("auth = %+v, want username %q", auth, tt.wantUsername)
+			}
+		})
+	}
+}
+
+func TestImagePushSendsRegistryAuth(t *testing.T) {
+	// Characters encoded differently by base64 and base64url.
+	password := "pa??word~"
+
+	var header string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /images/registry.example.com/app/push", func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Registry-Auth")
+		w.Write([]byte(`{"status":"Pushing","id":"a1"}` + "\n" +
+			`{"status":"1.0: digest: sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945 size: 527"}` + "\n" +
+			`{"progressDetail":{},"aux":{"Tag":"1.0","Digest":"sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945","Size":527}}` + "\n"))
+	})
+
+	images := NewImage(newTestDockerClient(t, mux), nil, NewRegistryCredentialStore(t.TempDir()), nil, "")
+	body, _ := json.Marshal(ImagePushRequest{Reference: "registry.example.com/app:1.0", Auth: registry.AuthConfig{Username: "bot", Password: password}})
+	recorder := httptest.NewRecorder()
+	if err := images.Push(echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/images/push", strings.NewReader(string(body))), recorder)); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth := decodeRegistryAuth(t, header); auth.Username != "bot" || auth.Password != password {
+		t.Errorf("auth = %+v", auth)
+	}
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	var result ImagePushResult
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Tag != "1.0" || result.Digest != "sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945" || result.Error != "" {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestImageCommit(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantQuery string
+	}{
+		{
+			// Docker pauses unless told otherwise.
+			name:      "defaults to pausing",
+			body:      `{"tag":"postmortem/api:1","message":"crash","author":"ops","changes":["ENV DEBUG=true"]}`,
+			wantQuery: "author=ops&changes=ENV+DEBUG%3Dtrue&comment=crash&container=api&repo=postmortem%2Fapi&tag=1",
+		},
+		{
+			name:      "without pausing",
+			body:      `{"pause":false}`,
+			wantQuery: "author=&comment=&container=api&pause=0&repo=&tag=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /commit", func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query().Encode()
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"Id":"sha256:committed"}`))
+			})
+			mux.HandleFunc("GET /images/sha256:committed/json", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"Id":"sha256:committed","RepoTags":["postmortem/api:1"]}`))
+			})
+			images := NewImage(newTestDockerClient(t, mux), nil, NewRegistryCredentialStore(t.TempDir()), nil, "")
+
+			recorder := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)), recorder)
+			c.SetParamNames("id")
+			c.SetParamValues("api")
+			if err := images.Commit(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"Id":"sha256:committed"`) {
+				t.Errorf("status = %d, body %s", recorder.Code, recorder.Body)
+			}
+			if query != tt.wantQuery {
+				t.Errorf("query = %s, want %s", query, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestImageExport(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/api/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("rootfs tarball"))
+	})
+	mux.HandleFunc("GET /containers/missing/export", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"No such container: missing"}`))
+	})
+	images := NewImage(newTestDockerClient(t, mux), nil, NewRegistryCredentialStore(t.TempDir()), nil, "")
+
+	export := func(containerID string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), recorder)
+		c.SetParamNames("id")
+		c.SetParamValues(containerID)
+		if err := images.Export(c); err != nil {
+			t.Fatal(err)
+		}
+		return recorder
+	}
+
+	recorder := export("api")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "rootfs tarball" {
+		t.Errorf("status = %d, body %q", recorder.Code, recorder.Body)
+	}
+	if disposition := recorder.Header().Get(echo.HeaderContentDisposition); disposition != `attachment; filename=api.tar` {
+		t.Errorf("content disposition = %q", disposition)
+	}
+
+	if recorder := export("missing"); recorder.Code == http.StatusOK {
+		t.Errorf("missing container: status = %d", recorder.Code)
+	}
+}
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrUploadFileMissing = errors.New("multipart body has no `file` part")
+
+// Save streams the images given as `ref` query params, repeated or comma
+// separated, as a single tarball that Load accepts on another host.
+func (i *Image) Save(c echo.Context) error {
+	refs := []string{}
+	for _, value := range c.QueryParams()["ref"] {
+		for _, ref := range strings.Split(value, ",") {
+			if ref = strings.TrimSpace(ref); ref != "" {
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	if len(refs) == 0 {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("at least one image reference must be given as `ref`"))
+	}
+
+	rc, err := i.dockerClient.ImageSave(c.Request().Context(), refs)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return c.JSON(http.StatusNotFound, NotFoundResponseBody(err.Error()))
+		}
+		log.Err(err).
+			Strs("refs", refs).
+			Msg("error saving images")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer rc.Close()
+
+	filename := "images.tar"
+	if len(refs) == 1 {
+		filename = strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(refs[0]) + ".tar"
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-tar")
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Response().WriteHeader(http.StatusOK)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			if _, err := c.Response().Write(buf[:n]); err != nil {
+				log.Err(err).Msg("error writing save chunk")
+				return nil
+			}
+			c.Response().Flush()
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Err(err).Msg("error reading save response")
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Load loads images from a tarball produced by Save or `docker save`. The
+// tarball is either the raw body or the `file` part of a multipart body.
+func (i *Image) Load(c echo.Context) error {
+	body, err := uploadedFile(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	response, err := i.dockerClient.ImageLoad(c.Request().Context(), body, true)
+	if err != nil {
+		log.Err(err).Msg("error loading images")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer response.Body.Close()
+
+	loaded := []string{}
+	err = decodeJSONMessages(response.Body, func(raw json.RawMessage) error {
+		var message jsonmessage.JSONMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return err
+		}
+
+		// Docker reports `Loaded image: <ref>` for tagged images and
+		// `Loaded image ID: <id>` for untagged ones.
+		for _, line := range strings.Split(message.Stream, "\n") {
+			if ref, found := strings.CutPrefix(line, "Loaded image ID: "); found {
+				loaded = append(loaded, strings.TrimSpace(ref))
+			} else if ref, found := strings.CutPrefix(line, "Loaded image: "); found {
+				loaded = append(loaded, strings.TrimSpace(ref))
+			}
+		}
+		return nil
+	}, func(json.RawMessage) {})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody(err.Error()))
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Images loaded successfully",
+		"data":    loaded,
+	})
+}
+
+// Import creates an image from a rootfs tarball, given as the raw body or the
+// `file` part of a multipart body. The image is tagged with the `ref` query
+// param, `message`, `platform` and repeated `change` params are optional.
+func (i *Image) Import(c echo.Context) error {
+	ref := c.QueryParam("ref")
+
+	body, err := uploadedFile(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	rc, err := i.dockerClient.ImageImport(c.Request().Context(), types.ImageImportSource{
+		Source:     body,
+		SourceName: "-",
+	}, ref, image.ImportOptions{
+		Message:  c.QueryParam("message"),
+		Changes:  c.QueryParams()["change"],
+		Platform: c.QueryParam("platform"),
+	})
+	if err != nil {
+		if errdefs.IsInvalidParameter(err) {
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+		}
+		log.Err(err).
+			Str("ref", ref).
+			Msg("error importing image")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer rc.Close()
+
+	// The last status message carries the id of the imported image.
+	imageID := ""
+	err = decodeJSONMessages(rc, func(raw json.RawMessage) error {
+		var message jsonmessage.JSONMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return err
+		}
+		if strings.HasPrefix(message.Status, "sha256:") {
+			imageID = strings.TrimSpace(message.Status)
+		}
+		return nil
+	}, func(json.RawMessage) {})
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody(err.Error()))
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":   "Image imported successfully",
+		"id":        imageID,
+		"reference": ref,
+	})
+}
+
+// uploadedFile returns the uploaded content without buffering it, either the
+// raw body or the `file` part of a multipart body.
+func uploadedFile(c echo.Context) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType != echo.MIMEMultipartForm {
+		return c.Request().Body, nil
+	}
+
+	reader, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, ErrUploadFileMissing
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// multipartBody encodes the parts in order, as form fields or as files when
+// their name is "file".
+func multipartBody(t *testing.T, parts [][2]string) (string, *bytes.Buffer) {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		var (
+			w   io.Writer
+			err error
+		)
+		if part[0] == "file" {
+			w, err = writer.CreateFormFile(part[0], "images.tar")
+		} else {
+			w, err = writer.CreateFormField(part[0])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(part[1]))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writer.FormDataContentType(), &body
+}
+
+func TestUploadedFile(t *testing.T) {
+	fileAfterField, body := multipartBody(t, [][2]string{{"ref", "app:1"}, {"file", "tarball"}})
+	fileAfterFieldBody := body.String()
+	withoutFile, body := multipartBody(t, [][2]string{{"ref", "app:1"}})
+	withoutFileBody := body.String()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		wantErr     error // nil to only check that an error is returned
+	}{
+		{name: "raw", contentType: "application/x-tar", body: "tarball", want: "tarball"},
+		{name: "no content type", body: "tarball", want: "tarball"},
+		{name: "multipart", contentType: fileAfterField, body: fileAfterFieldBody, want: "tarball"},
+		{name: "multipart without file", contentType: withoutFile, body: withoutFileBody, wantErr: ErrUploadFileMissing},
+		{name: "multipart without boundary", contentType: echo.MIMEMultipartForm, body: fileAfterFieldBody},
+		{name: "truncated multipart", contentType: fileAfterField, body: fileAfterFieldBody[:40]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/images/load", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				request.Header.Set(echo.HeaderContentType, tt.contentType)
+			}
+
+			r, err := uploadedFile(echo.New().NewContext(request, httptest.NewRecorder()))
+			if tt.want == "" {
+				if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+					t.Errorf("uploadedFile() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("content = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageLoadReportsLoadedImages(t *testing.T) {
+	var loaded string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /images/load", func(w http.ResponseWriter, r *http.Request) {
+		content, _ := io.ReadAll(r.Body)
+		loaded = string(content)
+		w.Write([]byte(`{"stream":"Loaded image: app:1\n"}` + "\n" +
+			`{"stream":"Loaded image ID: sha256:9c7a54a9a43cca047013b82af109fe963fde787f63f9e016fdc3384500c2823d\n"}` + "\n"))
+	})
+	images := NewImage(newTestDockerClient(t, mux), nil, NewRegistryCredentialStore(t.TempDir()), nil, "")
+
+	contentType, body := multipartBody(t, [][2]string{{"file", "tarball"}})
+	request := httptest.NewRequest(http.MethodPost, "/images/load", body)
+	request.Header.Set(echo.HeaderContentType, contentType)
+	recorder := httptest.NewRecorder()
+	if err := images.Load(echo.New().NewContext(request, recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+
+	var response struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if loaded != "tarball" || strings.Join(response.Data, ",") != "app:1,sha256:9c7a54a9a43cca047013b82af109fe963fde787f63f9e016fdc3384500c2823d" {
+		t.Errorf("docker received %q, loaded %v", loaded, response.Data)
+	}
+}
@@ -0,0 +1,469 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	maxSignaturePayloadSize   = 1 << 20
+)
+
+var (
+	ErrImageNotSigned        = errors.New("image has no signature")
+	ErrImageSignatureInvalid = errors.New("image signature does not match any trusted key")
+)
+
+type ImageVerifierOptions struct {
+	PublicKeys         []string // Paths of PEM encoded ECDSA or ed25519 public keys
+	InsecureRegistries []string // Registries reached over plain http
+}
+
+// ImageVerification is the outcome of a successful verification.
+type ImageVerification struct {
+	Reference       string `json:"reference"`
+	Digest          string `json:"digest"`
+	PinnedReference string `json:"pinned_reference"` // Reference by digest, what is actually pulled
+	KeyID           string `json:"key_id"`           // Fingerprint of the key the signature was verified with
+}
+
+type verificationKey struct {
+	id        string
+	publicKey crypto.PublicKey
+}
+
+// cosignPayload is the simple signing payload cosign signs.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// ImageVerifier resolves image tags to digests and checks cosign style
+// signatures, stored in the registry as the `sha256-<digest>.sig` tag,
+// against the trusted public keys.
+type ImageVerifier struct {
+	dockerClient       *client.Client
+	credentials        *RegistryCredentialStore
+	keys               []verificationKey
+	insecureRegistries []string
+	httpClient         *http.Client
+}
+
+func NewImageVerifier(dockerClient *client.Client, credentials *RegistryCredentialStore, options ImageVerifierOptions) (*ImageVerifier, error) {
+	verifier := &ImageVerifier{
+		dockerClient:       dockerClient,
+		credentials:        credentials,
+		insecureRegistries: options.InsecureRegistries,
+		httpClient:         &http.Client{Timeout: 30 * time.Second},
+	}
+
+	for _, path := range options.PublicKeys {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM block found", path)
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		switch publicKey.(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("%s: only ECDSA and ed25519 keys are supported", path)
+		}
+
+		fingerprint := sha256.Sum256(block.Bytes)
+		verifier.keys = append(verifier.keys, verificationKey{
+			id:        hex.EncodeToString(fingerprint[:8]),
+			publicKey: publicKey,
+		})
+	}
+
+	if len(verifier.keys) == 0 {
+		return nil, errors.New("image verification needs at least one public key")
+	}
+
+	return verifier, nil
+}
+
+// Verify resolves imageRef to a digest and checks its signature. auth is the
+// registry auth given with the request, the stored registry credentials are
+// used when nil.
+func (v *ImageVerifier) Verify(ctx context.Context, imageRef string, auth *registry.AuthConfig) (ImageVerification, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return ImageVerification{}, err
+	}
+	named = reference.TagNameOnly(named)
+
+	var encodedAuth string
+	if auth != nil {
+		encodedAuth, err = registry.EncodeAuthConfig(*auth)
+	} else {
+		encodedAuth, err = v.credentials.EncodedAuth(imageRef)
+	}
+	if err != nil {
+		return ImageVerification{}, err
+	}
+	distribution, err := v.dockerClient.DistributionInspect(ctx, named.String(), encodedAuth)
+	if err != nil {
+		return ImageVerification{}, fmt.Errorf("resolving digest: %w", err)
+	}
+	digest := distribution.Descriptor.Digest
+
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), digest)
+	if err != nil {
+		return ImageVerification{}, err
+	}
+
+	remote := newRegistryClient(v.httpClient, v.credentials, named, v.insecureRegistries)
+	remote.auth = auth
+	signatureTag := strings.Replace(digest.String(), ":", "-", 1) + ".sig"
+
+	var manifest ocispec.Manifest
+	if err := remote.manifest(ctx, signatureTag, &manifest); err != nil {
+		if errdefs.IsNotFound(err) {
+			return ImageVerification{}, ErrImageNotSigned
+		}
+		return ImageVerification{}, fmt.Errorf("fetching signature: %w", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		encodedSignature, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+		if err != nil {
+			continue
+		}
+
+		payload, err := remote.blob(ctx, layer)
+		if err != nil {
+			return ImageVerification{}, fmt.Errorf("fetching signature payload: %w", err)
+		}
+
+		keyID, ok := v.verifySignature(payload, signature)
+		if !ok {
+			continue
+		}
+
+		// The signature must be about this very manifest.
+		var signed cosignPayload
+		if err := json.Unmarshal(payload, &signed); err != nil || signed.Critical.Image.DockerManifestDigest != digest.String() {
+			continue
+		}
+
+		return ImageVerification{
+			Reference:       named.String(),
+			Digest:          digest.String(),
+			PinnedReference: pinned.String(),
+			KeyID:           keyID,
+		}, nil
+	}
+
+	return ImageVerification{}, ErrImageSignatureInvalid
+}
+
+// Ensure verifies imageRef and makes sure the local tag points at the
+// verified digest, pulling it when missing.
+func (v *ImageVerifier) Ensure(ctx context.Context, imageRef string) (ImageVerification, error) {
+	verification, err := v.Verify(ctx, imageRef, nil)
+	if err != nil {
+		return verification, err
+	}
+
+	if _, _, err := v.dockerClient.ImageInspectWithRaw(ctx, verification.PinnedReference); err != nil {
+		if !errdefs.IsNotFound(err) {
+			return verification, err
+		}
+		if err := pullImage(ctx, v.dockerClient, v.credentials, verification.PinnedReference); err != nil {
+			return verification, err
+		}
+	}
+
+	return verification, v.dockerClient.ImageTag(ctx, verification.PinnedReference, verification.Reference)
+}
+
+// ensureImage makes sure imageRef is on the host before a container is created
+// from it, and returns the reference to create it from. With a verifier the
+// tag is pointed at the verified digest, even when the image is already there,
+// and the container is created from the digest so a later retag cannot swap
+// the image. Otherwise a missing image is pulled.
+func ensureImage(ctx context.Context, dockerClient *client.Client, credentials *RegistryCredentialStore, verifier *ImageVerifier, imageRef string) (string, error) {
+	if verifier != nil {
+		verification, err := verifier.Ensure(ctx, imageRef)
+		if err != nil {
+			return "", err
+		}
+		return verification.PinnedReference, nil
+	}
+
+	if _, _, err := dockerClient.ImageInspectWithRaw(ctx, imageRef); errdefs.IsNotFound(err) {
+		if err := pullImage(ctx, dockerClient, credentials, imageRef); err != nil {
+			return "", err
+		}
+	}
+
+	return imageRef, nil
+}
+
+// imageErrorResponse maps an error of verifying or pulling an image to the
+// response. Only a missing or mismatching signature fails the verification,
+// images the registry does not have or serve to us cannot be pulled, anything
+// else is an error on our side.
+func imageErrorResponse(err error) (int, map[string]any) {
+	switch {
+	case errors.Is(err, ErrImageNotSigned), errors.Is(err, ErrImageSignatureInvalid):
+		return http.StatusUnprocessableEntity, UnprocessableEntityResponseBody("image verification failed: " + err.Error())
+	case errdefs.IsNotFound(err), errdefs.IsUnauthorized(err), errdefs.IsForbidden(err), errdefs.IsInvalidParameter(err):
+		return http.StatusUnprocessableEntity, UnprocessableEntityResponseBody("image cannot be pulled: " + err.Error())
+	default:
+		return http.StatusInternalServerError, InternalServerErrorResponseBody()
+	}
+}
+
+// sameImage tells whether a container configured with image runs imageRef,
+// either by tag or pinned to a digest of the same repository.
+func sameImage(image, imageRef string) bool {
+	if image == imageRef {
+		return true
+	}
+
+	pinned, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+	if _, ok := pinned.(reference.Canonical); !ok {
+		return false
+	}
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return false
+	}
+
+	return pinned.Name() == named.Name()
+}
+
+func (v *ImageVerifier) verifySignature(payload, signature []byte) (string, bool) {
+	digest := sha256.Sum256(payload)
+
+	for _, key := range v.keys {
+		switch publicKey := key.publicKey.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+				return key.id, true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(publicKey, payload, signature) {
+				return key.id, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// registryClient reads manifests and blobs of one repository through the
+// registry HTTP API, authenticating with auth when set, the stored registry
+// credentials otherwise, or anonymously when credentials is nil too.
+type registryClient struct {
+	httpClient  *http.Client
+	credentials *RegistryCredentialStore
+	auth        *registry.AuthConfig
+	named       reference.Named
+	baseURL     string
+	token       string
+}
+
+func newRegistryClient(httpClient *http.Client, credentials *RegistryCredentialStore, named reference.Named, insecureRegistries []string) *registryClient {
+	host := reference.Domain(named)
+	if host == dockerHubRegistry {
+		host = "registry-1.docker.io"
+	}
+
+	scheme := "https"
+	if containsString(insecureRegistries, reference.Domain(named)) {
+		scheme = "http"
+	}
+
+	return &registryClient{
+		httpClient:  httpClient,
+		credentials: credentials,
+		named:       named,
+		baseURL:     scheme + "://" + host + "/v2/" + reference.Path(named),
+	}
+}
+
+func (r *registryClient) manifest(ctx context.Context, tag string, v any) error {
+	response, err := r.get(ctx, "/manifests/"+tag, ocispec.MediaTypeImageManifest+", application/vnd.docker.distribution.manifest.v2+json")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return json.NewDecoder(io.LimitReader(response.Body, maxSignaturePayloadSize)).Decode(v)
+}
+
+func (r *registryClient) blob(ctx context.Context, descriptor ocispec.Descriptor) ([]byte, error) {
+	response, err := r.get(ctx, "/blobs/"+descriptor.Digest.String(), "*/*")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(response.Body, maxSignaturePayloadSize))
+	if err != nil {
+		return nil, err
+	}
+	if err := descriptor.Digest.Validate(); err != nil || descriptor.Digest.Algorithm().FromBytes(raw) != descriptor.Digest {
+		return nil, errors.New("blob does not match its digest")
+	}
+
+	return raw, nil
+}
+
+// get performs the request, answering a bearer or basic challenge once.
+func (r *registryClient) get(ctx context.Context, path, accept string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, r.baseURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", accept)
+		if r.token != "" {
+			request.Header.Set("Authorization", r.token)
+		}
+
+		response, err := r.httpClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case response.StatusCode == http.StatusOK:
+			return response, nil
+		case response.StatusCode == http.StatusUnauthorized && attempt == 0:
+			challenge := response.Header.Get("WWW-Authenticate")
+			response.Body.Close()
+			if err := r.authenticate(ctx, challenge); err != nil {
+				return nil, err
+			}
+		case response.StatusCode == http.StatusNotFound:
+			response.Body.Close()
+			return nil, errdefs.NotFound(errors.New("not found in registry"))
+		default:
+			response.Body.Close()
+			return nil, fmt.Errorf("registry responded with status %d", response.StatusCode)
+		}
+	}
+}
+
+func (r *registryClient) authenticate(ctx context.Context, challenge string) error {
+	var (
+		auth    registry.AuthConfig
+		hasAuth bool
+	)
+	if r.auth != nil {
+		auth, hasAuth = *r.auth, true
+	} else if r.credentials != nil {
+		var err error
+		if auth, hasAuth, err = r.credentials.Resolve(r.named.String()); err != nil {
+			return err
+		}
+	}
+
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasAuth {
+			return errors.New("registry requires credentials")
+		}
+		r.token = "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported registry auth challenge %q", scheme)
+	}
+
+	values := map[string]string{}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		values[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+
+	tokenURL, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return errors.New("registry auth challenge has no realm")
+	}
+	query := tokenURL.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	query.Set("scope", "repository:"+reference.Path(r.named)+":pull")
+	tokenURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if hasAuth && auth.Username != "" {
+		request.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	response, err := r.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry token endpoint responded with status %d", response.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	r.token = "Bearer " + token.Token
+
+	return nil
+}
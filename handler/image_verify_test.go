@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testImageDigest = digest.Digest("sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945")
+
+// newTestSigningKey generates an ECDSA key and writes its public half where
+// NewImageVerifier reads it from.
+func newTestSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return key, path
+}
+
+// testSignatureRegistry serves the cosign signature of team/app, when one is
+// set, like a registry does.
+type testSignatureRegistry struct {
+	mu       sync.Mutex
+	manifest []byte
+	blobs    map[digest.Digest][]byte
+	password string // Basic auth password of user, none required when empty
+}
+
+func (r *testSignatureRegistry) sign(t *testing.T, key *ecdsa.PrivateKey, signedDigest digest.Digest) {
+	t.Helper()
+
+	payload, err := json.Marshal(map[string]any{
+		"critical": map[string]any{
+			"identity": map[string]any{"docker-reference": "team/app"},
+			"image":    map[string]any{"docker-manifest-digest": signedDigest.String()},
+			"type":     "cosign container image signature",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloadDigest := digest.FromBytes(payload)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Layers: []ocispec.Descriptor{{
+			MediaType:   "application/vnd.dev.cosign.simplesigning.v1+json",
+			Digest:      payloadDigest,
+			Size:        int64(len(payload)),
+			Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifest = manifest
+	r.blobs = map[digest.Digest][]byte{payloadDigest: payload}
+}
+
+func (r *testSignatureRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if username, password, _ := req.BasicAuth(); r.password != "" && (username != "user" || password != r.password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	signatureTag := strings.Replace(testImageDigest.String(), ":", "-", 1) + ".sig"
+	switch {
+	case req.URL.Path == "/v2/team/app/manifests/"+signatureTag && r.manifest != nil:
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		_, _ = w.Write(r.manifest)
+	case strings.HasPrefix(req.URL.Path, "/v2/team/app/blobs/"):
+		blob, ok := r.blobs[digest.Digest(strings.TrimPrefix(req.URL.Path, "/v2/team/app/blobs/"))]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write(blob)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// newTestImageVerifier returns a verifier trusting publicKeyPath, a docker
+// resolving every tag to testImageDigest and the reference of team/app in
+// the registry, along with the docker calls made besides resolving.
+func newTestImageVerifier(t *testing.T, signatures *testSignatureRegistry, publicKeyPath string) (*ImageVerifier, string, *[]string) {
+	t.Helper()
+
+	registryServer := httptest.NewServer(signatures)
+	t.Cleanup(registryServer.Close)
+	registryHost := registryServer.Listener.Addr().String()
+
+	calls := &[]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /distribution/", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(registry.DistributionInspect{
+			Descriptor: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: testImageDigest, Size: 1024},
+		})
+	})
+	mux.HandleFunc("GET /images/{ref...}", func(w http.ResponseWriter, r *http.Request) {
+		*calls = append(*calls, r.Method+" "+r.URL.Path)
+		_, _ = w.Write([]byte(`{"Id":"sha256:abc"}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		*calls = append(*calls, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	verifier, err := NewImageVerifier(newTestDockerClient(t, mux), NewRegistryCredentialStore(t.TempDir()), ImageVerifierOptions{
+		PublicKeys:         []string{publicKeyPath},
+		InsecureRegistries: []string{registryHost},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return verifier, registryHost + "/team/app:v1", calls
+}
+
+func TestImageVerifierVerify(t *testing.T) {
+	trustedKey, trustedKeyPath := newTestSigningKey(t)
+	otherKey, _ := newTestSigningKey(t)
+
+	tests := []struct {
+		name string
+		sign func(t *testing.T, signatures *testSignatureRegistry)
+		want error
+	}{
+		{
+			name: "signed with the trusted key",
+			sign: func(t *testing.T, signatures *testSignatureRegistry) { signatures.sign(t, trustedKey, testImageDigest) },
+		},
+		{
+			name: "unsigned",
+			sign: func(t *testing.T, signatures *testSignatureRegistry) {},
+			want: ErrImageNotSigned,
+		},
+		{
+			name: "signed with another key",
+			sign: func(t *testing.T, signatures *testSignatureRegistry) { signatures.sign(t, otherKey, testImageDigest) },
+			want: ErrImageSignatureInvalid,
+		},
+		{
+			name: "signature of another manifest",
+			sign: func(t *testing.T, signatures *testSignatureRegistry) {
+				signatures.sign(t, trustedKey, digest.FromString("another manifest"))
+			},
+			want: ErrImageSignatureInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signatures := &testSignatureRegistry{}
+			tt.sign(t, signatures)
+			verifier, imageRef, _ := newTestImageVerifier(t, signatures, trustedKeyPath)
+
+			verification, err := verifier.Verify(context.Background(), imageRef, nil)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+
+			if verification.Digest != testImageDigest.String() {
+				t.Errorf("digest = %q, want %q", verification.Digest, testImageDigest)
+			}
+			if !strings.HasSuffix(verification.PinnedReference, "/team/app@"+testImageDigest.String()) {
+				t.Errorf("pinned reference = %q", verification.PinnedReference)
+			}
+		})
+	}
+}
+
+func TestEnsureImageRejectsUnverifiedImages(t *testing.T) {
+	trustedKey, trustedKeyPath := newTestSigningKey(t)
+	otherKey, _ := newTestSigningKey(t)
+
+	for name, key := range map[string]*ecdsa.PrivateKey{"unsigned": nil, "wrong key": otherKey} {
+		t.Run(name, func(t *testing.T) {
+			signatures := &testSignatureRegistry{}
+			if key != nil {
+				signatures.sign(t, key, testImageDigest)
+			}
+			verifier, imageRef, calls := newTestImageVerifier(t, signatures, trustedKeyPath)
+
+			if _, err := ensureImage(context.Background(), verifier.dockerClient, verifier.credentials, verifier, imageRef); err == nil {
+				t.Fatal("ensureImage() accepted an unverified image")
+			}
+			if len(*calls) != 0 {
+				t.Errorf("docker calls = %v, want none", *calls)
+			}
+		})
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		signatures := &testSignatureRegistry{}
+		signatures.sign(t, trustedKey, testImageDigest)
+		verifier, imageRef, calls := newTestImageVerifier(t, signatures, trustedKeyPath)
+
+		pinnedRef, err := ensureImage(context.Background(), verifier.dockerClient, verifier.credentials, verifier, imageRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Containers are created from the digest, not the mutable tag.
+		if !strings.HasSuffix(pinnedRef, "/team/app@"+testImageDigest.String()) {
+			t.Errorf("ensureImage() = %q, want the pinned reference", pinnedRef)
+		}
+
+		// The local tag is pointed at the verified digest.
+		if len(*calls) != 2 || !strings.HasSuffix((*calls)[1], "/tag") {
+			t.Errorf("docker calls = %v, want an inspect then a tag", *calls)
+		}
+	})
+}
+
+func TestImageVerifierVerifyWithRequestAuth(t *testing.T) {
+	trustedKey, trustedKeyPath := newTestSigningKey(t)
+	signatures := &testSignatureRegistry{password: "secret"}
+	signatures.sign(t, trustedKey, testImageDigest)
+	verifier, imageRef, _ := newTestImageVerifier(t, signatures, trustedKeyPath)
+
+	// Nothing is stored for the registry, only the request has credentials.
+	if _, err := verifier.Verify(context.Background(), imageRef, nil); err == nil {
+		t.Error("Verify() without credentials succeeded")
+	}
+	if _, err := verifier.Verify(context.Background(), imageRef, &registry.AuthConfig{Username: "user", Password: "secret"}); err != nil {
+		t.Errorf("Verify() with the request auth = %v", err)
+	}
+}
+
+func TestImageErrorResponse(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: ErrImageNotSigned, want: http.StatusUnprocessableEntity},
+		{err: fmt.Errorf("image of service web: %w", ErrImageSignatureInvalid), want: http.StatusUnprocessableEntity},
+		{err: errdefs.NotFound(errors.New("manifest unknown")), want: http.StatusUnprocessableEntity},
+		{err: errdefs.Unauthorized(errors.New("authentication required")), want: http.StatusUnprocessableEntity},
+		{err: errors.New("connection refused"), want: http.StatusInternalServerError},
+		{err: context.DeadlineExceeded, want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		status, body := imageErrorResponse(tt.err)
+		if status != tt.want {
+			t.Errorf("imageErrorResponse(%v) status = %d, want %d", tt.err, status, tt.want)
+		}
+		message, _ := body["message"].(string)
+		verification := strings.Contains(message, "image verification failed")
+		if want := errors.Is(tt.err, ErrImageNotSigned) || errors.Is(tt.err, ErrImageSignatureInvalid); verification != want {
+			t.Errorf("imageErrorResponse(%v) message = %q", tt.err, message)
+		}
+	}
+}
+
+func TestSameImage(t *testing.T) {
+	tests := []struct {
+		image, imageRef string
+		want            bool
+	}{
+		{image: "nginx:1.27", imageRef: "nginx:1.27", want: true},
+		{image: "docker.io/library/nginx@" + testImageDigest.String(), imageRef: "nginx:1.27", want: true},
+		{image: "nginx:1.26", imageRef: "nginx:1.27", want: false},
+		{image: "team/nginx@" + testImageDigest.String(), imageRef: "nginx:1.27", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := sameImage(tt.image, tt.imageRef); got != tt.want {
+			t.Errorf("sameImage(%q, %q) = %t, want %t", tt.image, tt.imageRef, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+
+	maxJobProgress = 1000
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// JobFunc runs a job. Progress is reported through job.AddProgress and the
+// returned result is kept on the job once it succeeds.
+type JobFunc func(ctx context.Context, job *Job) (any, error)
+
+type Job struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Status     string            `json:"status"`
+	Progress   []json.RawMessage `json:"progress"`
+	Result     any               `json:"result,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+
+	// Number of progress entries dropped to keep at most maxJobProgress.
+	DroppedProgress int `json:"dropped_progress,omitempty"`
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	changed chan struct{}
+}
+
+// AddProgress records one progress entry, usually a docker json message.
+func (j *Job) AddProgress(entry json.RawMessage) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Progress = append(j.Progress, entry)
+	if len(j.Progress) > maxJobProgress {
+		j.DroppedProgress += len(j.Progress) - maxJobProgress
+		j.Progress = j.Progress[len(j.Progress)-maxJobProgress:]
+	}
+	j.notify()
+}
+
+// CopyProgress records every json message of a docker progress stream. An
+// error reported inside the stream is returned once the stream ends.
+func (j *Job) CopyProgress(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	var streamErr error
+	for {
+		var message json.RawMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return streamErr
+			}
+			return err
+		}
+		j.AddProgress(message)
+
+		var status struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(message, &status) == nil && status.Error != "" {
+			streamErr = errors.New(status.Error)
+		}
+	}
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed || j.Status == JobStatusCancelled
+}
+
+// notify wakes up every stream waiting on the job, callers hold j.mu.
+func (j *Job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// snapshot returns a copy safe to encode while the job keeps running.
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return &Job{
+		ID:              j.ID,
+		Kind:            j.Kind,
+		Status:          j.Status,
+		Progress:        append([]json.RawMessage{}, j.Progress...),
+		Result:          j.Result,
+		Error:           j.Error,
+		CreatedAt:       j.CreatedAt,
+		StartedAt:       j.StartedAt,
+		FinishedAt:      j.FinishedAt,
+		DroppedProgress: j.DroppedProgress,
+	}
+}
+
+// Jobs runs long operations detached from the request that started them and
+// keeps finished jobs around for the retention period.
+type Jobs struct {
+	ctx       context.Context
+	retention time.Duration
+
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+func NewJobs(ctx context.Context, retention time.Duration) *Jobs {
+	jobs := &Jobs{
+		ctx:       ctx,
+		retention: retention,
+		jobs:      map[string]*Job{},
+	}
+	go jobs.janitor()
+
+	return jobs
+}
+
+// Submit starts fn in the background and returns the job right away.
+func (js *Jobs) Submit(kind string, fn JobFunc) *Job {
+	ctx, cancel := context.WithCancel(js.ctx)
+
+	job := &Job{
+		ID:        newRandomID(),
+		Kind:      kind,
+		Status:    JobStatusQueued,
+		Progress:  []json.RawMessage{},
+		CreatedAt: time.Now().UTC(),
+		cancel:    cancel,
+		changed:   make(chan struct{}),
+	}
+
+	js.mu.Lock()
+	js.jobs[job.ID] = job
+	js.mu.Unlock()
+
+	go func() {
+		defer cancel()
+
+		job.mu.Lock()
+		startedAt := time.Now().UTC()
+		job.StartedAt = &startedAt
+		job.Status = JobStatusRunning
+		job.notify()
+		job.mu.Unlock()
+
+		result, err := fn(ctx, job)
+
+		job.mu.Lock()
+		defer job.mu.Unlock()
+
+		finishedAt := time.Now().UTC()
+		job.FinishedAt = &finishedAt
+		switch {
+		case ctx.Err() != nil:
+			job.Status = JobStatusCancelled
+			job.Error = "job was cancelled"
+		case err != nil:
+			job.Status = JobStatusFailed
+			job.Error = err.Error()
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("job").Str(job.Kind)).
+				Str("job_id", job.ID).
+				Msg("job failed")
+		default:
+			job.Status = JobStatusSucceeded
+			job.Result = result
+		}
+		job.notify()
+	}()
+
+	return job
+}
+
+func (js *Jobs) get(id string) (*Job, error) {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	job, ok := js.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+
+	return job, nil
+}
+
+// janitor drops finished jobs once they are older than the retention period.
+func (js *Jobs) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-js.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		js.expire()
+	}
+}
+
+func (js *Jobs) expire() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	for id, job := range js.jobs {
+		job.mu.Lock()
+		expired := job.FinishedAt != nil && time.Since(*job.FinishedAt) > js.retention
+		job.mu.Unlock()
+
+		if expired {
+			delete(js.jobs, id)
+		}
+	}
+}
+
+// Accepted answers a request whose work continues as the given job.
+func (js *Jobs) Accepted(c echo.Context, job *Job) error {
+	return c.JSON(http.StatusAccepted, map[string]any{
+		"message": "Job accepted",
+		"job_id":  job.ID,
+		"links": map[string]string{
+			"self":   "/v1/jobs/" + job.ID,
+			"stream": "/v1/jobs/" + job.ID + "/stream",
+		},
+	})
+}
+
+func (js *Jobs) List(c echo.Context) error {
+	kind := c.QueryParam("kind")
+	status := c.QueryParam("status")
+
+	js.mu.RLock()
+	data := []*Job{}
+	for _, job := range js.jobs {
+		snapshot := job.snapshot()
+		if (kind != "" && snapshot.Kind != kind) || (status != "" && snapshot.Status != status) {
+			continue
+		}
+		// Progress can be large, it is only returned when inspecting a job.
+		snapshot.Progress = nil
+		data = append(data, snapshot)
+	}
+	js.mu.RUnlock()
+
+	sort.Slice(data, func(i, j int) bool { return data[i].CreatedAt.After(data[j].CreatedAt) })
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+func (js *Jobs) Inspect(c echo.Context) error {
+	job, err := js.get(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody(err.Error()))
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": job.snapshot(),
+	})
+}
+
+func (js *Jobs) Cancel(c echo.Context) error {
+	job, err := js.get(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody(err.Error()))
+	}
+
+	job.mu.Lock()
+	finished := job.finished()
+	job.mu.Unlock()
+
+	if finished {
+		return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody("job is already finished"))
+	}
+
+	job.cancel()
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Job cancellation requested",
+		"job_id":  job.ID,
+	})
+}
+
+// Stream sends the job progress as server-sent events, `progress` for every
+// entry and a final `done` event carrying the job without its progress.
+func (js *Jobs) Stream(c echo.Context) error {
+	job, err := js.get(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody(err.Error()))
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	sent := 0
+	for {
+		job.mu.Lock()
+		// Entries dropped from the head shift the indexes of what is left.
+		offset := job.DroppedProgress
+		pending := []json.RawMessage{}
+		if sent-offset < len(job.Progress) {
+			from := sent - offset
+			if from < 0 {
+				from = 0
+			}
+			pending = append(pending, job.Progress[from:]...)
+		}
+		sent = offset + len(job.Progress)
+		finished := job.finished()
+		changed := job.changed
+		job.mu.Unlock()
+
+		for _, entry := range pending {
+			if _, err := fmt.Fprintf(c.Response(), "event: progress\ndata: %s\n\n", entry); err != nil {
+				return nil
+			}
+		}
+
+		if finished {
+			snapshot := job.snapshot()
+			snapshot.Progress = nil
+			raw, _ := json.Marshal(snapshot)
+			fmt.Fprintf(c.Response(), "event: done\ndata: %s\n\n", raw)
+			c.Response().Flush()
+			return nil
+		}
+		c.Response().Flush()
+
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-changed:
+		case <-time.After(eventKeepAliveInterval):
+			if _, err := fmt.Fprint(c.Response(), ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		}
+	}
+}
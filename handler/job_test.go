@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newTestJobs(t *testing.T, retention time.Duration) *Jobs {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return NewJobs(ctx, retention)
+}
+
+// waitJob waits until the job is finished.
+func waitJob(t *testing.T, job *Job) *Job {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		job.mu.Lock()
+		finished := job.finished()
+		changed := job.changed
+		job.mu.Unlock()
+		if finished {
+			return job.snapshot()
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatal("job did not finish")
+		}
+	}
+}
+
+func jobContext(method string, id string) (echo.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(method, "/", nil), recorder)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	return c, recorder
+}
+
+func TestJobAddProgressDropsOldest(t *testing.T) {
+	job := &Job{changed: make(chan struct{})}
+	for i := 0; i < maxJobProgress+25; i++ {
+		job.AddProgress(json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	if len(job.Progress) != maxJobProgress || job.DroppedProgress != 25 || string(job.Progress[0]) != `{"n":25}` {
+		t.Errorf("kept %d entries from %s, dropped %d", len(job.Progress), job.Progress[0], job.DroppedProgress)
+	}
+}
+
+func TestJobsStreamResumesAfterDroppedProgress(t *testing.T) {
+	jobs := newTestJobs(t, time.Hour)
+
+	total := 5 + maxJobProgress + 10
+	gate := make(chan struct{})
+	job := jobs.Submit("test", func(ctx context.Context, job *Job) (any, error) {
+		for i := 0; i < 5; i++ {
+			job.AddProgress(json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)))
+		}
+		<-gate
+		// Enough to push what was already streamed out of the job.
+		for i := 5; i < total; i++ {
+			job.AddProgress(json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)))
+		}
+		return "done", nil
+	})
+
+	e := echo.New()
+	e.GET("/jobs/:id/stream", jobs.Stream)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/jobs/" + job.ID + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	received := []int{}
+	done := false
+	event := ""
+	scanner := bufio.NewScanner(response.Body)
+	for !done && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "progress":
+			var entry struct{ N int }
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &entry); err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, entry.N)
+			if len(received) == 5 {
+				close(gate)
+			}
+		case strings.HasPrefix(line, "data: ") && event == "done":
+			var finished struct {
+				Status          string
+				Progress        []json.RawMessage
+				DroppedProgress int `json:"dropped_progress"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &finished); err != nil {
+				t.Fatal(err)
+			}
+			if finished.Status != JobStatusSucceeded || len(finished.Progress) != 0 || finished.DroppedProgress != total-maxJobProgress {
+				t.Errorf("done = %+v", finished)
+			}
+			done = true
+		}
+	}
+	if !done {
+		t.Fatalf("stream ended without done event after %d entries", len(received))
+	}
+
+	// Entries dropped before they were sent are skipped, none is sent twice.
+	for i, n := range received {
+		if i < 5 && n != i {
+			t.Fatalf("received %v, want the first 5 entries first", received[:5])
+		}
+		if i > 0 && n <= received[i-1] {
+			t.Fatalf("entry %d sent after %d", n, received[i-1])
+		}
+	}
+	if last := received[len(received)-1]; last != total-1 {
+		t.Errorf("last entry = %d, want %d", last, total-1)
+	}
+}
+
+func TestJobsCancelRunningJob(t *testing.T) {
+	jobs := newTestJobs(t, time.Hour)
+
+	started := make(chan struct{})
+	job := jobs.Submit("test", func(ctx context.Context, job *Job) (any, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+
+	c, recorder := jobContext(http.MethodPost, job.ID)
+	if err := jobs.Cancel(c); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+	}
+
+	finished := waitJob(t, job)
+	if finished.Status != JobStatusCancelled || finished.Error == "" || finished.FinishedAt == nil {
+		t.Errorf("job = %+v, want cancelled", finished)
+	}
+
+	// Finished jobs cannot be cancelled, unknown ones are not found.
+	c, recorder = jobContext(http.MethodPost, job.ID)
+	if err := jobs.Cancel(c); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("cancelling a finished job: status = %d", recorder.Code)
+	}
+
+	c, recorder = jobContext(http.MethodPost, "missing")
+	if err := jobs.Cancel(c); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("cancelling a missing job: status = %d", recorder.Code)
+	}
+}
+
+func TestJobsExpire(t *testing.T) {
+	jobs := newTestJobs(t, time.Minute)
+
+	expired := waitJob(t, jobs.Submit("test", func(ctx context.Context, job *Job) (any, error) { return nil, nil }))
+	recent := waitJob(t, jobs.Submit("test", func(ctx context.Context, job *Job) (any, error) { return nil, errors.New("failed") }))
+
+	release := make(chan struct{})
+	defer close(release)
+	running := jobs.Submit("test", func(ctx context.Context, job *Job) (any, error) {
+		<-release
+		return nil, nil
+	})
+
+	job, _ := jobs.get(expired.ID)
+	job.mu.Lock()
+	finishedAt := time.Now().Add(-2 * time.Minute)
+	job.FinishedAt = &finishedAt
+	job.mu.Unlock()
+
+	jobs.expire()
+
+	if _, err := jobs.get(expired.ID); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("job finished before the retention period: error = %v, want %v", err, ErrJobNotFound)
+	}
+	if _, err := jobs.get(recent.ID); err != nil {
+		t.Errorf("recently finished job: %v", err)
+	}
+	if _, err := jobs.get(running.ID); err != nil {
+		t.Errorf("running job: %v", err)
+	}
+}
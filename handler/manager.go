@@ -43,10 +43,9 @@ func (m *Manager) Claim(c echo.Context) error {
 		return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody("manager token already claimed"))
 	}
 
-	if err := m.editConfigFunction(entity.CconnectorConfig{
-		HostToken:    defaultConfig.HostToken,
-		ManagerToken: claimRequest.ManagerToken,
-	}); err != nil {
+	claimedConfig := *defaultConfig
+	claimedConfig.ManagerToken = claimRequest.ManagerToken
+	if err := m.editConfigFunction(claimedConfig); err != nil {
 		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
 	}
 
@@ -54,10 +53,7 @@ func (m *Manager) Claim(c echo.Context) error {
 	specs, err := getMachineSpecs()
 	if err != nil {
 		// rollback the config if error
-		_ = m.editConfigFunction(entity.CconnectorConfig{
-			HostToken:    defaultConfig.HostToken,
-			ManagerToken: "",
-		})
+		_ = m.editConfigFunction(*defaultConfig)
 
 		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
 	}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// PageMeta is returned as `meta` alongside paginated `data`.
+type PageMeta struct {
+	Count      int    `json:"count"`
+	Total      int    `json:"total"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// listCursor points at the last item of the previous page.
+type listCursor struct {
+	created int64
+	id      string
+}
+
+type pageRequest struct {
+	limit  int
+	after  *listCursor
+	fields []string
+}
+
+// parsePageRequest reads the `limit`, `cursor` and `fields` query params.
+func parsePageRequest(c echo.Context) (pageRequest, error) {
+	page := pageRequest{limit: defaultPageLimit}
+
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return page, errors.New("limit must be a number between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+		page.limit = limit
+	}
+
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		cursor, err := decodeListCursor(cursorStr)
+		if err != nil {
+			return page, err
+		}
+		page.after = &cursor
+	}
+
+	if fieldsStr := c.QueryParam("fields"); fieldsStr != "" {
+		for _, field := range strings.Split(fieldsStr, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				page.fields = append(page.fields, field)
+			}
+		}
+	}
+
+	return page, nil
+}
+
+func encodeListCursor(cursor listCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(cursor.created, 10) + ":" + cursor.id))
+}
+
+func decodeListCursor(cursorStr string) (listCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursorStr)
+	if err != nil {
+		return listCursor{}, ErrInvalidCursor
+	}
+
+	createdStr, id, found := strings.Cut(string(raw), ":")
+	if !found || id == "" {
+		return listCursor{}, ErrInvalidCursor
+	}
+
+	created, err := strconv.ParseInt(createdStr, 10, 64)
+	if err != nil {
+		return listCursor{}, ErrInvalidCursor
+	}
+
+	return listCursor{created: created, id: id}, nil
+}
+
+// projectFields keeps only the requested top-level json fields of every item.
+// Field names are matched case-insensitively, so `id` selects docker's `Id`.
+// Items are returned untouched when no field is requested.
+func projectFields[T any](items []T, fields []string) ([]any, error) {
+	projected := make([]any, 0, len(items))
+
+	for _, item := range items {
+		if len(fields) == 0 {
+			projected = append(projected, item)
+			continue
+		}
+
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+
+		full := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &full); err != nil {
+			return nil, err
+		}
+
+		partial := map[string]json.RawMessage{}
+		for key, value := range full {
+			for _, field := range fields {
+				if strings.EqualFold(key, field) {
+					partial[key] = value
+				}
+			}
+		}
+		projected = append(projected, partial)
+	}
+
+	return projected, nil
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestListCursorRoundTrip(t *testing.T) {
+	for _, cursor := range []listCursor{
+		{created: 1700000000, id: "abc123"},
+		{created: 0, id: "id:with:colons"},
+		{created: -1, id: "x"},
+	} {
+		decoded, err := decodeListCursor(encodeListCursor(cursor))
+		if err != nil {
+			t.Fatalf("decodeListCursor(%v) error = %v", cursor, err)
+		}
+		if decoded != cursor {
+			t.Errorf("round trip = %v, want %v", decoded, cursor)
+		}
+	}
+}
+
+func TestDecodeListCursorInvalid(t *testing.T) {
+	for _, cursor := range []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("123")),
+		base64.RawURLEncoding.EncodeToString([]byte("123:")),
+		base64.RawURLEncoding.EncodeToString([]byte("abc:id")),
+	} {
+		if _, err := decodeListCursor(cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decodeListCursor(%q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+func TestParsePageRequest(t *testing.T) {
+	cursor := encodeListCursor(listCursor{created: 42, id: "abc"})
+
+	tests := []struct {
+		query   string
+		want    pageRequest
+		wantErr bool
+	}{
+		{query: "", want: pageRequest{limit: defaultPageLimit}},
+		{query: "limit=10&fields=id,%20names,,", want: pageRequest{limit: 10, fields: []string{"id", "names"}}},
+		{query: "cursor=" + cursor, want: pageRequest{limit: defaultPageLimit, after: &listCursor{created: 42, id: "abc"}}},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=1001", wantErr: true},
+		{query: "limit=ten", wantErr: true},
+		{query: "cursor=bogus", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil), httptest.NewRecorder())
+
+		got, err := parsePageRequest(c)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePageRequest(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePageRequest(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestProjectFields(t *testing.T) {
+	type item struct {
+		ID    string `json:"Id"`
+		Names []string
+		State string
+	}
+	items := []item{{ID: "a", Names: []string{"/web"}, State: "running"}}
+
+	projected, err := projectFields(items, []string{"id", "state"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := projected[0].(map[string]json.RawMessage)
+	if len(partial) != 2 || string(partial["Id"]) != `"a"` || string(partial["State"]) != `"running"` {
+		t.Errorf("projectFields = %s", partial)
+	}
+
+	untouched, err := projectFields(items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(untouched[0], items[0]) {
+		t.Errorf("projectFields without fields = %v", untouched[0])
+	}
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PullProgressNDJSON = "ndjson"
+	PullProgressSSE    = "sse"
+)
+
+var ErrInvalidPullProgressFormat = errors.New("progress must be ndjson or sse")
+
+type PullProgressLayer struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"` // e.g. Waiting, Downloading, Extracting, Pull complete, Already exists
+	Current int64  `json:"current"`
+	Total   int64  `json:"total"`
+}
+
+// PullProgressEvent is emitted for every docker message of a pull, followed
+// by a `summary` event once the pull is over. Byte counts cover the layers
+// whose size is known so far, downloads only.
+type PullProgressEvent struct {
+	Type       string             `json:"type"` // progress or summary
+	Reference  string             `json:"reference"`
+	Status     string             `json:"status,omitempty"`
+	Layer      *PullProgressLayer `json:"layer,omitempty"`
+	Layers     int                `json:"layers"`
+	Current    int64              `json:"current"`
+	Total      int64              `json:"total"`
+	Percent    float64            `json:"percent"`
+	ETASeconds *float64           `json:"eta_seconds,omitempty"`
+	Digest     string             `json:"digest,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Duration   float64            `json:"duration_seconds,omitempty"` // Summary only
+}
+
+// pullProgress aggregates the per-layer docker messages of a pull.
+type pullProgress struct {
+	reference string
+	now       func() time.Time
+	startedAt time.Time
+	layers    map[string]*PullProgressLayer
+	status    string
+	digest    string
+}
+
+func newPullProgress(reference string) *pullProgress {
+	return &pullProgress{
+		reference: reference,
+		now:       time.Now,
+		startedAt: time.Now(),
+		layers:    map[string]*PullProgressLayer{},
+	}
+}
+
+func (p *pullProgress) update(message jsonmessage.JSONMessage) PullProgressEvent {
+	p.status = message.Status
+
+	if digest, found := strings.CutPrefix(message.Status, "Digest: "); found {
+		p.digest = strings.TrimSpace(digest)
+	}
+
+	var layer *PullProgressLayer
+	// Messages about the image itself carry the tag as id, e.g. `Pulling from`.
+	if message.ID != "" && (isLayerStatus(message.Status) || p.layers[message.ID] != nil) {
+		layer = p.layers[message.ID]
+		if layer == nil {
+			layer = &PullProgressLayer{ID: message.ID}
+			p.layers[message.ID] = layer
+		}
+		layer.Status = message.Status
+
+		switch {
+		case message.Status == "Downloading" && message.Progress != nil:
+			layer.Current = message.Progress.Current
+			layer.Total = message.Progress.Total
+		case message.Status == "Download complete" || message.Status == "Pull complete" || message.Status == "Already exists":
+			layer.Current = layer.Total
+		}
+	}
+
+	event := p.event("progress")
+	if layer != nil {
+		layerCopy := *layer
+		event.Layer = &layerCopy
+	}
+
+	return event
+}
+
+func (p *pullProgress) event(eventType string) PullProgressEvent {
+	event := PullProgressEvent{
+		Type:      eventType,
+		Reference: p.reference,
+		Status:    p.status,
+		Layers:    len(p.layers),
+		Digest:    p.digest,
+	}
+
+	for _, layer := range p.layers {
+		event.Current += layer.Current
+		event.Total += layer.Total
+	}
+
+	if event.Total > 0 {
+		event.Percent = math.Round(float64(event.Current)/float64(event.Total)*10000) / 100
+
+		elapsed := p.now().Sub(p.startedAt).Seconds()
+		if event.Current > 0 && elapsed > 0 {
+			eta := math.Round(float64(event.Total-event.Current) / (float64(event.Current) / elapsed))
+			event.ETASeconds = &eta
+		}
+	}
+
+	return event
+}
+
+func isLayerStatus(status string) bool {
+	switch status {
+	case "Pulling fs layer", "Waiting", "Downloading", "Verifying Checksum", "Download complete", "Extracting", "Pull complete", "Already exists":
+		return true
+	}
+
+	return false
+}
+
+// writePullProgress decodes a docker pull stream and writes aggregated
+// progress events as newline delimited json or server-sent events. The error
+// the pull failed with, also reported in the summary, is returned.
+func writePullProgress(c echo.Context, rc io.Reader, reference, format string) error {
+	progress := newPullProgress(reference)
+
+	contentType := "application/x-ndjson"
+	if format == PullProgressSSE {
+		contentType = "text/event-stream"
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+	}
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().WriteHeader(http.StatusOK)
+
+	write := func(event PullProgressEvent) error {
+		raw, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		if format == PullProgressSSE {
+			_, err = fmt.Fprintf(c.Response(), "event: %s\ndata: %s\n\n", event.Type, raw)
+		} else {
+			_, err = fmt.Fprintf(c.Response(), "%s\n", raw)
+		}
+		if err != nil {
+			return err
+		}
+
+		c.Response().Flush()
+		return nil
+	}
+
+	err := decodeJSONMessages(rc, func(raw json.RawMessage) error {
+		var message jsonmessage.JSONMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return err
+		}
+
+		return write(progress.update(message))
+	}, func(json.RawMessage) {})
+
+	summary := progress.event("summary")
+	summary.Duration = math.Round(progress.now().Sub(progress.startedAt).Seconds()*100) / 100
+	summary.ETASeconds = nil
+	if err != nil {
+		log.Err(err).
+			Str("reference", reference).
+			Msg("error reading pull response")
+		summary.Error = err.Error()
+	}
+
+	if err := write(summary); err != nil {
+		log.Err(err).Msg("error writing pull summary")
+	}
+
+	return err
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/labstack/echo/v4"
+)
+
+// testPullStream is a docker pull of two layers, recorded and trimmed.
+const testPullStream = `{"status":"Pulling from library/nginx","id":"1.27"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"a1"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"b2"}
+{"status":"Waiting","progressDetail":{},"id":"b2"}
+{"status":"Downloading","progressDetail":{"current":250,"total":1000},"id":"a1"}
+{"status":"Downloading","progressDetail":{"current":500,"total":1000},"id":"a1"}
+{"status":"Downloading","progressDetail":{"current":1000,"total":3000},"id":"b2"}
+{"status":"Download complete","progressDetail":{},"id":"a1"}
+{"status":"Extracting","progressDetail":{"current":100,"total":1000},"id":"a1"}
+{"status":"Pull complete","progressDetail":{},"id":"a1"}
+{"status":"Downloading","progressDetail":{"current":3000,"total":3000},"id":"b2"}
+{"status":"Pull complete","progressDetail":{},"id":"b2"}
+{"status":"Digest: sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"}
+{"status":"Status: Downloaded newer image for nginx:1.27"}
+`
+
+func TestPullProgressUpdate(t *testing.T) {
+	type want struct {
+		layers         int
+		current, total int64
+		percent        float64
+		eta            float64 // -1 when not known
+		layer          string  // Layer the event is about, empty for none
+	}
+
+	tests := []want{
+		{layers: 0, eta: -1},
+		{layers: 1, eta: -1, layer: "a1"},
+		{layers: 2, eta: -1, layer: "b2"},
+		{layers: 2, eta: -1, layer: "b2"},
+		// One second per message: 250 bytes in 5s, 750 left at 50 bytes/s.
+		{layers: 2, current: 250, total: 1000, percent: 25, eta: 15, layer: "a1"},
+		{layers: 2, current: 500, total: 1000, percent: 50, eta: 6, layer: "a1"},
+		// b2 is now known to be 3000 bytes.
+		{layers: 2, current: 1500, total: 4000, percent: 37.5, eta: 12, layer: "b2"},
+		{layers: 2, current: 2000, total: 4000, percent: 50, eta: 8, layer: "a1"},
+		// Extraction does not count as downloaded bytes.
+		{layers: 2, current: 2000, total: 4000, percent: 50, eta: 9, layer: "a1"},
+		{layers: 2, current: 2000, total: 4000, percent: 50, eta: 10, layer: "a1"},
+		{layers: 2, current: 4000, total: 4000, percent: 100, eta: 0, layer: "b2"},
+		{layers: 2, current: 4000, total: 4000, percent: 100, eta: 0, layer: "b2"},
+		{layers: 2, current: 4000, total: 4000, percent: 100, eta: 0},
+		{layers: 2, current: 4000, total: 4000, percent: 100, eta: 0},
+	}
+
+	startedAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	now := startedAt
+	progress := newPullProgress("nginx:1.27")
+	progress.startedAt = startedAt
+	progress.now = func() time.Time { return now }
+
+	lines := strings.Split(strings.TrimSpace(testPullStream), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("%d messages, %d expectations", len(lines), len(tests))
+	}
+
+	for i, line := range lines {
+		now = now.Add(time.Second)
+
+		var message jsonmessage.JSONMessage
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			t.Fatal(err)
+		}
+		event := progress.update(message)
+		tt := tests[i]
+
+		if event.Type != "progress" || event.Status != message.Status {
+			t.Errorf("message %d: event = %+v", i, event)
+		}
+		if event.Layers != tt.layers || event.Current != tt.current || event.Total != tt.total || event.Percent != tt.percent {
+			t.Errorf("message %d: layers %d, %d/%d bytes, %v%%, want %d, %d/%d bytes, %v%%",
+				i, event.Layers, event.Current, event.Total, event.Percent, tt.layers, tt.current, tt.total, tt.percent)
+		}
+
+		eta := -1.0
+		if event.ETASeconds != nil {
+			eta = *event.ETASeconds
+		}
+		if eta != tt.eta {
+			t.Errorf("message %d: eta = %v, want %v", i, eta, tt.eta)
+		}
+
+		layer := ""
+		if event.Layer != nil {
+			layer = event.Layer.ID
+		}
+		if layer != tt.layer {
+			t.Errorf("message %d: layer = %q, want %q", i, layer, tt.layer)
+		}
+	}
+
+	if progress.digest != "sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945" {
+		t.Errorf("digest = %q", progress.digest)
+	}
+}
+
+func TestWritePullProgress(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		stream    string
+		wantError string
+	}{
+		{name: "ndjson", format: PullProgressNDJSON, stream: testPullStream},
+		{name: "sse", format: PullProgressSSE, stream: testPullStream},
+		{
+			name:      "failed pull",
+			format:    PullProgressNDJSON,
+			stream:    `{"status":"Pulling from library/nginx","id":"1.27"}` + "\n" + `{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`,
+			wantError: "manifest unknown",
+		},
+		{
+			name:      "truncated stream",
+			format:    PullProgressSSE,
+			stream:    `{"status":"Pulling from library/nginx","id":"1.27"}` + "\n" + `{"status":"Downlo`,
+			wantError: "unexpected EOF",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/images/pull", nil), recorder)
+
+			err := writePullProgress(c, strings.NewReader(tt.stream), "nginx:1.27", tt.format)
+			if (err == nil) != (tt.wantError == "") || (err != nil && !strings.Contains(err.Error(), tt.wantError)) {
+				t.Fatalf("writePullProgress() error = %v, want %q", err, tt.wantError)
+			}
+
+			// The summary comes last, whether the pull failed or not.
+			var events []PullProgressEvent
+			scanner := bufio.NewScanner(recorder.Body)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if tt.format == PullProgressSSE {
+					var found bool
+					if line, found = strings.CutPrefix(line, "data: "); !found {
+						continue
+					}
+				}
+
+				var event PullProgressEvent
+				if err := json.Unmarshal([]byte(line), &event); err != nil {
+					t.Fatalf("line %q: %v", line, err)
+				}
+				events = append(events, event)
+			}
+
+			if len(events) == 0 {
+				t.Fatal("no event written")
+			}
+			summary := events[len(events)-1]
+			if summary.Type != "summary" || summary.ETASeconds != nil {
+				t.Errorf("last event = %+v, want the summary", summary)
+			}
+			if !strings.Contains(summary.Error, tt.wantError) || (tt.wantError == "") != (summary.Error == "") {
+				t.Errorf("summary error = %q, want %q", summary.Error, tt.wantError)
+			}
+			if tt.wantError == "" && (summary.Percent != 100 || summary.Digest == "") {
+				t.Errorf("summary = %+v, want the pull complete", summary)
+			}
+		})
+	}
+}
+
+func TestPullSkipsTaggingFailedPulls(t *testing.T) {
+	for _, progress := range []string{"", PullProgressNDJSON} {
+		for _, stream := range []string{testPullStream, `{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`} {
+			failed := strings.Contains(stream, "error")
+
+			var calls []string
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /images/create", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(stream))
+			})
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, r.Method+" "+r.URL.Path)
+				w.Write([]byte(`[]`))
+			})
+
+			// Pulled through the mirror, the image is tagged as nginx:1.27 once pulled.
+			images := NewImage(newTestDockerClient(t, mux), nil, NewRegistryCredentialStore(t.TempDir()), nil, "127.0.0.1:5000")
+			request := httptest.NewRequest(http.MethodPost, "/images/pull?progress="+progress, strings.NewReader(`{"reference":"nginx:1.27"}`))
+			recorder := httptest.NewRecorder()
+			if err := images.Pull(echo.New().NewContext(request, recorder)); err != nil {
+				t.Fatal(err)
+			}
+
+			if tagged := len(calls) > 0; tagged == failed {
+				t.Errorf("progress %q, failed %t: calls = %v", progress, failed, calls)
+			}
+			if !strings.Contains(recorder.Body.String(), "manifest unknown") && failed {
+				t.Errorf("progress %q: body = %s, want the error", progress, recorder.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const ManagedContainerLabel = "cconnector.managed"
+
+// Desired run states of managed containers.
+const (
+	ManagedStateRunning = "running"
+	ManagedStateStopped = "stopped"
+)
+
+// ManagedContainerSpec is the desired state of a container created with the
+// `managed` flag.
+type ManagedContainerSpec struct {
+	Name        string                   `json:"name"`
+	ContainerID string                   `json:"container_id"`
+	Request     ContainerCreationRequest `json:"request"`
+	ImageDigest string                   `json:"image_digest"` // Image id the container was created from
+	CreatedAt   time.Time                `json:"created_at"`
+
+	// DesiredState is running or stopped, following the start and stop
+	// requests. Specs saved before it existed are empty and kept running.
+	DesiredState string `json:"desired_state"`
+}
+
+func (spec ManagedContainerSpec) shouldRun() bool {
+	return spec.DesiredState != ManagedStateStopped
+}
+
+// ManagedContainerStatus is the outcome of the last reconciliation of a
+// managed container.
+type ManagedContainerStatus struct {
+	Name          string    `json:"name"`
+	ContainerID   string    `json:"container_id,omitempty"`
+	State         string    `json:"state"`
+	Action        string    `json:"action"` // none, recreated, started or failed
+	Drift         []string  `json:"drift"`
+	Error         string    `json:"error,omitempty"`
+	LastReconcile time.Time `json:"last_reconcile"`
+}
+
+// ManagedContainerStore persists managed container specs as a json file.
+type ManagedContainerStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewManagedContainerStore(dataDir string) *ManagedContainerStore {
+	return &ManagedContainerStore{path: filepath.Join(dataDir, "managed_containers.json")}
+}
+
+func (s *ManagedContainerStore) All() ([]ManagedContainerSpec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	specs, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]ManagedContainerSpec, 0, len(specs))
+	for _, name := range sortedKeys(specs) {
+		all = append(all, specs[name])
+	}
+
+	return all, nil
+}
+
+func (s *ManagedContainerStore) Save(spec ManagedContainerSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	specs, err := s.load()
+	if err != nil {
+		return err
+	}
+	specs[spec.Name] = spec
+
+	return writeJSONFile(s.path, specs)
+}
+
+// Forget drops the spec matching the given container name or id, if any.
+func (s *ManagedContainerStore) Forget(ref string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	specs, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for name, spec := range specs {
+		if spec.matches(ref) {
+			delete(specs, name)
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	return writeJSONFile(s.path, specs)
+}
+
+// SetContainer records the container a spec was recreated as. A spec
+// forgotten meanwhile stays forgotten.
+func (s *ManagedContainerStore) SetContainer(name, containerID, imageDigest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	specs, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	spec, ok := specs[name]
+	if !ok {
+		return nil
+	}
+	spec.ContainerID = containerID
+	spec.ImageDigest = imageDigest
+	specs[name] = spec
+
+	return writeJSONFile(s.path, specs)
+}
+
+// SetDesiredState records the run state of the spec matching the given
+// container name or id, if any.
+func (s *ManagedContainerStore) SetDesiredState(ref, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	specs, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for name, spec := range specs {
+		if spec.matches(ref) && spec.DesiredState != state {
+			spec.DesiredState = state
+			specs[name] = spec
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	return writeJSONFile(s.path, specs)
+}
+
+// matches reports whether ref is the container name, its id or an id prefix
+// of at least 12 characters.
+func (spec ManagedContainerSpec) matches(ref string) bool {
+	ref = strings.TrimPrefix(ref, "/")
+
+	return spec.Name == ref || spec.ContainerID == ref || (len(ref) >= 12 && strings.HasPrefix(spec.ContainerID, ref))
+}
+
+func (s *ManagedContainerStore) load() (map[string]ManagedContainerSpec, error) {
+	specs := map[string]ManagedContainerSpec{}
+	if err := readJSONFile(s.path, &specs); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
+
+// Reconciler periodically converges managed containers to their persisted spec.
+type Reconciler struct {
+	dockerClient *client.Client
+	store        *ManagedContainerStore
+	containers   *Container // Recreates containers as the create endpoint does
+	interval     time.Duration
+
+	mu       sync.RWMutex
+	statuses map[string]ManagedContainerStatus
+}
+
+func NewReconciler(dockerClient *client.Client, store *ManagedContainerStore, containers *Container, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		dockerClient: dockerClient,
+		store:        store,
+		containers:   containers,
+		interval:     interval,
+		statuses:     map[string]ManagedContainerStatus{},
+	}
+}
+
+// Run reconciles on every interval until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.ReconcileOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) ReconcileOnce(ctx context.Context) {
+	specs, err := r.store.All()
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("reconciler").Str("store_load")).
+			Msg("error loading managed container specs")
+		return
+	}
+
+	statuses := map[string]ManagedContainerStatus{}
+	for _, spec := range specs {
+		status := r.reconcile(ctx, spec)
+		if status.Error != "" {
+			log.Error().
+				Array("tags", zerolog.Arr().Str("reconciler").Str("reconcile")).
+				Str("container_name", spec.Name).
+				Str("error", status.Error).
+				Msg("error reconciling managed container")
+		} else if status.Action != "none" || len(status.Drift) > 0 {
+			log.Info().
+				Array("tags", zerolog.Arr().Str("reconciler").Str("reconcile")).
+				Str("container_name", spec.Name).
+				Str("action", status.Action).
+				Strs("drift", status.Drift).
+				Msg("managed container reconciled")
+		}
+		statuses[spec.Name] = status
+	}
+
+	r.mu.Lock()
+	r.statuses = statuses
+	r.mu.Unlock()
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, spec ManagedContainerSpec) ManagedContainerStatus {
+	status := ManagedContainerStatus{
+		Name:          spec.Name,
+		Action:        "none",
+		Drift:         []string{},
+		LastReconcile: time.Now(),
+	}
+
+	containers, err := r.dockerClient.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("name", "^/"+regexp.QuoteMeta(spec.Name)+"$")),
+	})
+	if err != nil {
+		status.Action = "failed"
+		status.Error = err.Error()
+		return status
+	}
+
+	if len(containers) == 0 {
+		createResp, err := r.containers.create(ctx, spec.Request)
+		if err != nil {
+			status.Action = "failed"
+			status.Error = fmt.Sprintf("recreating container: %s", err.Error())
+			return status
+		}
+
+		status.State = "created"
+		if spec.shouldRun() {
+			if err := r.dockerClient.ContainerStart(ctx, createResp.ID, container.StartOptions{}); err != nil {
+				status.Action = "failed"
+				status.Error = fmt.Sprintf("starting recreated container: %s", err.Error())
+				return status
+			}
+			status.State = "running"
+		}
+
+		imageDigest := spec.ImageDigest
+		if containerJson, err := r.dockerClient.ContainerInspect(ctx, createResp.ID); err == nil {
+			imageDigest = containerJson.Image
+		}
+		if err := r.store.SetContainer(spec.Name, createResp.ID, imageDigest); err != nil {
+			status.Error = fmt.Sprintf("persisting recreated container: %s", err.Error())
+		}
+
+		status.ContainerID = createResp.ID
+		status.Action = "recreated"
+		return status
+	}
+
+	containerJson, err := r.dockerClient.ContainerInspect(ctx, containers[0].ID)
+	if err != nil {
+		status.Action = "failed"
+		status.Error = err.Error()
+		return status
+	}
+	status.ContainerID = containerJson.ID
+	status.State = containerJson.State.Status
+
+	if spec.shouldRun() && !containerJson.State.Running && !containerJson.State.Restarting {
+		if err := r.dockerClient.ContainerStart(ctx, containerJson.ID, container.StartOptions{}); err != nil {
+			status.Action = "failed"
+			status.Error = fmt.Sprintf("starting container: %s", err.Error())
+			return status
+		}
+		status.State = "running"
+		status.Action = "started"
+	}
+
+	status.Drift = r.drift(ctx, spec, containerJson.Config, containerJson.Image)
+
+	return status
+}
+
+// drift lists the differences between the spec and the running container.
+func (r *Reconciler) drift(ctx context.Context, spec ManagedContainerSpec, config *container.Config, imageID string) []string {
+	drift := []string{}
+	if config == nil {
+		return drift
+	}
+
+	imageRef := fmt.Sprintf("%s:%s", spec.Request.ImageSource, spec.Request.ImageTag)
+	if !sameImage(config.Image, imageRef) {
+		drift = append(drift, fmt.Sprintf("image: expected `%s`, got `%s`", imageRef, config.Image))
+	}
+
+	if spec.ImageDigest != "" && imageID != spec.ImageDigest {
+		drift = append(drift, fmt.Sprintf("image_digest: expected `%s`, got `%s`", spec.ImageDigest, imageID))
+	}
+
+	if current, _, err := r.dockerClient.ImageInspectWithRaw(ctx, imageRef); err == nil && current.ID != imageID {
+		drift = append(drift, fmt.Sprintf("image_outdated: `%s` now points to `%s`", imageRef, current.ID))
+	} else if err != nil && !errdefs.IsNotFound(err) {
+		drift = append(drift, fmt.Sprintf("image_outdated: unable to inspect `%s`", imageRef))
+	}
+
+	currentEnv := map[string]bool{}
+	for _, env := range config.Env {
+		currentEnv[env] = true
+	}
+	for _, env := range spec.Request.Environments {
+		expected := fmt.Sprintf(`%s="%s"`, env.Key, env.Value)
+		if !currentEnv[expected] {
+			drift = append(drift, fmt.Sprintf("env: `%s` differs", env.Key))
+		}
+	}
+
+	for key, value := range spec.Request.Labels {
+		if config.Labels[key] != value {
+			drift = append(drift, fmt.Sprintf("label: `%s` differs", key))
+		}
+	}
+
+	return drift
+}
+
+func (r *Reconciler) List(c echo.Context) error {
+	specs, err := r.store.All()
+	if err != nil {
+		log.Err(err).Msg("error loading managed container specs")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	data := []ManagedContainerStatus{}
+	for _, spec := range specs {
+		status, ok := r.statuses[spec.Name]
+		if !ok {
+			status = ManagedContainerStatus{Name: spec.Name, ContainerID: spec.ContainerID, State: "pending", Action: "none", Drift: []string{}}
+		}
+		data = append(data, status)
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Name < data[j].Name })
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+func (r *Reconciler) Inspect(c echo.Context) error {
+	name := c.Param("name")
+
+	if name == "" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("container name cannot be empty"))
+	}
+
+	specs, err := r.store.All()
+	if err != nil {
+		log.Err(err).Msg("error loading managed container specs")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	for _, spec := range specs {
+		if spec.Name != name {
+			continue
+		}
+
+		r.mu.RLock()
+		status, ok := r.statuses[name]
+		r.mu.RUnlock()
+		if !ok {
+			status = ManagedContainerStatus{Name: spec.Name, ContainerID: spec.ContainerID, State: "pending", Action: "none", Drift: []string{}}
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"data": map[string]any{
+				"spec":   spec,
+				"status": status,
+			},
+		})
+	}
+
+	return c.JSON(http.StatusNotFound, NotFoundResponseBody("managed container does not exist"))
+}
+
+// Unmanage stops reconciling the container without touching it.
+func (r *Reconciler) Unmanage(c echo.Context) error {
+	name := c.Param("name")
+
+	if name == "" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("container name cannot be empty"))
+	}
+
+	if err := r.store.Forget(name); err != nil {
+		log.Err(err).
+			Str("container_name", name).
+			Msg("error forgetting managed container spec")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	r.mu.Lock()
+	delete(r.statuses, name)
+	r.mu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Container is no longer managed",
+		"name":    name,
+	})
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestManagedContainerStoreSetDesiredState(t *testing.T) {
+	store := NewManagedContainerStore(t.TempDir())
+	if err := store.Save(ManagedContainerSpec{Name: "web", ContainerID: "0123456789abcdef0123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		ref   string
+		state string
+		want  string
+	}{
+		{ref: "web", state: ManagedStateStopped, want: ManagedStateStopped},
+		{ref: "/web", state: ManagedStateRunning, want: ManagedStateRunning},
+		{ref: "0123456789ab", state: ManagedStateStopped, want: ManagedStateStopped},
+		// Too short to be an id prefix.
+		{ref: "0123", state: ManagedStateRunning, want: ManagedStateStopped},
+		{ref: "other", state: ManagedStateRunning, want: ManagedStateStopped},
+	} {
+		if err := store.SetDesiredState(tt.ref, tt.state); err != nil {
+			t.Fatal(err)
+		}
+		specs, err := store.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if specs[0].DesiredState != tt.want {
+			t.Errorf("SetDesiredState(%q, %q): state = %q, want %q", tt.ref, tt.state, specs[0].DesiredState, tt.want)
+		}
+	}
+}
+
+// fakeReconcilerDocker serves a single stopped `web` container, or none when
+// exists is false, and records the mutating calls.
+func fakeReconcilerDocker(t *testing.T, exists bool) (*Reconciler, *ManagedContainerStore, func() []string) {
+	t.Helper()
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		if filters := r.URL.Query().Get("filters"); !strings.Contains(filters, `"^/web$"`) && !strings.Contains(filters, `"^/web\\.1$"`) {
+			t.Errorf("filters = %s, want the escaped name", filters)
+		}
+		if !exists {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"Id":"web-id","Names":["/web"],"State":"exited"}]`))
+	})
+	mux.HandleFunc("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:    r.PathValue("id"),
+				Image: "sha256:image",
+				State: &types.ContainerState{Status: "exited"},
+			},
+		})
+	})
+	mux.HandleFunc("GET /images/{ref...}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id":"sha256:image"}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		if r.URL.Path == "/containers/create" {
+			w.Write([]byte(`{"Id":"new-id"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cli := newTestDockerClient(t, mux)
+	store := NewManagedContainerStore(t.TempDir())
+	reconciler := NewReconciler(cli, store, NewContainer(cli, store, nil, nil), 0)
+
+	return reconciler, store, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, calls...)
+	}
+}
+
+func TestReconcileFollowsDesiredState(t *testing.T) {
+	tests := []struct {
+		name       string
+		exists     bool
+		state      string
+		wantAction string
+		wantCalls  string
+	}{
+		{name: "stopped on purpose", exists: true, state: ManagedStateStopped, wantAction: "none", wantCalls: ""},
+		{name: "should run", exists: true, state: ManagedStateRunning, wantAction: "started", wantCalls: "POST /containers/web-id/start"},
+		{name: "legacy spec", exists: true, state: "", wantAction: "started", wantCalls: "POST /containers/web-id/start"},
+		{name: "recreated stopped", exists: false, state: ManagedStateStopped, wantAction: "recreated", wantCalls: "POST /containers/create"},
+		{name: "recreated running", exists: false, state: ManagedStateRunning, wantAction: "recreated", wantCalls: "POST /containers/create,POST /containers/new-id/start"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reconciler, store, calls := fakeReconcilerDocker(t, tt.exists)
+
+			spec := ManagedContainerSpec{
+				Name:         "web",
+				ContainerID:  "web-id",
+				Request:      ContainerCreationRequest{Name: "web", ImageSource: "nginx", ImageTag: "latest"},
+				DesiredState: tt.state,
+			}
+			if err := store.Save(spec); err != nil {
+				t.Fatal(err)
+			}
+
+			status := reconciler.reconcile(context.Background(), spec)
+			if status.Error != "" {
+				t.Fatalf("reconcile error = %s", status.Error)
+			}
+			if status.Action != tt.wantAction {
+				t.Errorf("action = %q, want %q", status.Action, tt.wantAction)
+			}
+			if got := strings.Join(calls(), ","); got != tt.wantCalls {
+				t.Errorf("calls = %q, want %q", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestReconcileDoesNotResurrectForgottenSpecs(t *testing.T) {
+	reconciler, store, _ := fakeReconcilerDocker(t, false)
+
+	spec := ManagedContainerSpec{
+		Name:    "web",
+		Request: ContainerCreationRequest{Name: "web", ImageSource: "nginx", ImageTag: "latest"},
+	}
+	if err := store.Save(spec); err != nil {
+		t.Fatal(err)
+	}
+	// Forgotten after the pass listed it.
+	if err := store.Forget("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := reconciler.reconcile(context.Background(), spec); status.Action != "recreated" {
+		t.Fatalf("action = %q, error %s", status.Action, status.Error)
+	}
+	specs, err := store.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 0 {
+		t.Errorf("specs = %+v, want the forgotten spec to stay forgotten", specs)
+	}
+}
+
+func TestReconcileEscapesTheNameFilter(t *testing.T) {
+	reconciler, _, _ := fakeReconcilerDocker(t, true)
+
+	spec := ManagedContainerSpec{
+		Name:         "web.1",
+		Request:      ContainerCreationRequest{Name: "web.1", ImageSource: "nginx", ImageTag: "latest"},
+		DesiredState: ManagedStateStopped,
+	}
+	if status := reconciler.reconcile(context.Background(), spec); status.Error != "" {
+		t.Fatalf("reconcile error = %s", status.Error)
+	}
+}
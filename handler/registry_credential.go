@@ -0,0 +1,339 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const dockerHubRegistry = "docker.io"
+
+var (
+	ErrRegistryCredentialNotFound = errors.New("registry credential not found")
+	ErrInvalidRegistryKey         = errors.New("registry credential key must be 32 bytes")
+)
+
+// RegistryCredential is what the API returns for stored credentials, secrets
+// are only reported as set or not.
+type RegistryCredential struct {
+	Registry         string    `json:"registry"`
+	Username         string    `json:"username,omitempty"`
+	PasswordSet      bool      `json:"password_set"`
+	IdentityTokenSet bool      `json:"identity_token_set"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+type registryCredentialRecord struct {
+	RegistryCredential
+	Sealed []byte `json:"sealed"` // AES-GCM nonce followed by the encrypted auth config
+}
+
+// RegistryCredentialStore keeps registry credentials on disk, encrypted with a
+// key generated on first use and stored next to them with 0600 permissions.
+type RegistryCredentialStore struct {
+	path    string
+	keyPath string
+
+	mu sync.Mutex
+}
+
+func NewRegistryCredentialStore(dataDir string) *RegistryCredentialStore {
+	return &RegistryCredentialStore{
+		path:    filepath.Join(dataDir, "registry_credentials.json"),
+		keyPath: filepath.Join(dataDir, "registry_credentials.key"),
+	}
+}
+
+// registryHostname normalizes a server address, e.g.
+// `https://index.docker.io/v1/` becomes `docker.io`.
+func registryHostname(serverAddress string) string {
+	address := strings.TrimSpace(serverAddress)
+	if strings.Contains(address, "://") {
+		if parsed, err := url.Parse(address); err == nil {
+			address = parsed.Host
+		}
+	}
+	address, _, _ = strings.Cut(address, "/")
+	address = strings.ToLower(address)
+
+	switch address {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHubRegistry
+	}
+
+	return address
+}
+
+func (s *RegistryCredentialStore) records() (map[string]registryCredentialRecord, error) {
+	records := map[string]registryCredentialRecord{}
+	return records, readJSONFile(s.path, &records)
+}
+
+func (s *RegistryCredentialStore) cipher() (cipher.AEAD, error) {
+	key, err := os.ReadFile(s.keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(s.keyPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(s.keyPath, key, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, ErrInvalidRegistryKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Save stores the credentials for the registry of auth.ServerAddress,
+// replacing any previous ones.
+func (s *RegistryCredentialStore) Save(auth registry.AuthConfig) (RegistryCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hostname := registryHostname(auth.ServerAddress)
+
+	records, err := s.records()
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+
+	aead, err := s.cipher()
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+
+	plaintext, err := json.Marshal(auth)
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return RegistryCredential{}, err
+	}
+
+	now := time.Now().UTC()
+	record := registryCredentialRecord{
+		RegistryCredential: RegistryCredential{
+			Registry:         hostname,
+			Username:         auth.Username,
+			PasswordSet:      auth.Password != "",
+			IdentityTokenSet: auth.IdentityToken != "",
+			CreatedAt:        now,
+			UpdatedAt:        now,
+		},
+		Sealed: aead.Seal(nonce, nonce, plaintext, []byte(hostname)),
+	}
+	if existing, ok := records[hostname]; ok {
+		record.CreatedAt = existing.CreatedAt
+	}
+	records[hostname] = record
+
+	return record.RegistryCredential, writeJSONFile(s.path, records)
+}
+
+func (s *RegistryCredentialStore) All() ([]RegistryCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.records()
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := []RegistryCredential{}
+	for _, record := range records {
+		credentials = append(credentials, record.RegistryCredential)
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].Registry < credentials[j].Registry })
+
+	return credentials, nil
+}
+
+func (s *RegistryCredentialStore) Get(hostname string) (RegistryCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.records()
+	if err != nil {
+		return RegistryCredential{}, err
+	}
+
+	record, ok := records[registryHostname(hostname)]
+	if !ok {
+		return RegistryCredential{}, ErrRegistryCredentialNotFound
+	}
+
+	return record.RegistryCredential, nil
+}
+
+func (s *RegistryCredentialStore) Delete(hostname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.records()
+	if err != nil {
+		return err
+	}
+
+	hostname = registryHostname(hostname)
+	if _, ok := records[hostname]; !ok {
+		return ErrRegistryCredentialNotFound
+	}
+	delete(records, hostname)
+
+	return writeJSONFile(s.path, records)
+}
+
+// Resolve returns the credentials stored for the registry hosting the image
+// reference. ok is false when none are stored.
+func (s *RegistryCredentialStore) Resolve(imageRef string) (auth registry.AuthConfig, ok bool, err error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return auth, false, err
+	}
+	hostname := registryHostname(reference.Domain(named))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.records()
+	if err != nil {
+		return auth, false, err
+	}
+
+	record, found := records[hostname]
+	if !found {
+		return auth, false, nil
+	}
+
+	aead, err := s.cipher()
+	if err != nil {
+		return auth, false, err
+	}
+	if len(record.Sealed) < aead.NonceSize() {
+		return auth, false, errors.New("registry credential is corrupted")
+	}
+	nonce, sealed := record.Sealed[:aead.NonceSize()], record.Sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(hostname))
+	if err != nil {
+		return auth, false, err
+	}
+
+	return auth, true, json.Unmarshal(plaintext, &auth)
+}
+
+// EncodedAuth returns the X-Registry-Auth value for the image reference, an
+// empty string when no credentials are stored for its registry.
+func (s *RegistryCredentialStore) EncodedAuth(imageRef string) (string, error) {
+	auth, ok, err := s.Resolve(imageRef)
+	if err != nil || !ok {
+		return "", err
+	}
+
+	return registry.EncodeAuthConfig(auth)
+}
+
+func (s *RegistryCredentialStore) List(c echo.Context) error {
+	credentials, err := s.All()
+	if err != nil {
+		log.Err(err).Msg("error reading registry credentials")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": credentials,
+	})
+}
+
+// Create stores credentials for the registry given as `serveraddress`, using
+// the same shape as the `auth` field of pull requests.
+func (s *RegistryCredentialStore) Create(c echo.Context) error {
+	var auth registry.AuthConfig
+	if err := json.NewDecoder(c.Request().Body).Decode(&auth); err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("body contains invalid json format"))
+	}
+
+	if registryHostname(auth.ServerAddress) == "" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("serveraddress cannot be empty"))
+	}
+	if auth.Password == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("password, identitytoken or registrytoken must be set"))
+	}
+
+	credential, err := s.Save(auth)
+	if err != nil {
+		log.Err(err).
+			Str("registry", registryHostname(auth.ServerAddress)).
+			Msg("error saving registry credential")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Registry credential saved successfully",
+		"data":    credential,
+	})
+}
+
+func (s *RegistryCredentialStore) Inspect(c echo.Context) error {
+	credential, err := s.Get(c.Param("registry"))
+	if err != nil {
+		if errors.Is(err, ErrRegistryCredentialNotFound) {
+			return c.JSON(http.StatusNotFound, NotFoundResponseBody(err.Error()))
+		}
+		log.Err(err).Msg("error reading registry credentials")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": credential,
+	})
+}
+
+func (s *RegistryCredentialStore) Remove(c echo.Context) error {
+	hostname := c.Param("registry")
+
+	if err := s.Delete(hostname); err != nil {
+		if errors.Is(err, ErrRegistryCredentialNotFound) {
+			return c.JSON(http.StatusNotFound, NotFoundResponseBody(err.Error()))
+		}
+		log.Err(err).
+			Str("registry", hostname).
+			Msg("error removing registry credential")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":  "Registry credential removed successfully",
+		"registry": registryHostname(hostname),
+	})
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+func TestRegistryHostname(t *testing.T) {
+	tests := map[string]string{
+		"https://index.docker.io/v1/":  "docker.io",
+		"registry-1.docker.io":         "docker.io",
+		"Registry.Example.com:5000":    "registry.example.com:5000",
+		"http://localhost:5000/v2/":    "localhost:5000",
+		"ghcr.io/owner/repo":           "ghcr.io",
+		" quay.io ":                    "quay.io",
+		"registry.hub.docker.com/team": "docker.io",
+	}
+
+	for address, want := range tests {
+		if got := registryHostname(address); got != want {
+			t.Errorf("registryHostname(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
+
+func TestRegistryCredentialStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := NewRegistryCredentialStore(dir)
+
+	saved, err := store.Save(registry.AuthConfig{Username: "bot", Password: "s3cret-password", ServerAddress: "https://index.docker.io/v1/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Registry != "docker.io" || !saved.PasswordSet || saved.IdentityTokenSet {
+		t.Errorf("saved = %+v", saved)
+	}
+	if _, err := store.Save(registry.AuthConfig{IdentityToken: "token", ServerAddress: "ghcr.io"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Secrets never reach the disk in clear.
+	raw, err := os.ReadFile(filepath.Join(dir, "registry_credentials.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("s3cret-password")) || bytes.Contains(raw, []byte(base64.StdEncoding.EncodeToString([]byte("s3cret-password")))) {
+		t.Errorf("password stored in clear: %s", raw)
+	}
+	info, err := os.Stat(filepath.Join(dir, "registry_credentials.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// A fresh store reads them back with the persisted key.
+	auth, ok, err := NewRegistryCredentialStore(dir).Resolve("nginx:latest")
+	if err != nil || !ok {
+		t.Fatalf("Resolve = %v, %v", ok, err)
+	}
+	if auth.Username != "bot" || auth.Password != "s3cret-password" {
+		t.Errorf("resolved = %+v", auth)
+	}
+
+	if _, ok, err := store.Resolve("quay.io/team/app"); ok || err != nil {
+		t.Errorf("Resolve of an unknown registry = %v, %v", ok, err)
+	}
+
+	encoded, err := store.EncodedAuth("ghcr.io/owner/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(decoded, []byte(`"identitytoken":"token"`)) {
+		t.Errorf("encoded auth = %s", decoded)
+	}
+}
+
+func TestRegistryCredentialStoreRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, dir string, records map[string]registryCredentialRecord)
+	}{
+		{
+			name: "flipped ciphertext bit",
+			tamper: func(t *testing.T, dir string, records map[string]registryCredentialRecord) {
+				record := records["docker.io"]
+				record.Sealed[len(record.Sealed)-1] ^= 1
+				records["docker.io"] = record
+			},
+		},
+		{
+			// The hostname is authenticated, a record cannot be moved to
+			// another registry.
+			name: "record moved to another registry",
+			tamper: func(t *testing.T, dir string, records map[string]registryCredentialRecord) {
+				records["docker.io"] = records["ghcr.io"]
+			},
+		},
+		{
+			name: "truncated record",
+			tamper: func(t *testing.T, dir string, records map[string]registryCredentialRecord) {
+				record := records["docker.io"]
+				record.Sealed = record.Sealed[:4]
+				records["docker.io"] = record
+			},
+		},
+		{
+			name: "replaced key",
+			tamper: func(t *testing.T, dir string, records map[string]registryCredentialRecord) {
+				if err := os.WriteFile(filepath.Join(dir, "registry_credentials.key"), bytes.Repeat([]byte{7}, 32), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := NewRegistryCredentialStore(dir)
+			if _, err := store.Save(registry.AuthConfig{Username: "hub", Password: "a", ServerAddress: "docker.io"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Save(registry.AuthConfig{Username: "gh", Password: "b", ServerAddress: "ghcr.io"}); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := store.records()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(t, dir, records)
+			raw, _ := json.Marshal(records)
+			if err := os.WriteFile(filepath.Join(dir, "registry_credentials.json"), raw, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if auth, _, err := store.Resolve("docker.io/library/nginx"); err == nil {
+				t.Errorf("Resolve accepted a tampered record: %+v", auth)
+			}
+		})
+	}
+}
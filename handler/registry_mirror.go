@@ -0,0 +1,581 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxMirrorManifestSize = 4 << 20
+	mirrorManifestAccept  = "application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json, " +
+		"application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var ErrMirrorDigestMismatch = errors.New("upstream content does not match its digest")
+
+type RegistryMirrorOptions struct {
+	MaxBytes        int64    // Cache size cap, least recently used blobs are evicted past it
+	AllowedNetworks []string // CIDRs of the peers allowed to pull public images without a token
+
+	// Upstream registries fetched with the stored registry credentials, pulling
+	// from them always needs a token. Others are fetched anonymously.
+	CredentialRegistries []string
+	// Authorize checks the API token peers log in with, as the password of
+	// `docker login <mirror>`.
+	Authorize func(token string) bool
+}
+
+type mirrorBlob struct {
+	size     int64
+	lastUsed time.Time
+	private  bool // Fetched with stored credentials, only served to token holders
+}
+
+// RegistryMirror is a read-only pull-through cache speaking the subset of the
+// OCI distribution API needed to pull. Repositories are named like in image
+// references, `library/nginx` is fetched from Docker Hub and
+// `ghcr.io/org/app` from ghcr.io. Blobs and manifests are stored on disk by
+// digest and the least recently used ones are evicted past the size cap.
+// Content fetched with stored credentials is kept apart and only served to
+// peers presenting an API token.
+type RegistryMirror struct {
+	credentials          *RegistryCredentialStore
+	credentialRegistries []string
+	authorize            func(token string) bool
+	httpClient           *http.Client
+	dir                  string
+	maxBytes             int64
+	allowed              []*net.IPNet
+
+	mu     sync.Mutex
+	blobs  map[digest.Digest]*mirrorBlob
+	size   int64
+	tags   map[string]digest.Digest // Last digest served for `<name>:<tag>`, used when upstream is down
+	hits   int64
+	misses int64
+}
+
+func NewRegistryMirror(credentials *RegistryCredentialStore, options RegistryMirrorOptions, dataDir string) (*RegistryMirror, error) {
+	mirror := &RegistryMirror{
+		credentials: credentials,
+		authorize:   options.Authorize,
+		httpClient:  &http.Client{Timeout: 10 * time.Minute},
+		dir:         filepath.Join(dataDir, "mirror"),
+		maxBytes:    options.MaxBytes,
+		blobs:       map[digest.Digest]*mirrorBlob{},
+		tags:        map[string]digest.Digest{},
+	}
+
+	for _, registry := range options.CredentialRegistries {
+		mirror.credentialRegistries = append(mirror.credentialRegistries, registryHostname(registry))
+	}
+
+	for _, cidr := range options.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		mirror.allowed = append(mirror.allowed, network)
+	}
+
+	for _, private := range []bool{false, true} {
+		if err := os.MkdirAll(mirror.blobDir(private), 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(mirror.dir, "tmp"), 0700); err != nil {
+		return nil, err
+	}
+
+	// Pick up what previous runs cached, modification times track usage.
+	for _, private := range []bool{false, true} {
+		err := filepath.WalkDir(mirror.blobDir(private), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			dgst := digest.NewDigestFromEncoded(digest.SHA256, entry.Name())
+			if existing, ok := mirror.blobs[dgst]; ok {
+				// Also cached publicly by an older run, which is enough.
+				mirror.size -= existing.size
+				_ = os.Remove(path)
+			}
+			mirror.blobs[dgst] = &mirrorBlob{size: info.Size(), lastUsed: info.ModTime(), private: private}
+			mirror.size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	mirror.evict()
+
+	return mirror, nil
+}
+
+// blobDir holds the cached sha256 blobs, content fetched with stored
+// credentials lives in its own tree.
+func (m *RegistryMirror) blobDir(private bool) string {
+	if private {
+		return filepath.Join(m.dir, "private", "sha256")
+	}
+
+	return filepath.Join(m.dir, "blobs", "sha256")
+}
+
+func (m *RegistryMirror) blobPath(dgst digest.Digest, private bool) string {
+	return filepath.Join(m.blobDir(private), dgst.Encoded())
+}
+
+// Serve handles every `/v2/*` request. Docker does not send the API key, peers
+// in the allowed networks pull public images anonymously, others and pulls
+// through stored credentials need an API token given with `docker login`.
+func (m *RegistryMirror) Serve(c echo.Context) error {
+	c.Response().Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	authorized := m.authorized(c)
+	if !authorized && !m.allowedPeer(c) {
+		return m.unauthorized(c, "peer is not allowed to use this mirror without a token")
+	}
+
+	path := strings.Trim(c.Param("*"), "/")
+	if path == "" {
+		// Docker only sends its login to registries asking for it here.
+		if !authorized && len(m.credentialRegistries) > 0 {
+			return m.unauthorized(c, "authentication required")
+		}
+		return c.JSON(http.StatusOK, map[string]any{})
+	}
+
+	if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+		return m.serveManifest(c, path[:i], path[i+len("/manifests/"):], authorized)
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+		dgst, err := digest.Parse(path[i+len("/blobs/"):])
+		if err != nil || dgst.Algorithm() != digest.SHA256 {
+			return registryError(c, http.StatusBadRequest, "DIGEST_INVALID", "provided digest is invalid")
+		}
+		return m.serveBlob(c, path[:i], dgst, authorized)
+	}
+
+	return registryError(c, http.StatusNotFound, "UNSUPPORTED", "the mirror only serves manifests and blobs")
+}
+
+func (m *RegistryMirror) serveManifest(c echo.Context, name, ref string, authorized bool) error {
+	remote, private, err := m.upstream(name)
+	if err != nil {
+		return registryError(c, http.StatusBadRequest, "NAME_INVALID", err.Error())
+	}
+	if private && !authorized {
+		return m.unauthorized(c, "authentication required")
+	}
+
+	dgst, err := digest.Parse(ref)
+	isDigest := err == nil
+	if !isDigest {
+		if _, err := reference.WithTag(reference.TrimNamed(remote.named), ref); err != nil {
+			return registryError(c, http.StatusBadRequest, "TAG_INVALID", "manifest tag is invalid")
+		}
+	}
+
+	// Manifests by digest never change, tags are always resolved upstream.
+	if !isDigest || !m.cached(dgst, authorized) {
+		accept := c.Request().Header.Get("Accept")
+		if accept == "" {
+			accept = mirrorManifestAccept
+		}
+
+		fetched, fetchErr := m.fetchManifest(c.Request().Context(), remote, ref, accept, private)
+		switch {
+		case fetchErr == nil:
+			dgst = fetched
+			if !isDigest {
+				m.mu.Lock()
+				m.tags[name+":"+ref] = dgst
+				m.mu.Unlock()
+			}
+		case !isDigest:
+			m.mu.Lock()
+			last, found := m.tags[name+":"+ref]
+			m.mu.Unlock()
+			if !found || !m.cached(last, authorized) {
+				return m.upstreamError(c, fetchErr)
+			}
+			dgst = last
+		default:
+			return m.upstreamError(c, fetchErr)
+		}
+	} else {
+		m.touch(dgst, true)
+	}
+
+	raw, err := m.readBlob(dgst)
+	if err != nil {
+		return registryError(c, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+	}
+
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	_ = json.Unmarshal(raw, &manifest)
+	if manifest.MediaType == "" {
+		manifest.MediaType = ocispec.MediaTypeImageManifest
+	}
+
+	c.Response().Header().Set("Docker-Content-Digest", dgst.String())
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(len(raw)))
+	if c.Request().Method == http.MethodHead {
+		c.Response().Header().Set(echo.HeaderContentType, manifest.MediaType)
+		return c.NoContent(http.StatusOK)
+	}
+
+	return c.Blob(http.StatusOK, manifest.MediaType, raw)
+}
+
+func (m *RegistryMirror) fetchManifest(ctx context.Context, remote *registryClient, ref, accept string, private bool) (digest.Digest, error) {
+	response, err := remote.get(ctx, "/manifests/"+ref, accept)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(response.Body, maxMirrorManifestSize))
+	if err != nil {
+		return "", err
+	}
+
+	dgst := digest.FromBytes(raw)
+	if expected, err := digest.Parse(ref); err == nil && expected != dgst {
+		return "", ErrMirrorDigestMismatch
+	}
+
+	return dgst, m.store(bytes.NewReader(raw), dgst, io.Discard, private)
+}
+
+func (m *RegistryMirror) serveBlob(c echo.Context, name string, dgst digest.Digest, authorized bool) error {
+	remote, private, err := m.upstream(name)
+	if err != nil {
+		return registryError(c, http.StatusBadRequest, "NAME_INVALID", err.Error())
+	}
+	if private && !authorized {
+		return m.unauthorized(c, "authentication required")
+	}
+
+	if !m.cached(dgst, authorized) {
+		response, err := remote.get(c.Request().Context(), "/blobs/"+dgst.String(), "*/*")
+		if err != nil {
+			return m.upstreamError(c, err)
+		}
+		defer response.Body.Close()
+
+		// A HEAD request fills the cache first, the GET that follows is
+		// then served locally.
+		if c.Request().Method == http.MethodHead {
+			if err := m.store(response.Body, dgst, io.Discard, private); err != nil {
+				return m.upstreamError(c, err)
+			}
+		} else {
+			c.Response().Header().Set(echo.HeaderContentType, "application/octet-stream")
+			c.Response().Header().Set("Docker-Content-Digest", dgst.String())
+			if response.ContentLength >= 0 {
+				c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(response.ContentLength, 10))
+			}
+			c.Response().WriteHeader(http.StatusOK)
+
+			// The client gets the bytes as they arrive, a broken transfer is
+			// not cached.
+			if err := m.store(response.Body, dgst, c.Response(), private); err != nil {
+				log.Err(err).
+					Array("tags", zerolog.Arr().Str("registry_mirror").Str("blob")).
+					Str("digest", dgst.String()).
+					Msg("error caching blob")
+			}
+			return nil
+		}
+	}
+
+	file, err := m.openBlob(dgst)
+	if err != nil {
+		return registryError(c, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+	}
+	defer file.Close()
+	m.touch(dgst, true)
+
+	info, err := file.Stat()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	c.Response().Header().Set("Docker-Content-Digest", dgst.String())
+	http.ServeContent(c.Response(), c.Request(), "", info.ModTime(), file)
+	return nil
+}
+
+// store copies r into the cache under dgst, writing it to w along the way. A
+// public copy replaces a private one, it is the same content.
+func (m *RegistryMirror) store(r io.Reader, dgst digest.Digest, w io.Writer, private bool) error {
+	tmp, err := os.CreateTemp(filepath.Join(m.dir, "tmp"), "blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	verifier := dgst.Verifier()
+	size, err := io.Copy(io.MultiWriter(tmp, verifier, w), r)
+	if err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return ErrMirrorDigestMismatch
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.blobPath(dgst, private)); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if existing, ok := m.blobs[dgst]; ok {
+		m.size -= existing.size
+		if existing.private != private {
+			_ = os.Remove(m.blobPath(dgst, existing.private))
+		}
+	}
+	m.blobs[dgst] = &mirrorBlob{size: size, lastUsed: time.Now(), private: private}
+	m.size += size
+	m.misses++
+	m.mu.Unlock()
+
+	m.evict()
+	return nil
+}
+
+// cached reports whether dgst can be served from the cache, private content
+// only when authorized.
+func (m *RegistryMirror) cached(dgst digest.Digest, authorized bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	blob, ok := m.blobs[dgst]
+	return ok && (authorized || !blob.private)
+}
+
+// cachedPath is where dgst is cached, either tree when unknown.
+func (m *RegistryMirror) cachedPath(dgst digest.Digest) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	blob, ok := m.blobs[dgst]
+	return m.blobPath(dgst, ok && blob.private)
+}
+
+func (m *RegistryMirror) readBlob(dgst digest.Digest) ([]byte, error) {
+	return os.ReadFile(m.cachedPath(dgst))
+}
+
+func (m *RegistryMirror) openBlob(dgst digest.Digest) (*os.File, error) {
+	return os.Open(m.cachedPath(dgst))
+}
+
+func (m *RegistryMirror) touch(dgst digest.Digest, hit bool) {
+	now := time.Now()
+
+	m.mu.Lock()
+	if blob, ok := m.blobs[dgst]; ok {
+		blob.lastUsed = now
+	}
+	if hit {
+		m.hits++
+	}
+	m.mu.Unlock()
+
+	_ = os.Chtimes(m.cachedPath(dgst), now, now)
+}
+
+// evict removes the least recently used blobs until the cache fits its cap.
+func (m *RegistryMirror) evict() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.size <= m.maxBytes {
+		return
+	}
+
+	digests := make([]digest.Digest, 0, len(m.blobs))
+	for dgst := range m.blobs {
+		digests = append(digests, dgst)
+	}
+	sort.Slice(digests, func(i, j int) bool { return m.blobs[digests[i]].lastUsed.Before(m.blobs[digests[j]].lastUsed) })
+
+	for _, dgst := range digests {
+		if m.size <= m.maxBytes {
+			break
+		}
+		if err := os.Remove(m.blobPath(dgst, m.blobs[dgst].private)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("registry_mirror").Str("evict")).
+				Str("digest", dgst.String()).
+				Msg("error evicting blob")
+			continue
+		}
+		m.size -= m.blobs[dgst].size
+		delete(m.blobs, dgst)
+	}
+}
+
+// upstream maps a mirror repository name to the registry it is pulled from.
+// private is true when the stored credentials are used for that registry.
+func (m *RegistryMirror) upstream(name string) (remote *registryClient, private bool, err error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if containsString(m.credentialRegistries, registryHostname(reference.Domain(named))) {
+		return newRegistryClient(m.httpClient, m.credentials, named, nil), true, nil
+	}
+
+	return newRegistryClient(m.httpClient, nil, named, nil), false, nil
+}
+
+func (m *RegistryMirror) upstreamError(c echo.Context, err error) error {
+	if errdefs.IsNotFound(err) {
+		return registryError(c, http.StatusNotFound, "MANIFEST_UNKNOWN", "not found upstream")
+	}
+
+	log.Err(err).
+		Array("tags", zerolog.Arr().Str("registry_mirror").Str("upstream")).
+		Str("path", c.Request().URL.Path).
+		Msg("error fetching from upstream registry")
+	return registryError(c, http.StatusBadGateway, "UNAVAILABLE", "upstream registry is unavailable")
+}
+
+func (m *RegistryMirror) Status(c echo.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": map[string]any{
+			"blobs":     len(m.blobs),
+			"size":      m.size,
+			"max_size":  m.maxBytes,
+			"hits":      m.hits,
+			"misses":    m.misses,
+			"tags_seen": len(m.tags),
+		},
+	})
+}
+
+// allowedPeer checks the connecting address against the allowed networks.
+// Requests coming through the manager tunnel carry the address of the tunnel
+// connection, not of the peer, and are never allowed this way.
+func (m *RegistryMirror) allowedPeer(c echo.Context) bool {
+	if viaTunnel(c.Request()) {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		host = c.Request().RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range m.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorized checks the API token sent as basic auth password, what docker
+// sends after `docker login`, or as bearer token.
+func (m *RegistryMirror) authorized(c echo.Context) bool {
+	if m.authorize == nil {
+		return false
+	}
+
+	if _, password, ok := c.Request().BasicAuth(); ok {
+		return password != "" && m.authorize(password)
+	}
+	if token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+		return token != "" && m.authorize(token)
+	}
+
+	return false
+}
+
+// unauthorized challenges the peer for basic auth, docker then retries with
+// the credentials of `docker login <mirror>`.
+func (m *RegistryMirror) unauthorized(c echo.Context, message string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="cconnector registry mirror"`)
+	return registryError(c, http.StatusUnauthorized, "UNAUTHORIZED", message)
+}
+
+// registryError answers with the error body of the distribution API.
+func registryError(c echo.Context, status int, code, message string) error {
+	return c.JSON(status, map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// mirrorReference rewrites an image reference so it is pulled through the
+// cconnector mirror at mirrorHost, the inverse of RegistryMirror.upstream.
+func mirrorReference(mirrorHost, imageRef string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+	named = reference.TagNameOnly(named)
+
+	path := reference.Path(named)
+	if domain := reference.Domain(named); domain != dockerHubRegistry {
+		path = domain + "/" + path
+	}
+
+	mirrored := mirrorHost + "/" + path
+	if tagged, ok := named.(reference.Tagged); ok {
+		mirrored += ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		mirrored += "@" + digested.Digest().String()
+	}
+
+	if _, err := reference.ParseNormalizedNamed(mirrored); err != nil {
+		return "", fmt.Errorf("%s cannot be pulled through the mirror: %w", imageRef, err)
+	}
+
+	return mirrored, nil
+}
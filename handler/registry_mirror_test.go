@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/labstack/echo/v4"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testMirrorToken = "mirror-token"
+
+var (
+	testMirrorLayer    = []byte("layer content")
+	testMirrorManifest = []byte(`{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","layers":[{"digest":"` +
+		digest.FromBytes(testMirrorLayer).String() + `"}]}`)
+)
+
+// testUpstreamRegistry serves one image under every repository and counts
+// the requests it gets. With credentials set, requests must carry them.
+type testUpstreamRegistry struct {
+	username, password string
+
+	mu             sync.Mutex
+	requests       map[string]int
+	authorizations []string
+}
+
+func (r *testUpstreamRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests[req.URL.Path]++
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		r.authorizations = append(r.authorizations, auth)
+	}
+	r.mu.Unlock()
+
+	if r.username != "" {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="upstream"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/manifests/v1"), strings.HasSuffix(req.URL.Path, "/manifests/"+digest.FromBytes(testMirrorManifest).String()):
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Write(testMirrorManifest)
+	case strings.HasSuffix(req.URL.Path, "/blobs/"+digest.FromBytes(testMirrorLayer).String()):
+		w.Write(testMirrorLayer)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *testUpstreamRegistry) count(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.requests[path]
+}
+
+// newTestRegistryMirror returns a mirror in front of upstream along with the
+// upstream host. Credentials for that host are always stored, whether the
+// mirror uses them depends on credentialRegistries.
+func newTestRegistryMirror(t *testing.T, upstream *testUpstreamRegistry, credentialRegistries func(host string) []string) (*RegistryMirror, *echo.Echo, string) {
+	t.Helper()
+
+	upstream.requests = map[string]int{}
+	server := httptest.NewTLSServer(upstream)
+	t.Cleanup(server.Close)
+	host := server.Listener.Addr().String()
+
+	credentials := NewRegistryCredentialStore(t.TempDir())
+	if _, err := credentials.Save(registry.AuthConfig{Username: "bot", Password: "upstream-password", ServerAddress: host}); err != nil {
+		t.Fatal(err)
+	}
+
+	options := RegistryMirrorOptions{
+		MaxBytes:        1 << 20,
+		AllowedNetworks: []string{"127.0.0.0/8"},
+		Authorize:       func(token string) bool { return token == testMirrorToken },
+	}
+	if credentialRegistries != nil {
+		options.CredentialRegistries = credentialRegistries(host)
+	}
+
+	mirror, err := NewRegistryMirror(credentials, options, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror.httpClient = server.Client()
+
+	e := echo.New()
+	e.GET("/v2/*", mirror.Serve)
+	e.HEAD("/v2/*", mirror.Serve)
+
+	return mirror, e, host
+}
+
+func mirrorRequest(e *echo.Echo, path, remoteAddr, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.RemoteAddr = remoteAddr
+	if token != "" {
+		request.Header.Set(echo.HeaderAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte("peer:"+token)))
+	}
+
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRegistryMirrorCachesBlobs(t *testing.T) {
+	upstream := &testUpstreamRegistry{}
+	mirror, e, host := newTestRegistryMirror(t, upstream, nil)
+	layerDigest := digest.FromBytes(testMirrorLayer)
+	manifestDigest := digest.FromBytes(testMirrorManifest)
+
+	response := mirrorRequest(e, "/v2/"+host+"/team/app/manifests/v1", "127.0.0.1:40000", "")
+	if response.Code != http.StatusOK || response.Body.String() != string(testMirrorManifest) {
+		t.Fatalf("manifest: status %d, body %s", response.Code, response.Body)
+	}
+	if got := response.Header().Get("Docker-Content-Digest"); got != manifestDigest.String() {
+		t.Errorf("Docker-Content-Digest = %q, want %q", got, manifestDigest)
+	}
+
+	for i := 0; i < 2; i++ {
+		response = mirrorRequest(e, "/v2/"+host+"/team/app/blobs/"+layerDigest.String(), "127.0.0.1:40000", "")
+		if response.Code != http.StatusOK || response.Body.String() != string(testMirrorLayer) {
+			t.Fatalf("blob pull %d: status %d, body %s", i, response.Code, response.Body)
+		}
+	}
+	if got := upstream.count("/v2/team/app/blobs/" + layerDigest.String()); got != 1 {
+		t.Errorf("upstream blob requests = %d, want 1, the second pull is a cache hit", got)
+	}
+
+	// Manifests by digest never change, they are served from the cache too.
+	response = mirrorRequest(e, "/v2/"+host+"/team/app/manifests/"+manifestDigest.String(), "127.0.0.1:40000", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("manifest by digest: status %d", response.Code)
+	}
+	if got := upstream.count("/v2/team/app/manifests/" + manifestDigest.String()); got != 0 {
+		t.Errorf("upstream manifest by digest requests = %d, want 0", got)
+	}
+
+	if mirror.hits != 2 || mirror.misses != 2 {
+		t.Errorf("hits = %d, misses = %d, want 2 and 2", mirror.hits, mirror.misses)
+	}
+
+	// Registries not listed are fetched anonymously, stored credentials or not.
+	if len(upstream.authorizations) != 0 {
+		t.Errorf("upstream got credentials %v", upstream.authorizations)
+	}
+}
+
+func TestRegistryMirrorPeerAccess(t *testing.T) {
+	_, e, host := newTestRegistryMirror(t, &testUpstreamRegistry{}, nil)
+	path := "/v2/" + host + "/team/app/manifests/v1"
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		token      string
+		tunnel     bool
+		want       int
+	}{
+		{name: "allowed network", remoteAddr: "127.0.0.1:40000", want: http.StatusOK},
+		{name: "other network", remoteAddr: "192.168.1.20:40000", want: http.StatusUnauthorized},
+		{name: "other network with token", remoteAddr: "192.168.1.20:40000", token: testMirrorToken, want: http.StatusOK},
+		{name: "other network with wrong token", remoteAddr: "192.168.1.20:40000", token: "guess", want: http.StatusUnauthorized},
+		{name: "through the tunnel", remoteAddr: "127.0.0.1:40000", tunnel: true, want: http.StatusUnauthorized},
+		{name: "through the tunnel with token", remoteAddr: "127.0.0.1:40000", token: testMirrorToken, tunnel: true, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, path, nil)
+			request.RemoteAddr = tt.remoteAddr
+			if tt.token != "" {
+				request.SetBasicAuth("peer", tt.token)
+			}
+			if tt.tunnel {
+				request = request.WithContext(context.WithValue(request.Context(), tunnelRequestContextKey{}, true))
+			}
+
+			response := httptest.NewRecorder()
+			e.ServeHTTP(response, request)
+
+			if response.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", response.Code, tt.want, response.Body)
+			}
+			if tt.want == http.StatusUnauthorized && response.Header().Get(echo.HeaderWWWAuthenticate) == "" {
+				t.Error("missing the basic auth challenge docker logs in after")
+			}
+		})
+	}
+}
+
+func TestRegistryMirrorCredentialRegistries(t *testing.T) {
+	upstream := &testUpstreamRegistry{username: "bot", password: "upstream-password"}
+	mirror, e, host := newTestRegistryMirror(t, upstream, func(host string) []string { return []string{host} })
+	layerDigest := digest.FromBytes(testMirrorLayer)
+
+	// Docker only logs in when the ping asks for it.
+	if response := mirrorRequest(e, "/v2/", "127.0.0.1:40000", ""); response.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous ping: status %d, want %d", response.Code, http.StatusUnauthorized)
+	}
+
+	for _, path := range []string{"/manifests/v1", "/blobs/" + layerDigest.String()} {
+		response := mirrorRequest(e, "/v2/"+host+"/team/app"+path, "127.0.0.1:40000", "")
+		if response.Code != http.StatusUnauthorized {
+			t.Errorf("anonymous %s: status %d, want %d", path, response.Code, http.StatusUnauthorized)
+		}
+	}
+	if len(upstream.requests) != 0 {
+		t.Fatalf("upstream requests = %v, want none before a token is given", upstream.requests)
+	}
+
+	response := mirrorRequest(e, "/v2/"+host+"/team/app/blobs/"+layerDigest.String(), "127.0.0.1:40000", testMirrorToken)
+	if response.Code != http.StatusOK || response.Body.String() != string(testMirrorLayer) {
+		t.Fatalf("blob with token: status %d, body %s", response.Code, response.Body)
+	}
+
+	// Content fetched with the stored credentials is only served to token holders.
+	if mirror.cached(layerDigest, false) || !mirror.cached(layerDigest, true) {
+		t.Error("private blob is served without a token")
+	}
+	if !strings.HasPrefix(mirror.cachedPath(layerDigest), mirror.blobDir(true)) {
+		t.Errorf("private blob cached at %s", mirror.cachedPath(layerDigest))
+	}
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// TokenScopesContextKey holds the scopes of the API token of the request.
+	TokenScopesContextKey = "token_scopes"
+
+	// ScopeAdmin allows every change and implies every other scope, the host
+	// token carries it.
+	ScopeAdmin = "admin"
+	// ScopeVolumesWrite allows writing and deleting files inside volumes.
+	ScopeVolumesWrite = "volumes:write"
+)
+
+// RequireScope rejects requests whose API token carries neither scope nor
+// ScopeAdmin.
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			scopes, _ := c.Get(TokenScopesContextKey).([]string)
+			if !containsString(scopes, scope) && !containsString(scopes, ScopeAdmin) {
+				return c.JSON(http.StatusForbidden, ForbiddenResponseBody("token lacks the "+scope+" scope"))
+			}
+
+			return next(c)
+		}
+	}
+}
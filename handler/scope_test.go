@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes any
+		want   int
+	}{
+		{name: "no scopes", scopes: nil, want: http.StatusForbidden},
+		{name: "other scope", scopes: []string{"images:write"}, want: http.StatusForbidden},
+		{name: "required scope", scopes: []string{"images:write", ScopeVolumesWrite}, want: http.StatusOK},
+		{name: "admin", scopes: []string{ScopeAdmin}, want: http.StatusOK},
+	}
+
+	guarded := RequireScope(ScopeVolumesWrite)(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/volumes/data/files", nil), recorder)
+		if tt.scopes != nil {
+			c.Set(TokenScopesContextKey, tt.scopes)
+		}
+
+		if err := guarded(c); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, recorder.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidLabelSelector = errors.New("invalid label selector")
+
+type selectorOperator string
+
+const (
+	selectorOperatorExists       selectorOperator = "exists"
+	selectorOperatorDoesNotExist selectorOperator = "!"
+	selectorOperatorEquals       selectorOperator = "="
+	selectorOperatorNotEquals    selectorOperator = "!="
+	selectorOperatorIn           selectorOperator = "in"
+	selectorOperatorNotIn        selectorOperator = "notin"
+)
+
+type selectorRequirement struct {
+	key      string
+	operator selectorOperator
+	values   []string
+}
+
+// LabelSelector is a parsed Kubernetes-style label selector, e.g.
+// `app=web,tier!=cache,env in (prod,staging),!legacy`.
+type LabelSelector struct {
+	requirements []selectorRequirement
+}
+
+// ParseLabelSelector parses a Kubernetes-style label selector. An empty
+// selector matches everything.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	parsed := LabelSelector{}
+
+	for _, term := range splitSelectorTerms(selector) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		requirement, err := parseSelectorTerm(term)
+		if err != nil {
+			return LabelSelector{}, err
+		}
+		parsed.requirements = append(parsed.requirements, requirement)
+	}
+
+	return parsed, nil
+}
+
+// Empty reports whether the selector has no requirement.
+func (s LabelSelector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+// Matches reports whether the given labels satisfy every requirement.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s.requirements {
+		value, exists := labels[requirement.key]
+
+		switch requirement.operator {
+		case selectorOperatorExists:
+			if !exists {
+				return false
+			}
+		case selectorOperatorDoesNotExist:
+			if exists {
+				return false
+			}
+		case selectorOperatorEquals:
+			if !exists || value != requirement.values[0] {
+				return false
+			}
+		case selectorOperatorNotEquals:
+			if exists && value == requirement.values[0] {
+				return false
+			}
+		case selectorOperatorIn:
+			if !exists || !containsString(requirement.values, value) {
+				return false
+			}
+		case selectorOperatorNotIn:
+			if exists && containsString(requirement.values, value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// splitSelectorTerms splits on commas that are not inside a value set.
+func splitSelectorTerms(selector string) []string {
+	terms := []string{}
+	depth := 0
+	start := 0
+
+	for i, r := range selector {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(terms, selector[start:])
+}
+
+func parseSelectorTerm(term string) (selectorRequirement, error) {
+	if strings.HasPrefix(term, "!") {
+		key := strings.TrimSpace(term[1:])
+		if !isValidSelectorKey(key) {
+			return selectorRequirement{}, fmt.Errorf("%w: `%s`", ErrInvalidLabelSelector, term)
+		}
+		return selectorRequirement{key: key, operator: selectorOperatorDoesNotExist}, nil
+	}
+
+	if open := strings.Index(term, "("); open != -1 {
+		if !strings.HasSuffix(term, ")") {
+			return selectorRequirement{}, fmt.Errorf("%w: `%s`", ErrInvalidLabelSelector, term)
+		}
+
+		fields := strings.Fields(term[:open])
+		if len(fields) != 2 || !isValidSelectorKey(fields[0]) {
+			return selectorRequirement{}, fmt.Errorf("%w: `%s`", ErrInvalidLabelSelector, term)
+		}
+
+		operator := selectorOperator(fields[1])
+		if operator != selectorOperatorIn && operator != selectorOperatorNotIn {
+			return selectorRequirement{}, fmt.Errorf("%w: `%s`", ErrInvalidLabelSelector, term)
+		}
+
+		values := []string{}
+		for _, value := range strings.Split(term[open+1:len(term)-1], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return selectorRequirement{}, fmt.Errorf("%w: `%s`", ErrInvalidLabelSelector, term)
+		}
+
+		return selectorRequirement{key: fields[0], operator: operator, values: values}, nil
+	}
+
+	for _, operator := range []string{"!=", "==", "="} {
+		if key, value, found := strings.Cut(term, operator); found {
+			key = strings.TrimSpace(key)
+			if !isValidSelectorKey(key) {
+				return selectorRequirement{}, fmt.Errorf("%w: `%s`", ErrInvalidLabelSelector, term)
+			}
+
+			parsedOperator := selectorOperatorEquals
+			if operator == "!=" {
+				parsedOperator = selectorOperatorNotEquals
+			}
+
+			return selectorRequirement{key: key, operator: parsedOperator, values: []string{strings.TrimSpace(value)}}, nil
+		}
+	}
+
+	if !isValidSelectorKey(term) {
+		return selectorRequirement{}, fmt.Errorf("%w: `%s`", ErrInvalidLabelSelector, term)
+	}
+
+	return selectorRequirement{key: term, operator: selectorOperatorExists}, nil
+}
+
+func isValidSelectorKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, " \t!=(),")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
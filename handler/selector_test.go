@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		labels   map[string]string
+		want     bool
+	}{
+		{selector: "", labels: nil, want: true},
+		{selector: "app=web", labels: map[string]string{"app": "web"}, want: true},
+		{selector: "app==web", labels: map[string]string{"app": "web"}, want: true},
+		{selector: "app=web", labels: map[string]string{"app": "api"}, want: false},
+		{selector: "app=web", labels: map[string]string{}, want: false},
+		{selector: "tier!=cache", labels: map[string]string{}, want: true},
+		{selector: "tier!=cache", labels: map[string]string{"tier": "cache"}, want: false},
+		{selector: "env in (prod, staging)", labels: map[string]string{"env": "staging"}, want: true},
+		{selector: "env in (prod,staging)", labels: map[string]string{"env": "dev"}, want: false},
+		{selector: "env in (prod)", labels: map[string]string{}, want: false},
+		{selector: "env notin (dev)", labels: map[string]string{}, want: true},
+		{selector: "env notin (dev)", labels: map[string]string{"env": "dev"}, want: false},
+		{selector: "legacy", labels: map[string]string{"legacy": ""}, want: true},
+		{selector: "!legacy", labels: map[string]string{"legacy": ""}, want: false},
+		{selector: "app=web, env in (prod,staging), !legacy", labels: map[string]string{"app": "web", "env": "prod"}, want: true},
+		{selector: "app=web,env in (prod,staging),!legacy", labels: map[string]string{"app": "web", "env": "prod", "legacy": "1"}, want: false},
+	}
+
+	for _, tt := range tests {
+		selector, err := ParseLabelSelector(tt.selector)
+		if err != nil {
+			t.Errorf("ParseLabelSelector(%q) error = %v", tt.selector, err)
+			continue
+		}
+		if got := selector.Matches(tt.labels); got != tt.want {
+			t.Errorf("ParseLabelSelector(%q).Matches(%v) = %v, want %v", tt.selector, tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestParseLabelSelectorInvalid(t *testing.T) {
+	for _, selector := range []string{
+		"!",
+		"=web",
+		"app web=x",
+		"env in (prod",
+		"env in ()",
+		"env within (prod)",
+		"in (prod)",
+		"a(b)",
+	} {
+		if _, err := ParseLabelSelector(selector); !errors.Is(err, ErrInvalidLabelSelector) {
+			t.Errorf("ParseLabelSelector(%q) error = %v, want ErrInvalidLabelSelector", selector, err)
+		}
+	}
+}
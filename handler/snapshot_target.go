@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// emptyPayloadHash is the sha256 of an empty body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// snapshotTarget stores snapshot tarballs under slash separated keys.
+type snapshotTarget interface {
+	// Put stores the content of file, whose sha256 is given as hex.
+	Put(ctx context.Context, key string, file *os.File, size int64, sha256Hex string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	String() string
+}
+
+type localSnapshotTarget struct {
+	dir string
+}
+
+func (t *localSnapshotTarget) path(key string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(key))
+}
+
+func (t *localSnapshotTarget) Put(_ context.Context, key string, file *os.File, _ int64, _ string) error {
+	target := t.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+func (t *localSnapshotTarget) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(t.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errdefs.NotFound(err)
+	}
+
+	return file, err
+}
+
+func (t *localSnapshotTarget) Delete(_ context.Context, key string) error {
+	if err := os.Remove(t.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (t *localSnapshotTarget) String() string {
+	return "dir:" + t.dir
+}
+
+type S3TargetOptions struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio.local:9000
+	Region    string
+	Bucket    string
+	Prefix    string // Prepended to every key
+	AccessKey string
+	SecretKey string
+}
+
+// s3SnapshotTarget speaks the S3 object API with path-style addressing and
+// AWS signature version 4, which MinIO, Ceph and most S3-compatible stores
+// accept.
+type s3SnapshotTarget struct {
+	options    S3TargetOptions
+	endpoint   *url.URL
+	httpClient *http.Client
+}
+
+func newS3SnapshotTarget(options S3TargetOptions) (*s3SnapshotTarget, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", options.Endpoint)
+	}
+	if options.Bucket == "" {
+		return nil, errors.New("s3 bucket cannot be empty")
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	options.Prefix = strings.Trim(options.Prefix, "/")
+
+	return &s3SnapshotTarget{
+		options:    options,
+		endpoint:   endpoint,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+func (t *s3SnapshotTarget) Put(ctx context.Context, key string, file *os.File, size int64, sha256Hex string) error {
+	response, err := t.do(ctx, http.MethodPut, key, io.NopCloser(file), size, sha256Hex)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+func (t *s3SnapshotTarget) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	response, err := t.do(ctx, http.MethodGet, key, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+func (t *s3SnapshotTarget) Delete(ctx context.Context, key string) error {
+	response, err := t.do(ctx, http.MethodDelete, key, nil, 0, emptyPayloadHash)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+func (t *s3SnapshotTarget) String() string {
+	return "s3://" + t.options.Bucket + "/" + t.options.Prefix
+}
+
+func (t *s3SnapshotTarget) do(ctx context.Context, method, key string, body io.ReadCloser, size int64, payloadHash string) (*http.Response, error) {
+	objectPath := "/" + t.options.Bucket + "/" + strings.TrimPrefix(t.options.Prefix+"/"+key, "/")
+
+	requestURL := *t.endpoint
+	requestURL.Path = strings.TrimSuffix(t.endpoint.Path, "/") + objectPath
+	requestURL.RawPath = s3EscapePath(requestURL.Path)
+
+	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = size
+	}
+	t.sign(request, payloadHash, time.Now().UTC())
+
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return response, nil
+	case response.StatusCode == http.StatusNotFound:
+		response.Body.Close()
+		return nil, errdefs.NotFound(fmt.Errorf("%s not found in bucket %s", key, t.options.Bucket))
+	default:
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		response.Body.Close()
+		return nil, fmt.Errorf("s3 responded to %s with status %d: %s", method, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+}
+
+// sign adds the AWS signature version 4 headers to the request.
+func (t *s3SnapshotTarget) sign(request *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + t.options.Region + "/s3/aws4_request"
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.Query().Encode(),
+		"host:" + request.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+t.options.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, t.options.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.options.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes every byte but the unreserved ones and `/`, as the
+// canonical request requires.
+func s3EscapePath(p string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("-_.~/", b) >= 0 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
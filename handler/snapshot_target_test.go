@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+)
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func TestS3SnapshotTargetSignKnownAnswer(t *testing.T) {
+	target, err := newS3SnapshotTarget(S3TargetOptions{
+		Endpoint:  "http://minio.local:9000",
+		Bucket:    "backups",
+		Prefix:    "/snap/",
+		AccessKey: testS3AccessKey,
+		SecretKey: testS3SecretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "http://minio.local:9000/backups/snap/data/2024%2001.tar.gz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.sign(request, emptyPayloadHash, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	// Computed independently from the AWS signature version 4 specification.
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=a20db5f4cee15db77d63effb260664506474e8523d346381ba146d6a9976260c"
+	if got := request.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+	if got := request.Header.Get("X-Amz-Date"); got != "20240102T030405Z" {
+		t.Errorf("X-Amz-Date = %q", got)
+	}
+}
+
+// testS3Server is an in-memory S3 stand-in checking the signature version 4
+// of every request against its own secret.
+type testS3Server struct {
+	secretKey string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *testS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if err := s.verify(r, body); err != nil {
+		http.Error(w, "SignatureDoesNotMatch: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[r.URL.Path] = body
+	case http.MethodGet:
+		object, ok := s.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(object)
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *testS3Server) verify(r *http.Request, body []byte) error {
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ", ") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+
+	accessKey, scope, _ := strings.Cut(credential, "/")
+	scopeParts := strings.Split(scope, "/")
+	if accessKey != testS3AccessKey || len(scopeParts) != 4 {
+		return fmt.Errorf("invalid credential %q", credential)
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if sum := sha256.Sum256(body); payloadHash != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("payload hash %q does not match the body", payloadHash)
+	}
+
+	canonicalHeaders := ""
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	canonicalRequest := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" +
+		canonicalHeaders + "\n" + signedHeaders + "\n" + payloadHash
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range scopeParts {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return fmt.Errorf("signature %q does not match", signature)
+	}
+
+	return nil
+}
+
+func newTestS3Target(t *testing.T, secretKey string) (*s3SnapshotTarget, *testS3Server) {
+	t.Helper()
+
+	stand := &testS3Server{secretKey: testS3SecretKey, objects: map[string][]byte{}}
+	server := httptest.NewServer(stand)
+	t.Cleanup(server.Close)
+
+	target, err := newS3SnapshotTarget(S3TargetOptions{
+		Endpoint:  server.URL,
+		Region:    "eu-west-1",
+		Bucket:    "backups",
+		Prefix:    "hosts/node-1",
+		AccessKey: testS3AccessKey,
+		SecretKey: secretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return target, stand
+}
+
+func TestS3SnapshotTargetSignsRequests(t *testing.T) {
+	target, stand := newTestS3Target(t, testS3SecretKey)
+	ctx := context.Background()
+
+	content := []byte("snapshot tarball")
+	file, err := os.Create(filepath.Join(t.TempDir(), "snapshot.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+
+	// Keys are escaped in the path, the signature covers the escaped form.
+	key := "data/2024-01-02 03:04 snapshot+1.tar.gz"
+	if err := target.Put(ctx, key, file, int64(len(content)), hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stand.objects["/backups/hosts/node-1/"+key]; !ok {
+		t.Fatalf("objects = %v, want the key under the bucket and prefix", stand.objects)
+	}
+
+	rc, err := target.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != string(content) {
+		t.Errorf("Open() = %q, want %q", got, content)
+	}
+
+	if err := target.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Open(ctx, key); !errdefs.IsNotFound(err) {
+		t.Errorf("Open() after Delete() error = %v, want not found", err)
+	}
+	// Deleting what is already gone is not an error.
+	if err := target.Delete(ctx, key); err != nil {
+		t.Errorf("Delete() of a missing key = %v", err)
+	}
+}
+
+func TestS3SnapshotTargetWrongSecret(t *testing.T) {
+	target, _ := newTestS3Target(t, "not-the-secret")
+
+	_, err := target.Open(context.Background(), "data/snapshot.tar.gz")
+	if err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("Open() error = %v, want a 403", err)
+	}
+}
@@ -0,0 +1,807 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	StackLabel        = "cconnector.stack"
+	StackServiceLabel = "cconnector.stack.service"
+	StackHashLabel    = "cconnector.stack.hash"
+
+	maxStackSpecSize = 1024 * 1024
+)
+
+var ErrInvalidStackSpec = errors.New("invalid stack spec")
+
+var stackNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Requests
+
+type StackSpec struct {
+	Name     string                      `json:"name" yaml:"name"`
+	Services map[string]StackServiceSpec `json:"services" yaml:"services"`
+	Networks map[string]StackNetworkSpec `json:"networks" yaml:"networks"`
+	Volumes  map[string]StackVolumeSpec  `json:"volumes" yaml:"volumes"`
+}
+
+type StackServiceSpec struct {
+	Image       string            `json:"image" yaml:"image"`
+	Command     []string          `json:"command" yaml:"command"`
+	Entrypoint  []string          `json:"entrypoint" yaml:"entrypoint"`
+	Environment map[string]string `json:"environment" yaml:"environment"`
+	Labels      map[string]string `json:"labels" yaml:"labels"`
+	Ports       []string          `json:"ports" yaml:"ports"`     // e.g. `8080:80`, `127.0.0.1:5432:5432/tcp`
+	Volumes     []string          `json:"volumes" yaml:"volumes"` // e.g. `data:/var/lib/data`, `/host/path:/path:ro`
+	Networks    []string          `json:"networks" yaml:"networks"`
+	DependsOn   []string          `json:"depends_on" yaml:"depends_on"`
+	Restart     string            `json:"restart" yaml:"restart"` // no, always, unless-stopped, on-failure
+}
+
+type StackNetworkSpec struct {
+	Driver   string            `json:"driver" yaml:"driver"`
+	Internal bool              `json:"internal" yaml:"internal"`
+	Labels   map[string]string `json:"labels" yaml:"labels"`
+}
+
+type StackVolumeSpec struct {
+	Driver     string            `json:"driver" yaml:"driver"`
+	DriverOpts map[string]string `json:"driver_opts" yaml:"driver_opts"`
+	Labels     map[string]string `json:"labels" yaml:"labels"`
+}
+
+type StackServiceStatus struct {
+	Service     string `json:"service"`
+	ContainerID string `json:"container_id,omitempty"`
+	Action      string `json:"action"` // created, recreated, unchanged or removed
+}
+
+// Handler
+
+type Stack struct {
+	dockerClient *client.Client
+	credentials  *RegistryCredentialStore
+	verifier     *ImageVerifier // Nil when image verification is disabled
+
+	// Deployed specs are persisted so stacks without containers yet are still
+	// known.
+	specsPath string
+	specsMu   sync.Mutex
+
+	// Deploys and removals of the same stack run one at a time.
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex
+}
+
+func NewStack(dockerClient *client.Client, credentials *RegistryCredentialStore, verifier *ImageVerifier, dataDir string) *Stack {
+	return &Stack{
+		dockerClient: dockerClient,
+		credentials:  credentials,
+		verifier:     verifier,
+		specsPath:    filepath.Join(dataDir, "stacks.json"),
+		locks:        map[string]*sync.Mutex{},
+	}
+}
+
+// lock locks the stack, the returned func unlocks it.
+func (s *Stack) lock(stackName string) func() {
+	s.locksMu.Lock()
+	lock, ok := s.locks[stackName]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[stackName] = lock
+	}
+	s.locksMu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Deploy creates a stack, or updates it when it already exists.
+func (s *Stack) Deploy(c echo.Context) error {
+	spec, err := decodeStackSpec(c.Request())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	if name := c.Param("name"); name != "" {
+		if spec.Name == "" {
+			spec.Name = name
+		} else if spec.Name != name {
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody("stack name in body does not match the url"))
+		}
+	}
+
+	order, err := spec.serviceOrder()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	unlock := s.lock(spec.Name)
+	defer unlock()
+
+	// Saved before applying, a partially applied stack still has to be known
+	// to be updated or removed.
+	if err := s.saveSpec(spec); err != nil {
+		log.Err(err).
+			Str("stack", spec.Name).
+			Msg("error saving stack spec")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	statuses, err := s.apply(c.Request().Context(), spec, order)
+	if err != nil {
+		log.Err(err).
+			Str("stack", spec.Name).
+			Any("statuses", statuses).
+			Msg("error deploying stack")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"message":  "Internal server error",
+			"stack":    spec.Name,
+			"services": statuses,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":  "Stack deployed successfully",
+		"stack":    spec.Name,
+		"services": statuses,
+	})
+}
+
+func (s *Stack) List(c echo.Context) error {
+	containers, err := s.dockerClient.ContainerList(c.Request().Context(), container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", StackLabel)),
+	})
+	if err != nil {
+		log.Err(err).Msg("error listing stack containers")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	type stackSummary struct {
+		Name     string         `json:"name"`
+		Services int            `json:"services"`
+		States   map[string]int `json:"states"`
+	}
+
+	specs, err := s.loadSpecs()
+	if err != nil {
+		log.Err(err).Msg("error loading stack specs")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	summaries := map[string]*stackSummary{}
+	for name, spec := range specs {
+		summaries[name] = &stackSummary{Name: name, Services: len(spec.Services), States: map[string]int{}}
+	}
+	for _, ctr := range containers {
+		name := ctr.Labels[StackLabel]
+		if _, ok := summaries[name]; !ok {
+			summaries[name] = &stackSummary{Name: name, States: map[string]int{}}
+		}
+		if _, ok := specs[name]; !ok {
+			summaries[name].Services++
+		}
+		summaries[name].States[ctr.State]++
+	}
+
+	data := []stackSummary{}
+	for _, summary := range summaries {
+		data = append(data, *summary)
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Name < data[j].Name })
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+func (s *Stack) Inspect(c echo.Context) error {
+	stackName := c.Param("name")
+
+	if stackName == "" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("stack name cannot be empty"))
+	}
+
+	containers, networks, volumes, err := s.resources(c.Request().Context(), stackName)
+	if err != nil {
+		log.Err(err).
+			Str("stack", stackName).
+			Msg("error inspecting stack")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	specs, err := s.loadSpecs()
+	if err != nil {
+		log.Err(err).
+			Str("stack", stackName).
+			Msg("error loading stack specs")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	spec, deployed := specs[stackName]
+
+	if !deployed && len(containers) == 0 && len(networks) == 0 && len(volumes) == 0 {
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody("stack does not exist"))
+	}
+
+	data := map[string]any{
+		"name":       stackName,
+		"containers": containers,
+		"networks":   networks,
+		"volumes":    volumes,
+	}
+	if deployed {
+		data["spec"] = spec
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+// Remove tears the whole stack down, volumes are only removed when
+// `remove_volumes=true` is given.
+func (s *Stack) Remove(c echo.Context) error {
+	stackName := c.Param("name")
+
+	if stackName == "" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("stack name cannot be empty"))
+	}
+
+	ctx := c.Request().Context()
+	removeVolumes := c.QueryParam("remove_volumes") == "true"
+
+	unlock := s.lock(stackName)
+	defer unlock()
+
+	containers, networks, volumes, err := s.resources(ctx, stackName)
+	if err != nil {
+		log.Err(err).
+			Str("stack", stackName).
+			Msg("error listing stack resources")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	specs, err := s.loadSpecs()
+	if err != nil {
+		log.Err(err).
+			Str("stack", stackName).
+			Msg("error loading stack specs")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	_, deployed := specs[stackName]
+
+	if !deployed && len(containers) == 0 && len(networks) == 0 && len(volumes) == 0 {
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody("stack does not exist"))
+	}
+
+	removed := map[string][]string{"containers": {}, "networks": {}, "volumes": {}}
+
+	for _, ctr := range containers {
+		if err := s.dockerClient.ContainerRemove(ctx, ctr.ID, container.RemoveOptions{Force: true}); err != nil {
+			log.Err(err).
+				Str("stack", stackName).
+				Str("container_id", ctr.ID).
+				Msg("error removing stack container")
+			return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+		}
+		removed["containers"] = append(removed["containers"], ctr.ID)
+	}
+
+	for _, nw := range networks {
+		if err := s.dockerClient.NetworkRemove(ctx, nw.ID); err != nil {
+			log.Err(err).
+				Str("stack", stackName).
+				Str("network_id", nw.ID).
+				Msg("error removing stack network")
+			return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+		}
+		removed["networks"] = append(removed["networks"], nw.Name)
+	}
+
+	if removeVolumes {
+		for _, vol := range volumes {
+			if err := s.dockerClient.VolumeRemove(ctx, vol.Name, false); err != nil {
+				log.Err(err).
+					Str("stack", stackName).
+					Str("volume_name", vol.Name).
+					Msg("error removing stack volume")
+				return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+			}
+			removed["volumes"] = append(removed["volumes"], vol.Name)
+		}
+	}
+
+	if err := s.forgetSpec(stackName); err != nil {
+		log.Err(err).
+			Str("stack", stackName).
+			Msg("error forgetting stack spec")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Stack removed successfully",
+		"stack":   stackName,
+		"removed": removed,
+	})
+}
+
+// apply converges docker resources to the spec: networks and volumes first,
+// then services in dependency order. Services that are no longer part of the
+// spec are removed.
+func (s *Stack) apply(ctx context.Context, spec StackSpec, order []string) ([]StackServiceStatus, error) {
+	statuses := []StackServiceStatus{}
+
+	existingContainers, existingNetworks, _, err := s.resources(ctx, spec.Name)
+	if err != nil {
+		return statuses, err
+	}
+
+	existingByService := map[string]types.Container{}
+	for _, ctr := range existingContainers {
+		existingByService[ctr.Labels[StackServiceLabel]] = ctr
+	}
+
+	// Networks whose spec changed are recreated. Docker refuses to remove a
+	// network in use, so the services attached to it are removed first and
+	// recreated below.
+	existingNetworkNames := map[string]bool{}
+	driftedNetworks := map[string]types.NetworkResource{}
+	for _, nw := range existingNetworks {
+		networkSpec, ok := spec.Networks[strings.TrimPrefix(nw.Name, spec.Name+"_")]
+		if ok && spec.networkDrifted(networkSpec, nw) {
+			driftedNetworks[nw.Name] = nw
+			continue
+		}
+		existingNetworkNames[nw.Name] = true
+	}
+
+	recreatedServices := map[string]bool{}
+	for serviceName, existing := range existingByService {
+		if !attachedToAny(existing, driftedNetworks) {
+			continue
+		}
+
+		if err := s.dockerClient.ContainerRemove(ctx, existing.ID, container.RemoveOptions{Force: true}); err != nil {
+			return statuses, fmt.Errorf("removing service %s attached to a changed network: %w", serviceName, err)
+		}
+		delete(existingByService, serviceName)
+
+		if _, ok := spec.Services[serviceName]; ok {
+			recreatedServices[serviceName] = true
+		} else {
+			statuses = append(statuses, StackServiceStatus{Service: serviceName, ContainerID: existing.ID, Action: "removed"})
+		}
+	}
+
+	for _, name := range sortedKeys(driftedNetworks) {
+		log.Info().
+			Str("stack", spec.Name).
+			Str("network", name).
+			Msg("recreating stack network whose spec changed")
+
+		if err := s.dockerClient.NetworkRemove(ctx, driftedNetworks[name].ID); err != nil {
+			return statuses, fmt.Errorf("removing changed network %s: %w", name, err)
+		}
+	}
+
+	for _, name := range sortedKeys(spec.Networks) {
+		networkSpec := spec.Networks[name]
+		if existingNetworkNames[spec.resourceName(name)] {
+			continue
+		}
+
+		_, err := s.dockerClient.NetworkCreate(ctx, spec.resourceName(name), types.NetworkCreate{
+			Driver:   networkSpec.Driver,
+			Internal: networkSpec.Internal,
+			Labels:   spec.labels(networkSpec.Labels, ""),
+		})
+		if err != nil {
+			return statuses, fmt.Errorf("creating network %s: %w", name, err)
+		}
+	}
+
+	for _, name := range sortedKeys(spec.Volumes) {
+		volumeSpec := spec.Volumes[name]
+		_, err := s.dockerClient.VolumeCreate(ctx, volume.CreateOptions{
+			Name:       spec.resourceName(name),
+			Driver:     volumeSpec.Driver,
+			DriverOpts: volumeSpec.DriverOpts,
+			Labels:     spec.labels(volumeSpec.Labels, ""),
+		})
+		if err != nil {
+			return statuses, fmt.Errorf("creating volume %s: %w", name, err)
+		}
+	}
+
+	for _, serviceName := range order {
+		serviceSpec := spec.Services[serviceName]
+		hash, err := serviceSpec.hash()
+		if err != nil {
+			return statuses, err
+		}
+
+		action := "created"
+		if recreatedServices[serviceName] {
+			action = "recreated"
+		}
+		if existing, ok := existingByService[serviceName]; ok {
+			if existing.Labels[StackHashLabel] == hash {
+				if existing.State != "running" {
+					if err := s.dockerClient.ContainerStart(ctx, existing.ID, container.StartOptions{}); err != nil {
+						return statuses, fmt.Errorf("starting service %s: %w", serviceName, err)
+					}
+				}
+				statuses = append(statuses, StackServiceStatus{Service: serviceName, ContainerID: existing.ID, Action: "unchanged"})
+				continue
+			}
+
+			if err := s.dockerClient.ContainerRemove(ctx, existing.ID, container.RemoveOptions{Force: true}); err != nil {
+				return statuses, fmt.Errorf("removing outdated service %s: %w", serviceName, err)
+			}
+			action = "recreated"
+		}
+
+		containerID, err := s.createService(ctx, spec, serviceName, hash)
+		if err != nil {
+			return statuses, err
+		}
+		statuses = append(statuses, StackServiceStatus{Service: serviceName, ContainerID: containerID, Action: action})
+	}
+
+	for serviceName, existing := range existingByService {
+		if _, ok := spec.Services[serviceName]; ok {
+			continue
+		}
+
+		if err := s.dockerClient.ContainerRemove(ctx, existing.ID, container.RemoveOptions{Force: true}); err != nil {
+			return statuses, fmt.Errorf("removing orphan service %s: %w", serviceName, err)
+		}
+		statuses = append(statuses, StackServiceStatus{Service: serviceName, ContainerID: existing.ID, Action: "removed"})
+	}
+
+	for _, nw := range existingNetworks {
+		if _, ok := spec.Networks[strings.TrimPrefix(nw.Name, spec.Name+"_")]; ok {
+			continue
+		}
+		if _, ok := driftedNetworks[nw.Name]; ok {
+			continue
+		}
+
+		if err := s.dockerClient.NetworkRemove(ctx, nw.ID); err != nil {
+			return statuses, fmt.Errorf("removing orphan network %s: %w", nw.Name, err)
+		}
+	}
+
+	return statuses, nil
+}
+
+func (s *Stack) createService(ctx context.Context, spec StackSpec, serviceName, hash string) (string, error) {
+	serviceSpec := spec.Services[serviceName]
+
+	envVariables := []string{}
+	for _, key := range sortedKeys(serviceSpec.Environment) {
+		envVariables = append(envVariables, fmt.Sprintf("%s=%s", key, serviceSpec.Environment[key]))
+	}
+
+	// Checked by validate, an invalid port fails the deploy before anything is applied.
+	exposedPorts, portBindings, _ := nat.ParsePortSpecs(serviceSpec.Ports)
+
+	volumeBinds := []string{}
+	for _, bind := range serviceSpec.Volumes {
+		source, rest, _ := strings.Cut(bind, ":")
+		if _, ok := spec.Volumes[source]; ok {
+			source = spec.resourceName(source)
+		}
+		volumeBinds = append(volumeBinds, source+":"+rest)
+	}
+
+	networkEndpointConfigs := map[string]*network.EndpointSettings{}
+	for _, n := range serviceSpec.Networks {
+		networkEndpointConfigs[spec.resourceName(n)] = &network.EndpointSettings{
+			Aliases: []string{serviceName},
+		}
+	}
+
+	labels := spec.labels(serviceSpec.Labels, serviceName)
+	labels[StackHashLabel] = hash
+
+	containerConfig := &container.Config{
+		Image:        serviceSpec.Image,
+		Cmd:          serviceSpec.Command,
+		Entrypoint:   serviceSpec.Entrypoint,
+		Env:          envVariables,
+		Labels:       labels,
+		ExposedPorts: exposedPorts,
+	}
+	hostConfig := &container.HostConfig{
+		Binds:         volumeBinds,
+		PortBindings:  portBindings,
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyMode(serviceSpec.Restart)},
+	}
+	networkingConfig := &network.NetworkingConfig{EndpointsConfig: networkEndpointConfigs}
+	containerName := spec.resourceName(serviceName)
+
+	imageRef, err := ensureImage(ctx, s.dockerClient, s.credentials, s.verifier, serviceSpec.Image)
+	if err != nil {
+		return "", fmt.Errorf("image of service %s: %w", serviceName, err)
+	}
+	containerConfig.Image = imageRef
+
+	createResp, err := s.dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, containerName)
+	if err != nil {
+		return "", fmt.Errorf("creating service %s: %w", serviceName, err)
+	}
+
+	if err := s.dockerClient.ContainerStart(ctx, createResp.ID, container.StartOptions{}); err != nil {
+		return createResp.ID, fmt.Errorf("starting service %s: %w", serviceName, err)
+	}
+
+	return createResp.ID, nil
+}
+
+func (s *Stack) loadSpecs() (map[string]StackSpec, error) {
+	s.specsMu.Lock()
+	defer s.specsMu.Unlock()
+
+	specs := map[string]StackSpec{}
+	if err := readJSONFile(s.specsPath, &specs); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
+
+func (s *Stack) saveSpec(spec StackSpec) error {
+	s.specsMu.Lock()
+	defer s.specsMu.Unlock()
+
+	specs := map[string]StackSpec{}
+	if err := readJSONFile(s.specsPath, &specs); err != nil {
+		return err
+	}
+	specs[spec.Name] = spec
+
+	return writeJSONFile(s.specsPath, specs)
+}
+
+func (s *Stack) forgetSpec(stackName string) error {
+	s.specsMu.Lock()
+	defer s.specsMu.Unlock()
+
+	specs := map[string]StackSpec{}
+	if err := readJSONFile(s.specsPath, &specs); err != nil {
+		return err
+	}
+	if _, ok := specs[stackName]; !ok {
+		return nil
+	}
+	delete(specs, stackName)
+
+	return writeJSONFile(s.specsPath, specs)
+}
+
+func (s *Stack) resources(ctx context.Context, stackName string) ([]types.Container, []types.NetworkResource, []*volume.Volume, error) {
+	stackFilter := filters.NewArgs(filters.Arg("label", StackLabel+"="+stackName))
+
+	containers, err := s.dockerClient.ContainerList(ctx, container.ListOptions{All: true, Filters: stackFilter})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	networks, err := s.dockerClient.NetworkList(ctx, types.NetworkListOptions{Filters: stackFilter})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	volumes, err := s.dockerClient.VolumeList(ctx, volume.ListOptions{Filters: stackFilter})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return containers, networks, volumes.Volumes, nil
+}
+
+// decodeStackSpec reads a yaml or json spec from the request body.
+func decodeStackSpec(r *http.Request) (StackSpec, error) {
+	spec := StackSpec{}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxStackSpecSize))
+	if err != nil {
+		return spec, fmt.Errorf("%w: failed to read body", ErrInvalidStackSpec)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(echo.HeaderContentType))
+	if mediaType == echo.MIMEApplicationJSON {
+		err = json.Unmarshal(body, &spec)
+	} else {
+		err = yaml.Unmarshal(body, &spec)
+	}
+	if err != nil {
+		return spec, fmt.Errorf("%w: %s", ErrInvalidStackSpec, err.Error())
+	}
+
+	return spec, spec.validate()
+}
+
+func (spec StackSpec) validate() error {
+	if !stackNamePattern.MatchString(spec.Name) {
+		return fmt.Errorf("%w: name must match %s", ErrInvalidStackSpec, stackNamePattern.String())
+	}
+
+	if len(spec.Services) == 0 {
+		return fmt.Errorf("%w: at least one service is required", ErrInvalidStackSpec)
+	}
+
+	for serviceName, serviceSpec := range spec.Services {
+		if !stackNamePattern.MatchString(serviceName) {
+			return fmt.Errorf("%w: service name `%s` is invalid", ErrInvalidStackSpec, serviceName)
+		}
+
+		if serviceSpec.Image == "" {
+			return fmt.Errorf("%w: service `%s` has no image", ErrInvalidStackSpec, serviceName)
+		}
+
+		if _, _, err := nat.ParsePortSpecs(serviceSpec.Ports); err != nil {
+			return fmt.Errorf("%w: service `%s` has invalid ports: %s", ErrInvalidStackSpec, serviceName, err.Error())
+		}
+
+		for _, n := range serviceSpec.Networks {
+			if _, ok := spec.Networks[n]; !ok {
+				return fmt.Errorf("%w: service `%s` uses undeclared network `%s`", ErrInvalidStackSpec, serviceName, n)
+			}
+		}
+
+		for _, bind := range serviceSpec.Volumes {
+			source, _, found := strings.Cut(bind, ":")
+			if !found {
+				return fmt.Errorf("%w: service `%s` has invalid volume `%s`", ErrInvalidStackSpec, serviceName, bind)
+			}
+			if _, ok := spec.Volumes[source]; !ok && !strings.HasPrefix(source, "/") {
+				return fmt.Errorf("%w: service `%s` uses undeclared volume `%s`", ErrInvalidStackSpec, serviceName, source)
+			}
+		}
+
+		for _, dependency := range serviceSpec.DependsOn {
+			if _, ok := spec.Services[dependency]; !ok {
+				return fmt.Errorf("%w: service `%s` depends on unknown service `%s`", ErrInvalidStackSpec, serviceName, dependency)
+			}
+		}
+	}
+
+	return nil
+}
+
+// serviceOrder sorts services so that every service comes after the services
+// it depends on.
+func (spec StackSpec) serviceOrder() ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := map[string]int{}
+	order := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("%w: dependency cycle through service `%s`", ErrInvalidStackSpec, name)
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		dependencies := append([]string{}, spec.Services[name].DependsOn...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range sortedKeys(spec.Services) {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// networkDrifted reports whether the existing network no longer matches its
+// spec. Docker cannot update networks in place.
+func (spec StackSpec) networkDrifted(networkSpec StackNetworkSpec, nw types.NetworkResource) bool {
+	driver := networkSpec.Driver
+	if driver == "" {
+		driver = "bridge"
+	}
+
+	return nw.Driver != driver ||
+		nw.Internal != networkSpec.Internal ||
+		!reflect.DeepEqual(nw.Labels, spec.labels(networkSpec.Labels, ""))
+}
+
+func attachedToAny(ctr types.Container, networks map[string]types.NetworkResource) bool {
+	if ctr.NetworkSettings == nil {
+		return false
+	}
+
+	for name := range ctr.NetworkSettings.Networks {
+		if _, ok := networks[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (spec StackSpec) resourceName(name string) string {
+	return spec.Name + "_" + name
+}
+
+func (spec StackSpec) labels(extra map[string]string, serviceName string) map[string]string {
+	labels := map[string]string{}
+	for key, value := range extra {
+		labels[key] = value
+	}
+
+	labels[StackLabel] = spec.Name
+	if serviceName != "" {
+		labels[StackServiceLabel] = serviceName
+	}
+
+	return labels
+}
+
+func (serviceSpec StackServiceSpec) hash() (string, error) {
+	raw, err := json.Marshal(serviceSpec)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/labstack/echo/v4"
+)
+
+func TestStackNetworkDrifted(t *testing.T) {
+	spec := StackSpec{Name: "demo"}
+	current := types.NetworkResource{
+		Driver: "bridge",
+		Labels: map[string]string{StackLabel: "demo", "team": "a"},
+	}
+
+	tests := []struct {
+		name        string
+		networkSpec StackNetworkSpec
+		want        bool
+	}{
+		{name: "unchanged", networkSpec: StackNetworkSpec{Labels: map[string]string{"team": "a"}}, want: false},
+		{name: "explicit default driver", networkSpec: StackNetworkSpec{Driver: "bridge", Labels: map[string]string{"team": "a"}}, want: false},
+		{name: "driver", networkSpec: StackNetworkSpec{Driver: "overlay", Labels: map[string]string{"team": "a"}}, want: true},
+		{name: "internal", networkSpec: StackNetworkSpec{Internal: true, Labels: map[string]string{"team": "a"}}, want: true},
+		{name: "label value", networkSpec: StackNetworkSpec{Labels: map[string]string{"team": "b"}}, want: true},
+		{name: "label removed", networkSpec: StackNetworkSpec{}, want: true},
+	}
+
+	for _, tt := range tests {
+		if got := spec.networkDrifted(tt.networkSpec, current); got != tt.want {
+			t.Errorf("%s: networkDrifted = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStackApplyRecreatesDriftedNetwork(t *testing.T) {
+	spec := StackSpec{
+		Name:     "demo",
+		Services: map[string]StackServiceSpec{"web": {Image: "nginx", Networks: []string{"net"}}},
+		Networks: map[string]StackNetworkSpec{"net": {Internal: true}},
+	}
+	hash, err := spec.Services["web"].hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	record := func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]types.Container{{
+			ID:     "old",
+			State:  "running",
+			Labels: map[string]string{StackLabel: "demo", StackServiceLabel: "web", StackHashLabel: hash},
+			NetworkSettings: &types.SummaryNetworkSettings{
+				Networks: map[string]*network.EndpointSettings{"demo_net": {}},
+			},
+		}})
+	})
+	mux.HandleFunc("GET /networks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]types.NetworkResource{{
+			ID:     "net-id",
+			Name:   "demo_net",
+			Driver: "bridge",
+			Labels: map[string]string{StackLabel: "demo"},
+		}})
+	})
+	mux.HandleFunc("GET /volumes", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Volumes":[]}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		switch {
+		case r.URL.Path == "/networks/create":
+			w.Write([]byte(`{"Id":"new-net"}`))
+		case r.URL.Path == "/containers/create":
+			w.Write([]byte(`{"Id":"new"}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	stack := NewStack(newTestDockerClient(t, mux), nil, nil, t.TempDir())
+	statuses, err := stack.apply(context.Background(), spec, []string{"web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantCalls := []string{
+		"DELETE /containers/old",
+		"DELETE /networks/net-id",
+		"POST /networks/create",
+		"GET /images/nginx/json",
+		"POST /containers/create",
+		"POST /containers/new/start",
+	}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("calls = %v, want %v", calls, wantCalls)
+	}
+	if len(statuses) != 1 || statuses[0].Action != "recreated" || statuses[0].ContainerID != "new" {
+		t.Errorf("statuses = %+v", statuses)
+	}
+}
+
+func TestStackListIncludesDeployedSpecs(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+
+	stack := NewStack(newTestDockerClient(t, mux), nil, nil, t.TempDir())
+	if err := stack.saveSpec(StackSpec{Name: "demo", Services: map[string]StackServiceSpec{"web": {Image: "nginx"}, "db": {Image: "postgres"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	if err := stack.List(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `"name":"demo","services":2`) {
+		t.Errorf("List = %s", body)
+	}
+
+	if err := stack.forgetSpec("demo"); err != nil {
+		t.Fatal(err)
+	}
+	specs, err := stack.loadSpecs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 0 {
+		t.Errorf("specs after forget = %v", specs)
+	}
+}
+
+func TestStackServiceOrder(t *testing.T) {
+	services := func(dependencies map[string][]string) map[string]StackServiceSpec {
+		specs := map[string]StackServiceSpec{}
+		for name, dependsOn := range dependencies {
+			specs[name] = StackServiceSpec{Image: "nginx", DependsOn: dependsOn}
+		}
+		return specs
+	}
+
+	tests := []struct {
+		name     string
+		services map[string]StackServiceSpec
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "independent services sorted by name",
+			services: services(map[string][]string{"web": nil, "db": nil, "cache": nil}),
+			want:     []string{"cache", "db", "web"},
+		},
+		{
+			name:     "dependencies first",
+			services: services(map[string][]string{"web": {"api"}, "api": {"db", "cache"}, "db": nil, "cache": nil}),
+			want:     []string{"cache", "db", "api", "web"},
+		},
+		{
+			name:     "shared dependency once",
+			services: services(map[string][]string{"a": {"db"}, "b": {"db"}, "db": nil}),
+			want:     []string{"db", "a", "b"},
+		},
+		{
+			name:     "cycle",
+			services: services(map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}),
+			wantErr:  true,
+		},
+		{
+			name:     "self dependency",
+			services: services(map[string][]string{"a": {"a"}}),
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		order, err := StackSpec{Name: "demo", Services: tt.services}.serviceOrder()
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidStackSpec) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, ErrInvalidStackSpec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(order, tt.want) {
+			t.Errorf("%s: order = %v, want %v", tt.name, order, tt.want)
+		}
+	}
+}
+
+func TestStackSpecValidate(t *testing.T) {
+	valid := func(edit func(spec *StackSpec)) StackSpec {
+		spec := StackSpec{
+			Name: "demo",
+			Services: map[string]StackServiceSpec{"web": {
+				Image:    "nginx",
+				Ports:    []string{"8080:80", "127.0.0.1:5432:5432/tcp"},
+				Volumes:  []string{"data:/data", "/srv/config:/config:ro"},
+				Networks: []string{"front"},
+			}},
+			Networks: map[string]StackNetworkSpec{"front": {}},
+			Volumes:  map[string]StackVolumeSpec{"data": {}},
+		}
+		edit(&spec)
+		return spec
+	}
+	service := func(edit func(service *StackServiceSpec)) func(spec *StackSpec) {
+		return func(spec *StackSpec) {
+			web := spec.Services["web"]
+			edit(&web)
+			spec.Services["web"] = web
+		}
+	}
+
+	tests := []struct {
+		name    string
+		spec    StackSpec
+		wantErr string
+	}{
+		{name: "valid", spec: valid(func(spec *StackSpec) {})},
+		{name: "invalid stack name", spec: valid(func(spec *StackSpec) { spec.Name = "-demo" }), wantErr: "name must match"},
+		{name: "no service", spec: valid(func(spec *StackSpec) { spec.Services = nil }), wantErr: "at least one service"},
+		{name: "invalid service name", spec: valid(func(spec *StackSpec) { spec.Services["we b"] = StackServiceSpec{Image: "nginx"} }), wantErr: "service name `we b`"},
+		{name: "no image", spec: valid(service(func(web *StackServiceSpec) { web.Image = "" })), wantErr: "has no image"},
+		{name: "invalid port", spec: valid(service(func(web *StackServiceSpec) { web.Ports = []string{"80:http"} })), wantErr: "invalid ports"},
+		{name: "port out of range", spec: valid(service(func(web *StackServiceSpec) { web.Ports = []string{"70000:80"} })), wantErr: "invalid ports"},
+		{name: "undeclared network", spec: valid(service(func(web *StackServiceSpec) { web.Networks = []string{"back"} })), wantErr: "undeclared network `back`"},
+		{name: "volume without target", spec: valid(service(func(web *StackServiceSpec) { web.Volumes = []string{"data"} })), wantErr: "invalid volume"},
+		{name: "undeclared volume", spec: valid(service(func(web *StackServiceSpec) { web.Volumes = []string{"logs:/logs"} })), wantErr: "undeclared volume `logs`"},
+		{name: "unknown dependency", spec: valid(service(func(web *StackServiceSpec) { web.DependsOn = []string{"db"} })), wantErr: "unknown service `db`"},
+	}
+
+	for _, tt := range tests {
+		err := tt.spec.validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: validate() = %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidStackSpec) || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: validate() = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodeStackSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{
+			name:        "yaml",
+			contentType: "application/yaml",
+			body:        "name: demo\nservices:\n  web:\n    image: nginx\n    ports: [\"8080:80\"]\n    depends_on: [db]\n  db:\n    image: postgres\n",
+		},
+		{
+			name: "yaml without content type",
+			body: "name: demo\nservices:\n  web:\n    image: nginx\n    ports: [\"8080:80\"]\n    depends_on: [db]\n  db:\n    image: postgres\n",
+		},
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"name":"demo","services":{"web":{"image":"nginx","ports":["8080:80"],"depends_on":["db"]},"db":{"image":"postgres"}}}`,
+		},
+		{name: "malformed yaml", contentType: "application/yaml", body: "name: [demo", wantErr: true},
+		{name: "malformed json", contentType: "application/json", body: `{"name":`, wantErr: true},
+		{name: "invalid spec", contentType: "application/json", body: `{"name":"demo","services":{"web":{}}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPut, "/stacks/demo", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			request.Header.Set(echo.HeaderContentType, tt.contentType)
+		}
+
+		spec, err := decodeStackSpec(request)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidStackSpec) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, ErrInvalidStackSpec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+
+		web := spec.Services["web"]
+		if spec.Name != "demo" || web.Image != "nginx" || !reflect.DeepEqual(web.Ports, []string{"8080:80"}) ||
+			!reflect.DeepEqual(web.DependsOn, []string{"db"}) || spec.Services["db"].Image != "postgres" {
+			t.Errorf("%s: spec = %+v", tt.name, spec)
+		}
+	}
+}
+
+func TestStackLockSerializesTheSameStack(t *testing.T) {
+	stack := NewStack(nil, nil, nil, t.TempDir())
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		running = map[string]int{}
+		most    = map[string]int{}
+	)
+	for i := 0; i < 20; i++ {
+		name := []string{"demo", "other"}[i%2]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			unlock := stack.lock(name)
+			defer unlock()
+
+			mu.Lock()
+			running[name]++
+			if running[name] > most[name] {
+				most[name] = running[name]
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running[name]--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if most["demo"] != 1 || most["other"] != 1 {
+		t.Errorf("concurrent holders = %v, want one per stack", most)
+	}
+}
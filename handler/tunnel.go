@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	tunnelBackoffBase = time.Second
+	tunnelBackoffMax  = time.Minute
+)
+
+var ErrTunnelInvalidURL = errors.New("tunnel manager url must use ws or wss scheme")
+
+// tunnelRequestContextKey marks requests which came in through the tunnel,
+// their remote address is the manager connection and says nothing about
+// the client.
+type tunnelRequestContextKey struct{}
+
+// viaTunnel reports whether r was served over the manager tunnel.
+func viaTunnel(r *http.Request) bool {
+	tunneled, _ := r.Context().Value(tunnelRequestContextKey{}).(bool)
+	return tunneled
+}
+
+type TunnelOptions struct {
+	ManagerURL string // ws:// or wss:// endpoint of the manager
+	HostToken  string
+	ClientCert string // Path to the PEM client certificate used for mTLS
+	ClientKey  string
+	CACert     string // Path to the PEM CA bundle used to verify the manager, system roots when empty
+}
+
+type tunnelStatus struct {
+	ManagerURL     string    `json:"manager_url"`
+	Connected      bool      `json:"connected"`
+	ConnectedSince time.Time `json:"connected_since,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	Reconnects     int       `json:"reconnects"`
+}
+
+// Tunnel dials out to the manager and serves the daemon router over the
+// connection, so hosts without inbound connectivity can still be driven.
+// The websocket carries an HTTP/2 connection where the daemon is the server,
+// which lets the manager multiplex concurrent requests.
+type Tunnel struct {
+	options TunnelOptions
+	handler http.Handler
+
+	mu     sync.RWMutex
+	status tunnelStatus
+}
+
+func NewTunnel(options TunnelOptions, handler http.Handler) *Tunnel {
+	return &Tunnel{
+		options: options,
+		handler: handler,
+		status:  tunnelStatus{ManagerURL: options.ManagerURL},
+	}
+}
+
+// Run keeps the tunnel up until ctx is done, reconnecting with backoff.
+func (t *Tunnel) Run(ctx context.Context) {
+	backoff := tunnelBackoffBase
+
+	for {
+		connectedAt := time.Now()
+		err := t.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A connection that stayed up for a while is not a failing one,
+		// start over with a short delay.
+		if time.Since(connectedAt) > tunnelBackoffMax {
+			backoff = tunnelBackoffBase
+		}
+
+		t.mu.Lock()
+		t.status.Connected = false
+		t.status.Reconnects++
+		if err != nil {
+			t.status.LastError = err.Error()
+		}
+		t.mu.Unlock()
+
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("tunnel").Str("reconnect")).
+			Str("manager_url", t.options.ManagerURL).
+			Dur("backoff", backoff).
+			Msg("tunnel to manager closed, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = minDuration(backoff*2, tunnelBackoffMax)
+	}
+}
+
+func (t *Tunnel) serve(ctx context.Context) error {
+	config, err := t.websocketConfig()
+	if err != nil {
+		return err
+	}
+
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.PayloadType = websocket.BinaryFrame
+
+	t.mu.Lock()
+	t.status.Connected = true
+	t.status.ConnectedSince = time.Now()
+	t.status.LastError = ""
+	t.mu.Unlock()
+
+	log.Info().
+		Array("tags", zerolog.Arr().Str("tunnel").Str("connect")).
+		Str("manager_url", t.options.ManagerURL).
+		Msg("tunnel to manager established")
+
+	// Closing the connection on shutdown unblocks ServeConn.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tunnelRequestContextKey{}, true)))
+		}),
+	})
+
+	return errors.New("tunnel connection closed")
+}
+
+func (t *Tunnel) websocketConfig() (*websocket.Config, error) {
+	managerURL, err := url.Parse(t.options.ManagerURL)
+	if err != nil {
+		return nil, err
+	}
+	if managerURL.Scheme != "ws" && managerURL.Scheme != "wss" {
+		return nil, ErrTunnelInvalidURL
+	}
+
+	origin := *managerURL
+	origin.Scheme = "https"
+	if managerURL.Scheme == "ws" {
+		origin.Scheme = "http"
+	}
+
+	config, err := websocket.NewConfig(managerURL.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set(echo.HeaderAuthorization, "Bearer "+t.options.HostToken)
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.options.ClientCert != "" || t.options.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(t.options.ClientCert, t.options.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if t.options.CACert != "" {
+		caPEM, err := os.ReadFile(t.options.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("ca cert contains no valid certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	config.TlsConfig = tlsConfig
+
+	return config, nil
+}
+
+func (t *Tunnel) Status(c echo.Context) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": t.status,
+	})
+}
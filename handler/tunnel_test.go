@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+)
+
+func TestTunnelMarksRequests(t *testing.T) {
+	e := echo.New()
+	e.GET("/via-tunnel", func(c echo.Context) error {
+		return c.String(http.StatusOK, strconv.FormatBool(viaTunnel(c.Request())))
+	})
+
+	type managerResult struct {
+		authorization string
+		body          string
+		err           error
+	}
+	results := make(chan managerResult, 1)
+	// The tunnel reconnects once the manager is done with it, only the
+	// first connection is reported.
+	report := func(result managerResult) {
+		select {
+		case results <- result:
+		default:
+		}
+	}
+
+	// The manager is the HTTP/2 client of the tunnel.
+	manager := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		result := managerResult{authorization: ws.Request().Header.Get(echo.HeaderAuthorization)}
+
+		clientConn, err := (&http2.Transport{}).NewClientConn(ws)
+		if err != nil {
+			result.err = err
+			report(result)
+			return
+		}
+		defer clientConn.Close()
+
+		request, _ := http.NewRequest(http.MethodGet, "http://daemon/via-tunnel", nil)
+		response, err := clientConn.RoundTrip(request)
+		if err != nil {
+			result.err = err
+			report(result)
+			return
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		result.body, result.err = string(body), err
+		report(result)
+	}))
+	defer manager.Close()
+
+	tunnel := NewTunnel(TunnelOptions{ManagerURL: "ws" + strings.TrimPrefix(manager.URL, "http"), HostToken: "host-token"}, e)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tunnel.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		if result.authorization != "Bearer host-token" {
+			t.Errorf("authorization = %q", result.authorization)
+		}
+		if result.body != "true" {
+			t.Errorf("request through the tunnel: viaTunnel = %s, want true", result.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request made through the tunnel")
+	}
+
+	// The same router serves direct requests unmarked.
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/via-tunnel", nil))
+	if recorder.Body.String() != "false" {
+		t.Errorf("direct request: viaTunnel = %s, want false", recorder.Body)
+	}
+}
+
+func TestTunnelWebsocketConfig(t *testing.T) {
+	tests := []struct {
+		managerURL string
+		wantOrigin string
+		wantErr    error // nil to only check that an error is returned
+	}{
+		{managerURL: "wss://manager.example.com/tunnel", wantOrigin: "https://manager.example.com/tunnel"},
+		{managerURL: "ws://127.0.0.1:8080/tunnel", wantOrigin: "http://127.0.0.1:8080/tunnel"},
+		{managerURL: "https://manager.example.com/tunnel", wantErr: ErrTunnelInvalidURL},
+		{managerURL: "manager.example.com", wantErr: ErrTunnelInvalidURL},
+	}
+
+	for _, tt := range tests {
+		config, err := NewTunnel(TunnelOptions{ManagerURL: tt.managerURL, HostToken: "host-token"}, nil).websocketConfig()
+		if tt.wantOrigin == "" {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error = %v, want %v", tt.managerURL, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Origin.String() != tt.wantOrigin || config.Header.Get(echo.HeaderAuthorization) != "Bearer host-token" {
+			t.Errorf("%s: origin %s, authorization %q", tt.managerURL, config.Origin, config.Header.Get(echo.HeaderAuthorization))
+		}
+	}
+}
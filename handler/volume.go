@@ -20,10 +20,18 @@ type VolumeCreationRequest struct {
 
 type Volume struct {
 	dockerClient *client.Client
+	credentials  *RegistryCredentialStore
+	verifier     *ImageVerifier // Nil when image verification is disabled
+	helperImage  string         // Image of the containers mounting volumes for backups and restores
 }
 
-func NewVolume(dockerClient *client.Client) *Volume {
-	return &Volume{dockerClient: dockerClient}
+func NewVolume(dockerClient *client.Client, credentials *RegistryCredentialStore, verifier *ImageVerifier, helperImage string) *Volume {
+	return &Volume{
+		dockerClient: dockerClient,
+		credentials:  credentials,
+		verifier:     verifier,
+		helperImage:  helperImage,
+	}
 }
 
 func (v *Volume) List(c echo.Context) error {
@@ -0,0 +1,389 @@
+package handler
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// VolumeHelperLabel marks the short-lived containers mounting a volume for
+	// backups and restores, its value is the volume name.
+	VolumeHelperLabel = "cconnector.volume-helper"
+
+	// volumeBackupManifestName is the last entry of every backup tarball.
+	volumeBackupManifestName = ".cconnector-backup.json"
+	volumeHelperMountPoint   = "/volume"
+)
+
+var ErrVolumeBackupChecksum = errors.New("backup content does not match its manifest")
+
+type VolumeBackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// VolumeBackupManifest lists the checksums of the regular files of a backup.
+type VolumeBackupManifest struct {
+	Volume    string             `json:"volume"`
+	CreatedAt time.Time          `json:"created_at"`
+	Files     []VolumeBackupFile `json:"files"`
+	Size      int64              `json:"size"` // Sum of the file sizes
+}
+
+type VolumeRestoreResult struct {
+	Volume   string `json:"volume"`
+	Created  bool   `json:"created"`  // The volume did not exist before
+	Verified bool   `json:"verified"` // Checksums were checked against the backup manifest
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+}
+
+// Backup streams the volume content as a gzip compressed tarball, ending with
+// a manifest of the file checksums.
+func (v *Volume) Backup(c echo.Context) error {
+	volumeName := c.Param("name")
+
+	if _, err := v.dockerClient.VolumeInspect(c.Request().Context(), volumeName); err != nil {
+		if errdefs.IsNotFound(err) {
+			return c.JSON(http.StatusNotFound, NotFoundResponseBody("volume not found"))
+		}
+		log.Err(err).
+			Str("volume", volumeName).
+			Msg("error inspecting volume")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	filename := fmt.Sprintf("%s-%s.tar.gz", volumeName, time.Now().UTC().Format("20060102T150405Z"))
+	c.Response().Header().Set(echo.HeaderContentType, "application/gzip")
+	c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	// Headers are only sent with the first chunk, failures before it still
+	// get a proper error response.
+	writer := &lazyResponseWriter{response: c.Response()}
+	if _, err := v.backup(c.Request().Context(), volumeName, writer); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("volume").Str("backup")).
+			Str("volume", volumeName).
+			Msg("error backing up volume")
+		if !writer.started {
+			return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+		}
+	}
+
+	return nil
+}
+
+// Restore extracts a tarball produced by Backup, raw or gzip compressed, into
+// the volume. It is created when missing unless `create=false`. Existing files
+// are overwritten, others are kept. When the tarball has a manifest nothing is
+// written unless every checksum matches.
+func (v *Volume) Restore(c echo.Context) error {
+	volumeName := c.Param("name")
+
+	body, err := uploadedFile(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	}
+
+	result, err := v.restore(c.Request().Context(), volumeName, body, c.QueryParam("create") != "false")
+	if err != nil {
+		switch {
+		case errdefs.IsNotFound(err):
+			return c.JSON(http.StatusNotFound, NotFoundResponseBody("volume not found"))
+		case isInvalidBackupError(err):
+			return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody(err.Error()))
+		}
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("volume").Str("restore")).
+			Str("volume", volumeName).
+			Msg("error restoring volume")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Volume restored successfully",
+		"data":    result,
+	})
+}
+
+// isInvalidBackupError tells whether restore failed because of the tarball
+// itself rather than docker.
+func isInvalidBackupError(err error) bool {
+	return errors.Is(err, ErrVolumeBackupChecksum) || errors.Is(err, ErrInvalidContainerPath) ||
+		errors.Is(err, gzip.ErrHeader) || errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backup writes the gzip compressed tarball of the volume to w.
+func (v *Volume) backup(ctx context.Context, volumeName string, w io.Writer) (VolumeBackupManifest, error) {
+	manifest := VolumeBackupManifest{
+		Volume:    volumeName,
+		CreatedAt: time.Now().UTC(),
+		Files:     []VolumeBackupFile{},
+	}
+
+	err := v.withHelper(ctx, volumeName, true, []string{"true"}, func(containerID string) error {
+		rc, _, err := v.dockerClient.CopyFromContainer(ctx, containerID, volumeHelperMountPoint)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		gzipWriter := gzip.NewWriter(w)
+		tarWriter := tar.NewWriter(gzipWriter)
+		tarReader := tar.NewReader(rc)
+
+		// Entries are named after the mount point, they are stored relative
+		// to the volume root instead.
+		base := path.Base(volumeHelperMountPoint)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			name := strings.TrimPrefix(strings.TrimPrefix(header.Name, base), "/")
+			if name == "" {
+				continue
+			}
+			header.Name = name
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname = strings.TrimPrefix(strings.TrimPrefix(header.Linkname, base), "/")
+			}
+
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+
+			hash := sha256.New()
+			size, err := io.Copy(io.MultiWriter(tarWriter, hash), tarReader)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, VolumeBackupFile{
+				Path:   name,
+				Size:   size,
+				SHA256: hex.EncodeToString(hash.Sum(nil)),
+			})
+			manifest.Size += size
+		}
+
+		raw, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = tarWriter.WriteHeader(&tar.Header{
+			Name:     volumeBackupManifestName,
+			Mode:     0644,
+			Size:     int64(len(raw)),
+			ModTime:  manifest.CreatedAt,
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(raw); err != nil {
+			return err
+		}
+		if err := tarWriter.Close(); err != nil {
+			return err
+		}
+
+		return gzipWriter.Close()
+	})
+
+	return manifest, err
+}
+
+// restore verifies the tarball while spooling it without its manifest, then
+// copies it into the volume.
+func (v *Volume) restore(ctx context.Context, volumeName string, r io.Reader, create bool) (VolumeRestoreResult, error) {
+	result := VolumeRestoreResult{Volume: volumeName}
+
+	spool, err := os.CreateTemp("", "cconnector-volume-restore-*")
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	buffered := bufio.NewReader(r)
+	var content io.Reader = buffered
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return result, err
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	}
+
+	var manifest *VolumeBackupManifest
+	checksums := map[string]string{}
+	tarReader := tar.NewReader(content)
+	tarWriter := tar.NewWriter(spool)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return result, fmt.Errorf("%w: %s", ErrInvalidContainerPath, header.Name)
+		}
+
+		if name == volumeBackupManifestName {
+			manifest = &VolumeBackupManifest{}
+			if err := json.NewDecoder(io.LimitReader(tarReader, 64<<20)).Decode(manifest); err != nil {
+				return result, fmt.Errorf("%w: unreadable manifest", ErrVolumeBackupChecksum)
+			}
+			continue
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return result, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(tarWriter, hash), tarReader)
+		if err != nil {
+			return result, err
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+		result.Files++
+		result.Size += size
+	}
+	if err := tarWriter.Close(); err != nil {
+		return result, err
+	}
+
+	if manifest != nil {
+		if len(manifest.Files) != len(checksums) {
+			return result, fmt.Errorf("%w: %d files expected, %d found", ErrVolumeBackupChecksum, len(manifest.Files), len(checksums))
+		}
+		for _, file := range manifest.Files {
+			if checksums[path.Clean(file.Path)] != file.SHA256 {
+				return result, fmt.Errorf("%w: %s", ErrVolumeBackupChecksum, file.Path)
+			}
+		}
+		result.Verified = true
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+
+	if _, err := v.dockerClient.VolumeInspect(ctx, volumeName); err != nil {
+		if !errdefs.IsNotFound(err) || !create {
+			return result, err
+		}
+		if _, err := v.dockerClient.VolumeCreate(ctx, volume.CreateOptions{Name: volumeName}); err != nil {
+			return result, err
+		}
+		result.Created = true
+	}
+
+	err = v.withHelper(ctx, volumeName, false, []string{"true"}, func(containerID string) error {
+		return v.dockerClient.CopyToContainer(ctx, containerID, volumeHelperMountPoint, spool, types.CopyToContainerOptions{})
+	})
+	if err != nil && result.Created {
+		if err := v.dockerClient.VolumeRemove(context.WithoutCancel(ctx), volumeName, false); err != nil {
+			log.Err(err).
+				Str("volume", volumeName).
+				Msg("error removing volume created for a failed restore")
+		}
+	}
+
+	return result, err
+}
+
+// withHelper calls fn with a created container mounting the volume, running
+// cmd once started. Docker copies archives in and out of it like of any
+// container, started or not.
+func (v *Volume) withHelper(ctx context.Context, volumeName string, readOnly bool, cmd []string, fn func(containerID string) error) error {
+	helperImage, err := ensureImage(ctx, v.dockerClient, v.credentials, v.verifier, v.helperImage)
+	if err != nil {
+		return fmt.Errorf("helper image: %w", err)
+	}
+
+	created, err := v.dockerClient.ContainerCreate(ctx, &container.Config{
+		Image:  helperImage,
+		Cmd:    cmd,
+		Labels: map[string]string{VolumeHelperLabel: volumeName},
+	}, &container.HostConfig{
+		NetworkMode: "none",
+		Mounts: []mount.Mount{{
+			Type:          mount.TypeVolume,
+			Source:        volumeName,
+			Target:        volumeHelperMountPoint,
+			ReadOnly:      readOnly,
+			VolumeOptions: &mount.VolumeOptions{NoCopy: true},
+		}},
+	}, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := v.dockerClient.ContainerRemove(context.WithoutCancel(ctx), created.ID, container.RemoveOptions{Force: true}); err != nil {
+			log.Err(err).
+				Str("container_id", created.ID).
+				Msg("error removing volume helper container")
+		}
+	}()
+
+	return fn(created.ID)
+}
+
+// lazyResponseWriter writes the response status with the first chunk.
+type lazyResponseWriter struct {
+	response *echo.Response
+	started  bool
+}
+
+func (w *lazyResponseWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.response.WriteHeader(http.StatusOK)
+	}
+
+	n, err := w.response.Write(p)
+	w.response.Flush()
+	return n, err
+}
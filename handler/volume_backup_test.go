@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+type testTarEntry struct {
+	name string
+	body string
+}
+
+func testTarball(t *testing.T, entries []testTarEntry, compress bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gzipWriter *gzip.Writer
+	if compress {
+		gzipWriter = gzip.NewWriter(&buf)
+		w = gzipWriter
+	}
+
+	tarWriter := tar.NewWriter(w)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(entry.body))}
+		if entry.name[len(entry.name)-1] == '/' {
+			header = &tar.Header{Name: entry.name, Typeflag: tar.TypeDir, Mode: 0755}
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func testBackupManifest(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	manifest := VolumeBackupManifest{Volume: "data", Files: []VolumeBackupFile{}}
+	for name, body := range files {
+		sum := sha256.Sum256([]byte(body))
+		manifest.Files = append(manifest.Files, VolumeBackupFile{Path: name, Size: int64(len(body)), SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+// testVolumeDocker fakes the docker endpoints the volume helpers use. volume
+// is what the helper container mounts, restored is what was copied into it,
+// nil until a restore gets that far.
+type testVolumeDocker struct {
+	volume   []byte
+	restored []byte
+}
+
+func newTestVolume(t *testing.T, docker *testVolumeDocker) *Volume {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/{ref...}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id":"sha256:busybox"}`))
+	})
+	mux.HandleFunc("GET /volumes/{name}", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"Name": r.PathValue("name")})
+	})
+	mux.HandleFunc("POST /containers/create", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id":"helper"}`))
+	})
+	mux.HandleFunc("GET /containers/helper/archive", func(w http.ResponseWriter, r *http.Request) {
+		setPathStat(t, w, types.ContainerPathStat{Name: "volume", Mode: 0755 | 1<<31})
+		w.Write(docker.volume)
+	})
+	mux.HandleFunc("PUT /containers/helper/archive", func(w http.ResponseWriter, r *http.Request) {
+		docker.restored, _ = io.ReadAll(r.Body)
+	})
+	mux.HandleFunc("DELETE /containers/helper", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return NewVolume(newTestDockerClient(t, mux), nil, nil, "busybox:latest")
+}
+
+// tarNames lists the entries of a raw or gzip compressed tarball.
+func tarNames(t *testing.T, raw []byte) []string {
+	t.Helper()
+
+	var r io.Reader = bytes.NewReader(raw)
+	if bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gzipReader
+	}
+
+	names := []string{}
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestVolumeBackupRestoreRoundTrip(t *testing.T) {
+	docker := &testVolumeDocker{volume: testTarball(t, []testTarEntry{
+		{name: "volume/"},
+		{name: "volume/config.yml", body: "listen: 8080\n"},
+		{name: "volume/data/"},
+		{name: "volume/data/rows.csv", body: "1,2,3\n"},
+	}, false)}
+	volume := newTestVolume(t, docker)
+
+	var backup bytes.Buffer
+	manifest, err := volume.backup(context.Background(), "data", &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 2 || manifest.Size != int64(len("listen: 8080\n")+len("1,2,3\n")) {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	// Entries are stored relative to the volume root, the manifest last.
+	wantNames := []string{volumeBackupManifestName, "config.yml", "data/", "data/rows.csv"}
+	if names := tarNames(t, backup.Bytes()); !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("backup entries = %v, want %v", names, wantNames)
+	}
+
+	result, err := volume.restore(context.Background(), "data", &backup, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Verified || result.Files != 2 || result.Created {
+		t.Errorf("result = %+v, want 2 verified files", result)
+	}
+
+	// The manifest is checked, not restored.
+	wantNames = []string{"config.yml", "data/", "data/rows.csv"}
+	if names := tarNames(t, docker.restored); !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("restored entries = %v, want %v", names, wantNames)
+	}
+}
+
+func TestVolumeRestoreVerifiesManifest(t *testing.T) {
+	tests := []struct {
+		name         string
+		entries      []testTarEntry
+		wantErr      error
+		wantVerified bool
+	}{
+		{
+			name: "matching checksums",
+			entries: []testTarEntry{
+				{name: "a.txt", body: "alpha"},
+				{name: volumeBackupManifestName, body: testBackupManifest(t, map[string]string{"a.txt": "alpha"})},
+			},
+			wantVerified: true,
+		},
+		{
+			name: "tampered file",
+			entries: []testTarEntry{
+				{name: "a.txt", body: "alphA"},
+				{name: volumeBackupManifestName, body: testBackupManifest(t, map[string]string{"a.txt": "alpha"})},
+			},
+			wantErr: ErrVolumeBackupChecksum,
+		},
+		{
+			name: "missing file",
+			entries: []testTarEntry{
+				{name: "a.txt", body: "alpha"},
+				{name: volumeBackupManifestName, body: testBackupManifest(t, map[string]string{"a.txt": "alpha", "b.txt": "beta"})},
+			},
+			wantErr: ErrVolumeBackupChecksum,
+		},
+		{
+			name: "extra file",
+			entries: []testTarEntry{
+				{name: "a.txt", body: "alpha"},
+				{name: "b.txt", body: "beta"},
+				{name: volumeBackupManifestName, body: testBackupManifest(t, map[string]string{"a.txt": "alpha"})},
+			},
+			wantErr: ErrVolumeBackupChecksum,
+		},
+		{
+			name: "unreadable manifest",
+			entries: []testTarEntry{
+				{name: "a.txt", body: "alpha"},
+				{name: volumeBackupManifestName, body: "{"},
+			},
+			wantErr: ErrVolumeBackupChecksum,
+		},
+		{
+			name:    "no manifest",
+			entries: []testTarEntry{{name: "a.txt", body: "alpha"}},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, compress := range []bool{false, true} {
+			docker := &testVolumeDocker{}
+			volume := newTestVolume(t, docker)
+
+			result, err := volume.restore(context.Background(), "data", bytes.NewReader(testTarball(t, tt.entries, compress)), false)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s (gzip %t): error = %v, want %v", tt.name, compress, err, tt.wantErr)
+				continue
+			}
+			if tt.wantErr != nil {
+				if docker.restored != nil {
+					t.Errorf("%s (gzip %t): content was copied into the volume", tt.name, compress)
+				}
+				continue
+			}
+			if result.Verified != tt.wantVerified || docker.restored == nil {
+				t.Errorf("%s (gzip %t): result = %+v, restored %t", tt.name, compress, result, docker.restored != nil)
+			}
+		}
+	}
+}
+
+func TestVolumeRestoreRejectsEscapingPaths(t *testing.T) {
+	for _, name := range []string{"../escape", "/etc/cron.d/job", "data/../../escape", ".."} {
+		docker := &testVolumeDocker{}
+		volume := newTestVolume(t, docker)
+
+		entries := []testTarEntry{{name: "ok.txt", body: "fine"}, {name: name, body: "payload"}}
+		_, err := volume.restore(context.Background(), "data", bytes.NewReader(testTarball(t, entries, true)), false)
+		if !errors.Is(err, ErrInvalidContainerPath) {
+			t.Errorf("restore with entry %q: error = %v, want %v", name, err, ErrInvalidContainerPath)
+		}
+		if docker.restored != nil {
+			t.Errorf("restore with entry %q copied content into the volume", name)
+		}
+	}
+}
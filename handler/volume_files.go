@@ -0,0 +1,467 @@
+package handler
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultVolumeFilesLimit = 1000
+	maxVolumeFilesLimit     = 10000
+	maxHelperOutput         = 8 << 20
+)
+
+var (
+	ErrVolumeNotFound    = errors.New("volume not found")
+	ErrVolumePathMissing = errors.New("path not found in volume")
+	ErrVolumeRootPath    = errors.New("the volume root cannot be changed")
+)
+
+// VolumeFile describes a file of a volume, paths are relative to the volume
+// root and start with `/`.
+type VolumeFile struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"`
+	IsDir      bool      `json:"is_dir"`
+	Mtime      time.Time `json:"mtime"`
+	LinkTarget string    `json:"link_target,omitempty"`
+}
+
+// helperOutput keeps the first maxHelperOutput bytes written to it.
+type helperOutput struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (o *helperOutput) Write(p []byte) (int, error) {
+	if room := maxHelperOutput - o.Len(); len(p) > room {
+		o.truncated = true
+		o.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+
+	return o.Buffer.Write(p)
+}
+
+// volumeFilePath validates a path relative to the volume root, returning it
+// cleaned along with where it is found in the helper container. The helper
+// container confines symlinks, the worst they can reach is its own image.
+func volumeFilePath(p string) (string, string, error) {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	cleaned, err := validateContainerPath(p)
+	if err != nil {
+		return "", "", err
+	}
+
+	return cleaned, path.Join(volumeHelperMountPoint, cleaned), nil
+}
+
+func newVolumeFile(relPath string, stat types.ContainerPathStat) VolumeFile {
+	file := VolumeFile{
+		Name:       path.Base(relPath),
+		Path:       relPath,
+		Size:       stat.Size,
+		Mode:       stat.Mode.String(),
+		IsDir:      stat.Mode.IsDir(),
+		Mtime:      stat.Mtime.UTC(),
+		LinkTarget: stat.LinkTarget,
+	}
+	if relPath == "/" {
+		file.Name = "/"
+	}
+	if target, found := strings.CutPrefix(stat.LinkTarget, volumeHelperMountPoint+"/"); found {
+		file.LinkTarget = "/" + target
+	}
+
+	return file
+}
+
+// ListFiles lists the directory given as `path`, the volume root by default,
+// sorted by name. At most `limit` entries are returned.
+func (v *Volume) ListFiles(c echo.Context) error {
+	relPath, fullPath, err := volumeFilePath(c.QueryParam("path"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("path must not contain `..`"))
+	}
+
+	limit := defaultVolumeFilesLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxVolumeFilesLimit {
+			return c.JSON(http.StatusBadRequest, BadRequestResponseBody("limit must be a number between 1 and "+strconv.Itoa(maxVolumeFilesLimit)))
+		}
+	}
+
+	ctx := c.Request().Context()
+	files := []VolumeFile{}
+	truncated := false
+
+	cmd := []string{"find", fullPath, "-mindepth", "1", "-maxdepth", "1", "-print0"}
+	err = v.withVolumeHelper(ctx, c.Param("name"), true, cmd, func(containerID string) error {
+		stat, err := v.statPath(ctx, containerID, fullPath)
+		if err != nil {
+			return err
+		}
+		if !stat.Mode.IsDir() {
+			return fmt.Errorf("%w: %s is not a directory", ErrInvalidContainerPath, relPath)
+		}
+
+		stdout, _, err := v.runHelper(ctx, containerID)
+		if err != nil {
+			return err
+		}
+		truncated = stdout.truncated
+
+		names := []string{}
+		for _, entry := range strings.Split(stdout.String(), "\x00") {
+			if name := path.Base(entry); entry != "" && name != "." && name != "/" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if len(names) > limit {
+			names = names[:limit]
+			truncated = true
+		}
+
+		for _, name := range names {
+			stat, err := v.dockerClient.ContainerStatPath(ctx, containerID, path.Join(fullPath, name))
+			if err != nil {
+				// Removed since it was listed.
+				if errdefs.IsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			files = append(files, newVolumeFile(path.Join(relPath, name), stat))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return v.volumeFilesError(c, err, relPath)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": files,
+		"meta": map[string]any{
+			"path":      relPath,
+			"count":     len(files),
+			"truncated": truncated,
+		},
+	})
+}
+
+// StatFile describes the file given as `path`.
+func (v *Volume) StatFile(c echo.Context) error {
+	relPath, fullPath, err := volumeFilePath(c.QueryParam("path"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("path must not contain `..`"))
+	}
+
+	var file VolumeFile
+	err = v.withVolumeHelper(c.Request().Context(), c.Param("name"), true, []string{"true"}, func(containerID string) error {
+		stat, err := v.statPath(c.Request().Context(), containerID, fullPath)
+		file = newVolumeFile(relPath, stat)
+		return err
+	})
+	if err != nil {
+		return v.volumeFilesError(c, err, relPath)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": file,
+	})
+}
+
+// DownloadFile returns the content of the regular file given as `path`.
+func (v *Volume) DownloadFile(c echo.Context) error {
+	relPath, fullPath, err := volumeFilePath(c.QueryParam("path"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("path must not contain `..`"))
+	}
+
+	ctx := c.Request().Context()
+	err = v.withVolumeHelper(ctx, c.Param("name"), true, []string{"true"}, func(containerID string) error {
+		stat, err := v.statPath(ctx, containerID, fullPath)
+		if err != nil {
+			return err
+		}
+		if !stat.Mode.IsRegular() {
+			return fmt.Errorf("%w: %s is not a regular file", ErrInvalidContainerPath, relPath)
+		}
+		if stat.Size > MaxArchiveTransferSize {
+			return ErrArchiveTooLarge
+		}
+
+		rc, _, err := v.dockerClient.CopyFromContainer(ctx, containerID, fullPath)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		tarReader := tar.NewReader(rc)
+		header, err := tarReader.Next()
+		if err != nil {
+			return err
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(stat.Name))
+		if contentType == "" {
+			contentType = echo.MIMEOctetStream
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(header.Size, 10))
+		c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": stat.Name}))
+		c.Response().WriteHeader(http.StatusOK)
+
+		if _, err := io.Copy(c.Response(), tarReader); err != nil {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("volume").Str("files").Str("stream")).
+				Str("path", relPath).
+				Msg("error streaming file from volume")
+		}
+		return nil
+	})
+	if err != nil {
+		return v.volumeFilesError(c, err, relPath)
+	}
+
+	return nil
+}
+
+// UploadFile writes the body to the file given as `path`, replacing it and
+// creating missing parent directories. Needs the volumes:write scope.
+func (v *Volume) UploadFile(c echo.Context) error {
+	relPath, _, err := volumeFilePath(c.QueryParam("path"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("path must not contain `..`"))
+	}
+	if relPath == "/" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(ErrVolumeRootPath.Error()))
+	}
+
+	// Spool the body first so oversized uploads are rejected before anything
+	// is written into the volume.
+	spool, err := os.CreateTemp("", "cconnector-volume-file-*")
+	if err != nil {
+		log.Err(err).Msg("error creating spool file")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, io.LimitReader(c.Request().Body, MaxArchiveTransferSize+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("failed to read request body"))
+	}
+	if size > MaxArchiveTransferSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, PayloadTooLargeResponseBody(ErrArchiveTooLarge.Error()))
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	err = v.writeVolumeEntry(c.Request().Context(), c.Param("name"), &tar.Header{
+		Name:     strings.TrimPrefix(relPath, "/"),
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}, spool)
+	if err != nil {
+		return v.volumeFilesError(c, err, relPath)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "File written successfully",
+		"path":    relPath,
+		"size":    size,
+	})
+}
+
+// CreateDirectory creates the directory given as `path` along with its
+// missing parents. Needs the volumes:write scope.
+func (v *Volume) CreateDirectory(c echo.Context) error {
+	relPath, _, err := volumeFilePath(c.QueryParam("path"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("path must not contain `..`"))
+	}
+	if relPath == "/" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(ErrVolumeRootPath.Error()))
+	}
+
+	err = v.writeVolumeEntry(c.Request().Context(), c.Param("name"), &tar.Header{
+		Name:     strings.TrimPrefix(relPath, "/") + "/",
+		Mode:     0755,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeDir,
+	}, nil)
+	if err != nil {
+		return v.volumeFilesError(c, err, relPath)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Directory created successfully",
+		"path":    relPath,
+	})
+}
+
+// DeleteFile removes the file or empty directory given as `path`, non-empty
+// directories too with `recursive=true`. Needs the volumes:write scope.
+func (v *Volume) DeleteFile(c echo.Context) error {
+	relPath, fullPath, err := volumeFilePath(c.QueryParam("path"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody("path must not contain `..`"))
+	}
+	if relPath == "/" {
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(ErrVolumeRootPath.Error()))
+	}
+
+	cmd := []string{"sh", "-c", `if [ -d "$1" ] && [ ! -L "$1" ]; then rmdir -- "$1"; else rm -f -- "$1"; fi`, "sh", fullPath}
+	if c.QueryParam("recursive") == "true" {
+		cmd = []string{"rm", "-rf", "--", fullPath}
+	}
+
+	ctx := c.Request().Context()
+	err = v.withVolumeHelper(ctx, c.Param("name"), false, cmd, func(containerID string) error {
+		if _, err := v.statPath(ctx, containerID, fullPath); err != nil {
+			return err
+		}
+
+		_, stderr, err := v.runHelper(ctx, containerID)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	})
+	if err != nil {
+		return v.volumeFilesError(c, err, relPath)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Path removed successfully",
+		"path":    relPath,
+	})
+}
+
+// writeVolumeEntry extracts a single tar entry at the volume root, docker
+// creates the missing parent directories.
+func (v *Volume) writeVolumeEntry(ctx context.Context, volumeName string, header *tar.Header, content io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		tarWriter := tar.NewWriter(pw)
+		err := tarWriter.WriteHeader(header)
+		if err == nil && content != nil {
+			_, err = io.Copy(tarWriter, content)
+		}
+		if err == nil {
+			err = tarWriter.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	return v.withVolumeHelper(ctx, volumeName, false, []string{"true"}, func(containerID string) error {
+		return v.dockerClient.CopyToContainer(ctx, containerID, volumeHelperMountPoint, pr, types.CopyToContainerOptions{})
+	})
+}
+
+// withVolumeHelper is withHelper for an existing volume only, as mounting a
+// missing one would create it.
+func (v *Volume) withVolumeHelper(ctx context.Context, volumeName string, readOnly bool, cmd []string, fn func(containerID string) error) error {
+	if _, err := v.dockerClient.VolumeInspect(ctx, volumeName); err != nil {
+		if errdefs.IsNotFound(err) {
+			return ErrVolumeNotFound
+		}
+		return err
+	}
+
+	return v.withHelper(ctx, volumeName, readOnly, cmd, fn)
+}
+
+func (v *Volume) statPath(ctx context.Context, containerID, fullPath string) (types.ContainerPathStat, error) {
+	stat, err := v.dockerClient.ContainerStatPath(ctx, containerID, fullPath)
+	if errdefs.IsNotFound(err) {
+		return stat, ErrVolumePathMissing
+	}
+
+	return stat, err
+}
+
+// runHelper starts the helper container and waits for its command, failing
+// when it exits with a non-zero code.
+func (v *Volume) runHelper(ctx context.Context, containerID string) (*helperOutput, *helperOutput, error) {
+	stdout, stderr := &helperOutput{}, &helperOutput{}
+
+	attached, err := v.dockerClient.ContainerAttach(ctx, containerID, container.AttachOptions{Stream: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return stdout, stderr, err
+	}
+	defer attached.Close()
+
+	if err := v.dockerClient.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+		return stdout, stderr, err
+	}
+	if _, err := stdcopy.StdCopy(stdout, stderr, attached.Reader); err != nil {
+		return stdout, stderr, err
+	}
+
+	statusCh, errCh := v.dockerClient.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return stdout, stderr, err
+	case status := <-statusCh:
+		if status.StatusCode != 0 {
+			return stdout, stderr, fmt.Errorf("helper exited with code %d", status.StatusCode)
+		}
+	}
+
+	return stdout, stderr, nil
+}
+
+func (v *Volume) volumeFilesError(c echo.Context, err error, relPath string) error {
+	switch {
+	case errors.Is(err, ErrVolumeNotFound):
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody(ErrVolumeNotFound.Error()))
+	case errors.Is(err, ErrVolumePathMissing):
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody(ErrVolumePathMissing.Error()))
+	case errors.Is(err, ErrInvalidContainerPath):
+		return c.JSON(http.StatusBadRequest, BadRequestResponseBody(err.Error()))
+	case errors.Is(err, ErrArchiveTooLarge):
+		return c.JSON(http.StatusRequestEntityTooLarge, PayloadTooLargeResponseBody(err.Error()))
+	}
+
+	log.Err(err).
+		Array("tags", zerolog.Arr().Str("volume").Str("files")).
+		Str("volume", c.Param("name")).
+		Str("path", relPath).
+		Msg("error accessing volume files")
+	return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+}
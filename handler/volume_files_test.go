@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestVolumeFilePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		wantRel  string
+		wantFull string
+		wantErr  bool
+	}{
+		{path: "", wantRel: "/", wantFull: "/volume"},
+		{path: "/", wantRel: "/", wantFull: "/volume"},
+		{path: "config/app.yml", wantRel: "/config/app.yml", wantFull: "/volume/config/app.yml"},
+		{path: "/config//app.yml/", wantRel: "/config/app.yml", wantFull: "/volume/config/app.yml"},
+		{path: "./config", wantRel: "/config", wantFull: "/volume/config"},
+		{path: "..", wantErr: true},
+		{path: "../etc/passwd", wantErr: true},
+		{path: "/config/../../etc/passwd", wantErr: true},
+		{path: "config/..", wantErr: true},
+		{path: "config\x00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		rel, full, err := volumeFilePath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("volumeFilePath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if rel != tt.wantRel || full != tt.wantFull {
+			t.Errorf("volumeFilePath(%q) = %q, %q, want %q, %q", tt.path, rel, full, tt.wantRel, tt.wantFull)
+		}
+	}
+}
+
+func TestVolumeFilesRejectTraversalBeforeDocker(t *testing.T) {
+	calls := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	volume := NewVolume(newTestDockerClient(t, mux), nil, nil, "busybox:latest")
+
+	tests := []struct {
+		method  string
+		handler echo.HandlerFunc
+		path    string
+	}{
+		{method: http.MethodGet, handler: volume.ListFiles, path: "../.."},
+		{method: http.MethodGet, handler: volume.DownloadFile, path: "../../etc/shadow"},
+		{method: http.MethodPut, handler: volume.UploadFile, path: "data/../../escape"},
+		{method: http.MethodPost, handler: volume.CreateDirectory, path: "../escape"},
+		{method: http.MethodDelete, handler: volume.DeleteFile, path: "../escape"},
+		{method: http.MethodDelete, handler: volume.DeleteFile, path: "/"},
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(tt.method, "/volumes/data/files?path="+url.QueryEscape(tt.path), nil), recorder)
+		c.SetParamNames("name")
+		c.SetParamValues("data")
+
+		if err := tt.handler(c); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s %q: status = %d, want %d", tt.method, tt.path, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	if len(calls) != 0 {
+		t.Errorf("docker calls = %v, want none", calls)
+	}
+}
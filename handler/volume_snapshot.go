@@ -0,0 +1,686 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// maxVolumeSnapshotHistory caps the failed and pruned snapshots kept in the
+// history, restore points are always kept.
+const maxVolumeSnapshotHistory = 500
+
+var (
+	ErrVolumeSnapshotRunning   = errors.New("a snapshot of this policy is already running")
+	ErrVolumeSnapshotNotFound  = errors.New("snapshot not found")
+	ErrVolumeSnapshotNoRestore = errors.New("snapshot is not a restore point")
+	ErrVolumeSnapshotChecksum  = errors.New("snapshot content does not match its checksum")
+)
+
+type VolumeSnapshotPolicy struct {
+	Name            string
+	Schedule        string           // Cron expression, see ParseCronSchedule
+	Volumes         []string         // Volume names
+	Selector        string           // Label selector of the volumes, e.g. `backup=true`
+	Dir             string           // Local directory snapshots are written to, when S3 is nil
+	S3              *S3TargetOptions // S3-compatible bucket snapshots are written to
+	KeepDaily       int              // Newest snapshot kept for each of the last KeepDaily days having one
+	KeepWeekly      int              // Same per ISO week
+	KeepMonthly     int              // Same per month
+	PauseContainers bool             // Pause the running containers mounting a volume while it is read
+}
+
+type volumeSnapshotPolicy struct {
+	VolumeSnapshotPolicy
+	schedule *CronSchedule
+	selector LabelSelector
+	target   snapshotTarget
+	running  sync.Mutex
+	nextRun  time.Time
+}
+
+// VolumeSnapshot is one entry of the snapshot history. Successful snapshots
+// not pruned yet are restore points.
+type VolumeSnapshot struct {
+	ID               string     `json:"id"`
+	Policy           string     `json:"policy"`
+	Volume           string     `json:"volume"`
+	Trigger          string     `json:"trigger"` // schedule or manual
+	Target           string     `json:"target"`
+	Key              string     `json:"key,omitempty"` // Location of the tarball in the target
+	CreatedAt        time.Time  `json:"created_at"`
+	Duration         float64    `json:"duration_seconds"`
+	Size             int64      `json:"size"`      // Size of the compressed tarball
+	DataSize         int64      `json:"data_size"` // Size of the files it holds
+	Files            int        `json:"files"`
+	SHA256           string     `json:"sha256,omitempty"` // Checksum of the compressed tarball
+	PausedContainers []string   `json:"paused_containers,omitempty"`
+	Error            string     `json:"error,omitempty"`
+	PrunedAt         *time.Time `json:"pruned_at,omitempty"`
+}
+
+func (s VolumeSnapshot) restorable() bool {
+	return s.Error == "" && s.PrunedAt == nil
+}
+
+// VolumeSnapshots takes snapshots of the volumes selected by each policy on
+// its cron schedule, then prunes the ones its retention rules let go.
+// Snapshots are tarballs as produced by Volume.Backup.
+type VolumeSnapshots struct {
+	volume   *Volume
+	jobs     *Jobs
+	policies []*volumeSnapshotPolicy
+	path     string
+
+	mu sync.Mutex
+}
+
+func NewVolumeSnapshots(volume *Volume, jobs *Jobs, policies []VolumeSnapshotPolicy, dataDir string) (*VolumeSnapshots, error) {
+	snapshots := &VolumeSnapshots{
+		volume: volume,
+		jobs:   jobs,
+		path:   filepath.Join(dataDir, "volume_snapshots.json"),
+	}
+
+	names := map[string]bool{}
+	for _, options := range policies {
+		if options.Name == "" || names[options.Name] {
+			return nil, fmt.Errorf("snapshot policy names must be unique and not empty, got %q", options.Name)
+		}
+		names[options.Name] = true
+
+		policy := &volumeSnapshotPolicy{VolumeSnapshotPolicy: options}
+
+		var err error
+		if policy.schedule, err = ParseCronSchedule(options.Schedule); err != nil {
+			return nil, fmt.Errorf("snapshot policy %s: %w", options.Name, err)
+		}
+		if policy.selector, err = ParseLabelSelector(options.Selector); err != nil {
+			return nil, fmt.Errorf("snapshot policy %s: %w", options.Name, err)
+		}
+		if len(options.Volumes) == 0 && policy.selector.Empty() {
+			return nil, fmt.Errorf("snapshot policy %s: volumes or selector must be set", options.Name)
+		}
+
+		switch {
+		case options.S3 != nil:
+			if policy.target, err = newS3SnapshotTarget(*options.S3); err != nil {
+				return nil, fmt.Errorf("snapshot policy %s: %w", options.Name, err)
+			}
+		case options.Dir != "":
+			policy.target = &localSnapshotTarget{dir: options.Dir}
+		default:
+			return nil, fmt.Errorf("snapshot policy %s: dir or s3 must be set", options.Name)
+		}
+
+		snapshots.policies = append(snapshots.policies, policy)
+	}
+
+	return snapshots, nil
+}
+
+// Run schedules every policy until ctx is done.
+func (s *VolumeSnapshots) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, policy := range s.policies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.schedule(ctx, policy)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *VolumeSnapshots) schedule(ctx context.Context, policy *volumeSnapshotPolicy) {
+	for {
+		next := policy.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Warn().
+				Array("tags", zerolog.Arr().Str("volume_snapshot").Str("schedule")).
+				Str("policy", policy.Name).
+				Msg("snapshot schedule never matches")
+			return
+		}
+
+		s.mu.Lock()
+		policy.nextRun = next
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if _, err := s.snapshotPolicy(ctx, policy, "schedule", nil); err != nil {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("volume_snapshot").Str("schedule")).
+				Str("policy", policy.Name).
+				Msg("error running snapshot policy")
+		}
+	}
+}
+
+// snapshotPolicy snapshots every volume of the policy then applies its
+// retention rules. Failed snapshots are recorded, not returned as errors.
+func (s *VolumeSnapshots) snapshotPolicy(ctx context.Context, policy *volumeSnapshotPolicy, trigger string, job *Job) ([]VolumeSnapshot, error) {
+	if !policy.running.TryLock() {
+		return nil, ErrVolumeSnapshotRunning
+	}
+	defer policy.running.Unlock()
+
+	volumeNames, err := s.policyVolumes(ctx, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := []VolumeSnapshot{}
+	for _, volumeName := range volumeNames {
+		snapshot := s.snapshotVolume(ctx, policy, volumeName, trigger)
+		if err := s.record(snapshot); err != nil {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("volume_snapshot").Str("record")).
+				Msg("error persisting volume snapshot")
+		}
+		taken = append(taken, snapshot)
+
+		if job != nil {
+			if raw, err := json.Marshal(snapshot); err == nil {
+				job.AddProgress(raw)
+			}
+		}
+	}
+
+	if err := s.prune(ctx, policy); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("volume_snapshot").Str("prune")).
+			Str("policy", policy.Name).
+			Msg("error pruning volume snapshots")
+	}
+
+	return taken, nil
+}
+
+// policyVolumes lists the volumes selected by name or label. Volumes named but
+// missing are kept so their failure shows up in the history.
+func (s *VolumeSnapshots) policyVolumes(ctx context.Context, policy *volumeSnapshotPolicy) ([]string, error) {
+	volumes, err := s.volume.dockerClient.VolumeList(ctx, volume.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	for _, name := range policy.Volumes {
+		selected[name] = true
+	}
+	if !policy.selector.Empty() {
+		for _, vol := range volumes.Volumes {
+			if policy.selector.Matches(vol.Labels) {
+				selected[vol.Name] = true
+			}
+		}
+	}
+
+	return sortedKeys(selected), nil
+}
+
+func (s *VolumeSnapshots) snapshotVolume(ctx context.Context, policy *volumeSnapshotPolicy, volumeName, trigger string) VolumeSnapshot {
+	snapshot := VolumeSnapshot{
+		ID:        newRandomID(),
+		Policy:    policy.Name,
+		Volume:    volumeName,
+		Trigger:   trigger,
+		Target:    policy.target.String(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := s.takeSnapshot(ctx, policy, &snapshot); err != nil {
+		snapshot.Error = err.Error()
+		snapshot.Key = ""
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("volume_snapshot").Str("snapshot")).
+			Str("policy", policy.Name).
+			Str("volume", volumeName).
+			Msg("error taking volume snapshot")
+	}
+	snapshot.Duration = time.Since(snapshot.CreatedAt).Round(10 * time.Millisecond).Seconds()
+
+	return snapshot
+}
+
+// takeSnapshot spools the backup tarball, with the containers paused if asked,
+// then uploads it to the target.
+func (s *VolumeSnapshots) takeSnapshot(ctx context.Context, policy *volumeSnapshotPolicy, snapshot *VolumeSnapshot) error {
+	if _, err := s.volume.dockerClient.VolumeInspect(ctx, snapshot.Volume); err != nil {
+		return err
+	}
+
+	spool, err := os.CreateTemp("", "cconnector-volume-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	var paused []string
+	if policy.PauseContainers {
+		paused, err = s.pauseContainers(ctx, snapshot.Volume)
+		snapshot.PausedContainers = paused
+		if err != nil {
+			s.unpauseContainers(ctx, paused)
+			return fmt.Errorf("pausing containers: %w", err)
+		}
+	}
+
+	hash := sha256.New()
+	manifest, err := s.volume.backup(ctx, snapshot.Volume, io.MultiWriter(spool, hash))
+	s.unpauseContainers(ctx, paused)
+	if err != nil {
+		return err
+	}
+	snapshot.Files = len(manifest.Files)
+	snapshot.DataSize = manifest.Size
+	snapshot.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	if snapshot.Size, err = spool.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	snapshot.Key = fmt.Sprintf("%s/%s/%s-%s.tar.gz", policy.Name, snapshot.Volume, snapshot.CreatedAt.Format("20060102T150405Z"), snapshot.ID[:8])
+	return policy.target.Put(ctx, snapshot.Key, spool, snapshot.Size, snapshot.SHA256)
+}
+
+// pauseContainers pauses the running containers mounting the volume. On
+// failure the ones already paused are returned, to be unpaused.
+func (s *VolumeSnapshots) pauseContainers(ctx context.Context, volumeName string) ([]string, error) {
+	containers, err := s.volume.dockerClient.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("volume", volumeName), filters.Arg("status", "running")),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paused := []string{}
+	for _, ctr := range containers {
+		if ctr.Labels[VolumeHelperLabel] != "" {
+			continue
+		}
+		if err := s.volume.dockerClient.ContainerPause(ctx, ctr.ID); err != nil {
+			return paused, err
+		}
+		paused = append(paused, ctr.ID)
+	}
+
+	return paused, nil
+}
+
+func (s *VolumeSnapshots) unpauseContainers(ctx context.Context, containerIDs []string) {
+	for _, containerID := range containerIDs {
+		if err := s.volume.dockerClient.ContainerUnpause(context.WithoutCancel(ctx), containerID); err != nil {
+			log.Err(err).
+				Array("tags", zerolog.Arr().Str("volume_snapshot").Str("unpause")).
+				Str("container_id", containerID).
+				Msg("error unpausing container after snapshot")
+		}
+	}
+}
+
+// prune deletes the restore points of the policy its retention rules do not
+// keep. Without any rule every snapshot is kept.
+func (s *VolumeSnapshots) prune(ctx context.Context, policy *volumeSnapshotPolicy) error {
+	if policy.KeepDaily <= 0 && policy.KeepWeekly <= 0 && policy.KeepMonthly <= 0 {
+		return nil
+	}
+
+	snapshots, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	byVolume := map[string][]VolumeSnapshot{}
+	for _, snapshot := range snapshots {
+		if snapshot.Policy == policy.Name && snapshot.restorable() {
+			byVolume[snapshot.Volume] = append(byVolume[snapshot.Volume], snapshot)
+		}
+	}
+
+	pruned := map[string]time.Time{}
+	for _, volumeSnapshots := range byVolume {
+		kept := retainedSnapshots(volumeSnapshots, policy.KeepDaily, policy.KeepWeekly, policy.KeepMonthly)
+		for _, snapshot := range volumeSnapshots {
+			if kept[snapshot.ID] {
+				continue
+			}
+			if err := policy.target.Delete(ctx, snapshot.Key); err != nil {
+				log.Err(err).
+					Array("tags", zerolog.Arr().Str("volume_snapshot").Str("prune")).
+					Str("snapshot_id", snapshot.ID).
+					Msg("error deleting volume snapshot")
+				continue
+			}
+			pruned[snapshot.ID] = time.Now().UTC()
+		}
+	}
+
+	if len(pruned) == 0 {
+		return nil
+	}
+
+	return s.update(func(snapshots []VolumeSnapshot) []VolumeSnapshot {
+		for i := range snapshots {
+			if prunedAt, ok := pruned[snapshots[i].ID]; ok {
+				snapshots[i].PrunedAt = &prunedAt
+			}
+		}
+		return snapshots
+	})
+}
+
+// retainedSnapshots returns the ids of the snapshots kept: the newest one of
+// each of the last keepDaily days, keepWeekly ISO weeks and keepMonthly months
+// having a snapshot. The newest snapshot is always kept.
+func retainedSnapshots(snapshots []VolumeSnapshot, keepDaily, keepWeekly, keepMonthly int) map[string]bool {
+	sorted := append([]VolumeSnapshot{}, snapshots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreatedAt.After(sorted[j].CreatedAt) })
+
+	kept := map[string]bool{}
+	if len(sorted) > 0 {
+		kept[sorted[0].ID] = true
+	}
+
+	keep := func(limit int, bucket func(time.Time) string) {
+		seen := map[string]bool{}
+		for _, snapshot := range sorted {
+			if len(seen) >= limit {
+				return
+			}
+			key := bucket(snapshot.CreatedAt.Local())
+			if !seen[key] {
+				seen[key] = true
+				kept[snapshot.ID] = true
+			}
+		}
+	}
+	keep(keepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keep(keepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	})
+	keep(keepMonthly, func(t time.Time) string { return t.Format("2006-01") })
+
+	return kept
+}
+
+func (s *VolumeSnapshots) load() ([]VolumeSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots := []VolumeSnapshot{}
+	err := readJSONFile(s.path, &snapshots)
+	return snapshots, err
+}
+
+func (s *VolumeSnapshots) update(fn func([]VolumeSnapshot) []VolumeSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots := []VolumeSnapshot{}
+	if err := readJSONFile(s.path, &snapshots); err != nil {
+		return err
+	}
+	snapshots = fn(snapshots)
+
+	// Drop the oldest failed and pruned snapshots past the cap.
+	stale := 0
+	for _, snapshot := range snapshots {
+		if !snapshot.restorable() {
+			stale++
+		}
+	}
+	trimmed := make([]VolumeSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if !snapshot.restorable() && stale > maxVolumeSnapshotHistory {
+			stale--
+			continue
+		}
+		trimmed = append(trimmed, snapshot)
+	}
+
+	return writeJSONFile(s.path, trimmed)
+}
+
+func (s *VolumeSnapshots) record(snapshot VolumeSnapshot) error {
+	return s.update(func(snapshots []VolumeSnapshot) []VolumeSnapshot {
+		return append(snapshots, snapshot)
+	})
+}
+
+func (s *VolumeSnapshots) policy(name string) *volumeSnapshotPolicy {
+	for _, policy := range s.policies {
+		if policy.Name == name {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+// Policies lists the snapshot policies and when they run next.
+func (s *VolumeSnapshots) Policies(c echo.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := make([]map[string]any, 0, len(s.policies))
+	for _, policy := range s.policies {
+		var nextRun *time.Time
+		if !policy.nextRun.IsZero() {
+			next := policy.nextRun.UTC()
+			nextRun = &next
+		}
+
+		data = append(data, map[string]any{
+			"name":             policy.Name,
+			"schedule":         policy.Schedule,
+			"volumes":          policy.Volumes,
+			"selector":         policy.Selector,
+			"target":           policy.target.String(),
+			"keep_daily":       policy.KeepDaily,
+			"keep_weekly":      policy.KeepWeekly,
+			"keep_monthly":     policy.KeepMonthly,
+			"pause_containers": policy.PauseContainers,
+			"next_run":         nextRun,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+// Trigger runs a policy right away, as a job.
+func (s *VolumeSnapshots) Trigger(c echo.Context) error {
+	policy := s.policy(c.Param("name"))
+	if policy == nil {
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody("snapshot policy not found"))
+	}
+
+	job := s.jobs.Submit("volume_snapshot", func(ctx context.Context, job *Job) (any, error) {
+		return s.snapshotPolicy(ctx, policy, "manual", job)
+	})
+	return s.jobs.Accepted(c, job)
+}
+
+// List returns the snapshot history, newest first, optionally filtered by
+// `volume` and `policy`. Pruned snapshots are left out unless
+// `include_pruned=true`.
+func (s *VolumeSnapshots) List(c echo.Context) error {
+	snapshots, err := s.load()
+	if err != nil {
+		log.Err(err).Msg("error reading volume snapshots")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	data := []VolumeSnapshot{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		switch {
+		case c.QueryParam("volume") != "" && snapshot.Volume != c.QueryParam("volume"):
+		case c.QueryParam("policy") != "" && snapshot.Policy != c.QueryParam("policy"):
+		case snapshot.PrunedAt != nil && c.QueryParam("include_pruned") != "true":
+		default:
+			data = append(data, snapshot)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+// RestorePoints lists the snapshots a volume can be restored from, newest
+// first.
+func (s *VolumeSnapshots) RestorePoints(c echo.Context) error {
+	snapshots, err := s.load()
+	if err != nil {
+		log.Err(err).Msg("error reading volume snapshots")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	data := []VolumeSnapshot{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Volume == c.Param("name") && snapshots[i].restorable() {
+			data = append(data, snapshots[i])
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+// Restore restores a snapshot into its volume, or the one given as `volume`,
+// like Volume.Restore does with an uploaded tarball.
+func (s *VolumeSnapshots) Restore(c echo.Context) error {
+	snapshots, err := s.load()
+	if err != nil {
+		log.Err(err).Msg("error reading volume snapshots")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	var snapshot *VolumeSnapshot
+	for i := range snapshots {
+		if snapshots[i].ID == c.Param("id") {
+			snapshot = &snapshots[i]
+		}
+	}
+	if snapshot == nil {
+		return c.JSON(http.StatusNotFound, NotFoundResponseBody(ErrVolumeSnapshotNotFound.Error()))
+	}
+	if !snapshot.restorable() {
+		return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody(ErrVolumeSnapshotNoRestore.Error()))
+	}
+
+	policy := s.policy(snapshot.Policy)
+	if policy == nil || policy.target.String() != snapshot.Target {
+		return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody("the target of this snapshot is no longer configured"))
+	}
+
+	volumeName := snapshot.Volume
+	if c.QueryParam("volume") != "" {
+		volumeName = c.QueryParam("volume")
+	}
+
+	rc, err := policy.target.Open(c.Request().Context(), snapshot.Key)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return c.JSON(http.StatusNotFound, NotFoundResponseBody("snapshot content is missing from its target"))
+		}
+		log.Err(err).
+			Str("snapshot_id", snapshot.ID).
+			Msg("error opening volume snapshot")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+	defer rc.Close()
+
+	content, err := spoolVerified(rc, snapshot.SHA256)
+	if content != nil {
+		defer os.Remove(content.Name())
+		defer content.Close()
+	}
+	if err != nil {
+		if errors.Is(err, ErrVolumeSnapshotChecksum) {
+			return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody(err.Error()))
+		}
+		log.Err(err).
+			Str("snapshot_id", snapshot.ID).
+			Msg("error reading volume snapshot")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	result, err := s.volume.restore(c.Request().Context(), volumeName, content, c.QueryParam("create") != "false")
+	if err != nil {
+		switch {
+		case errdefs.IsNotFound(err):
+			return c.JSON(http.StatusNotFound, NotFoundResponseBody("volume not found"))
+		case isInvalidBackupError(err):
+			return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody(err.Error()))
+		}
+		log.Err(err).
+			Str("snapshot_id", snapshot.ID).
+			Str("volume", volumeName).
+			Msg("error restoring volume snapshot")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":  "Volume restored successfully",
+		"snapshot": snapshot.ID,
+		"data":     result,
+	})
+}
+
+// spoolVerified copies r to a temporary file, checking it against the sha256
+// recorded when the snapshot was taken, so nothing is restored from a
+// corrupted or tampered object. The file is returned for the caller to
+// remove, even along with an error.
+func spoolVerified(r io.Reader, checksum string) (*os.File, error) {
+	spool, err := os.CreateTemp("", "cconnector-snapshot-restore-*")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(spool, hash), r); err != nil {
+		return spool, err
+	}
+	if checksum != "" && hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return spool, ErrVolumeSnapshotChecksum
+	}
+
+	_, err = spool.Seek(0, io.SeekStart)
+	return spool, err
+}
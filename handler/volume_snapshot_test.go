@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRetainedSnapshots(t *testing.T) {
+	snapshots := func(times ...string) []VolumeSnapshot {
+		list := []VolumeSnapshot{}
+		for _, value := range times {
+			createdAt, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, VolumeSnapshot{ID: value, CreatedAt: createdAt})
+		}
+		return list
+	}
+
+	tests := []struct {
+		name                               string
+		snapshots                          []VolumeSnapshot
+		keepDaily, keepWeekly, keepMonthly int
+		want                               []string
+	}{
+		{
+			name:      "newest of each of the last days",
+			snapshots: snapshots("2024-01-01 10:00", "2024-01-01 22:00", "2024-01-02 10:00", "2024-01-03 10:00", "2024-01-03 04:00", "2024-01-04 10:00"),
+			keepDaily: 3,
+			want:      []string{"2024-01-02 10:00", "2024-01-03 10:00", "2024-01-04 10:00"},
+		},
+		{
+			name:      "days without a snapshot do not count",
+			snapshots: snapshots("2024-01-01 10:00", "2024-01-01 22:00", "2024-01-10 10:00"),
+			keepDaily: 2,
+			want:      []string{"2024-01-01 22:00", "2024-01-10 10:00"},
+		},
+		{
+			// 2024-01-07 is the sunday ending ISO week 1, 2024-01-08 the monday
+			// starting week 2.
+			name:       "newest of each of the last ISO weeks",
+			snapshots:  snapshots("2024-01-07 10:00", "2024-01-08 10:00", "2024-01-14 10:00", "2024-01-15 10:00"),
+			keepWeekly: 2,
+			want:       []string{"2024-01-14 10:00", "2024-01-15 10:00"},
+		},
+		{
+			name:        "newest of each of the last months",
+			snapshots:   snapshots("2023-12-31 10:00", "2024-01-31 10:00", "2024-02-01 10:00", "2024-02-15 10:00", "2024-03-10 10:00"),
+			keepMonthly: 2,
+			want:        []string{"2024-02-15 10:00", "2024-03-10 10:00"},
+		},
+		{
+			name:        "policies add up",
+			snapshots:   snapshots("2023-11-20 10:00", "2023-12-31 10:00", "2024-01-10 10:00", "2024-01-30 10:00", "2024-01-31 10:00"),
+			keepDaily:   2,
+			keepWeekly:  1,
+			keepMonthly: 3,
+			want:        []string{"2023-11-20 10:00", "2023-12-31 10:00", "2024-01-30 10:00", "2024-01-31 10:00"},
+		},
+		{
+			name:      "the newest is always kept",
+			snapshots: snapshots("2024-01-01 10:00", "2024-01-02 10:00"),
+			want:      []string{"2024-01-02 10:00"},
+		},
+		{
+			name:      "no snapshot",
+			snapshots: snapshots(),
+			keepDaily: 7,
+			want:      []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		kept := retainedSnapshots(tt.snapshots, tt.keepDaily, tt.keepWeekly, tt.keepMonthly)
+
+		got := []string{}
+		for id := range kept {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVolumeSnapshotsRestore(t *testing.T) {
+	valid := testTarball(t, []testTarEntry{{name: "a.txt", body: "alpha"}}, true)
+	escaping := testTarball(t, []testTarEntry{{name: "../escape", body: "payload"}}, true)
+	checksum := func(raw []byte) string {
+		sum := sha256.Sum256(raw)
+		return hex.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		name     string
+		stored   []byte // Object in the target, nil when missing
+		checksum string // Recorded when the snapshot was taken
+		want     int
+	}{
+		{name: "intact", stored: valid, checksum: checksum(valid), want: http.StatusOK},
+		{name: "tampered object", stored: append(append([]byte{}, valid[:len(valid)-1]...), valid[len(valid)-1]^0xff), checksum: checksum(valid), want: http.StatusUnprocessableEntity},
+		{name: "truncated object", stored: valid[:len(valid)/2], checksum: checksum(valid), want: http.StatusUnprocessableEntity},
+		{name: "missing object", checksum: checksum(valid), want: http.StatusNotFound},
+		// Matching checksums, the content itself is rejected like an upload.
+		{name: "not a tarball", stored: []byte{0x1f, 0x8b, 0, 0}, checksum: checksum([]byte{0x1f, 0x8b, 0, 0}), want: http.StatusUnprocessableEntity},
+		{name: "escaping path", stored: escaping, checksum: checksum(escaping), want: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			docker := &testVolumeDocker{}
+			snapshots, err := NewVolumeSnapshots(newTestVolume(t, docker), nil, []VolumeSnapshotPolicy{
+				{Name: "nightly", Schedule: "@daily", Volumes: []string{"data"}, Dir: dir},
+			}, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.stored != nil {
+				if err := os.WriteFile(filepath.Join(dir, "data.tar.gz"), tt.stored, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := snapshots.record(VolumeSnapshot{
+				ID:     "snap-1",
+				Policy: "nightly",
+				Volume: "data",
+				Target: "dir:" + dir,
+				Key:    "data.tar.gz",
+				SHA256: tt.checksum,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), recorder)
+			c.SetParamNames("id")
+			c.SetParamValues("snap-1")
+			if err := snapshots.Restore(c); err != nil {
+				t.Fatal(err)
+			}
+
+			if recorder.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.want, recorder.Body)
+			}
+			if restored := docker.restored != nil; restored != (tt.want == http.StatusOK) {
+				t.Errorf("content copied into the volume: %t", restored)
+			}
+		})
+	}
+}
@@ -0,0 +1,457 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/insomnius/agent/entity"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	WebhookSignatureHeader = "X-Cconnector-Signature"
+	WebhookTimestampHeader = "X-Cconnector-Timestamp"
+	WebhookEventHeader     = "X-Cconnector-Event"
+	WebhookDeliveryHeader  = "X-Cconnector-Delivery"
+
+	webhookWorkers        = 4
+	webhookMaxAttempts    = 5
+	webhookRequeuePeriod  = time.Minute
+	webhookMaxQueueLength = 1000
+
+	// Queued deliveries still failing after this long are given up on.
+	webhookQueueRetention = 24 * time.Hour
+)
+
+var (
+	webhookBackoffBase = time.Second
+	webhookBackoffMax  = time.Minute
+)
+
+var ErrManagerTokenNotSet = errors.New("manager token is not set")
+
+// WebhookPayload is the json body posted to webhook endpoints.
+type WebhookPayload struct {
+	DeliveryID string          `json:"delivery_id"`
+	Webhook    string          `json:"webhook"`
+	Event      NormalizedEvent `json:"event"`
+}
+
+type WebhookDelivery struct {
+	Payload   WebhookPayload `json:"payload"`
+	URL       string         `json:"url"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error,omitempty"`
+	QueuedAt  time.Time      `json:"queued_at,omitempty"` // When it was first queued
+
+	queued bool // Read back from the queue, removed from it once delivered
+}
+
+// webhookQueue persists undeliverable payloads as a json file. Entries stay
+// in the file while they are retried, until delivered or given up on.
+type webhookQueue struct {
+	path string
+	mu   sync.Mutex
+}
+
+// push adds the delivery, or updates it when it is already queued.
+func (q *webhookQueue) push(delivery WebhookDelivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	if err := readJSONFile(q.path, &deliveries); err != nil {
+		return err
+	}
+
+	found := false
+	for i := range deliveries {
+		if deliveries[i].Payload.DeliveryID == delivery.Payload.DeliveryID {
+			deliveries[i] = delivery
+			found = true
+		}
+	}
+	if !found {
+		deliveries = append(deliveries, delivery)
+	}
+	if len(deliveries) > webhookMaxQueueLength {
+		deliveries = deliveries[len(deliveries)-webhookMaxQueueLength:]
+	}
+
+	return writeJSONFile(q.path, deliveries)
+}
+
+func (q *webhookQueue) remove(deliveryID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	if err := readJSONFile(q.path, &deliveries); err != nil {
+		return err
+	}
+
+	kept := []WebhookDelivery{}
+	for _, delivery := range deliveries {
+		if delivery.Payload.DeliveryID != deliveryID {
+			kept = append(kept, delivery)
+		}
+	}
+	if len(kept) == len(deliveries) {
+		return nil
+	}
+
+	return writeJSONFile(q.path, kept)
+}
+
+func (q *webhookQueue) list() ([]WebhookDelivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	return deliveries, readJSONFile(q.path, &deliveries)
+}
+
+// Webhook pushes docker events to the configured webhook endpoints. Payloads
+// are signed with an HMAC-SHA256 keyed by the manager token.
+type Webhook struct {
+	dockerClient      *client.Client
+	endpoints         []entity.WebhookConfig
+	getConfigFunction func() (*entity.CconnectorConfig, error)
+	httpClient        *http.Client
+	queue             *webhookQueue
+	deliveries        chan WebhookDelivery
+	running           atomic.Bool
+
+	// Queued deliveries handed to the workers, not requeued again meanwhile.
+	inFlightMu sync.Mutex
+	inFlight   map[string]bool
+}
+
+func NewWebhook(dockerClient *client.Client, endpoints []entity.WebhookConfig, getConfigFunction func() (*entity.CconnectorConfig, error), dataDir string) *Webhook {
+	return &Webhook{
+		dockerClient:      dockerClient,
+		endpoints:         endpoints,
+		getConfigFunction: getConfigFunction,
+		httpClient:        &http.Client{Timeout: 10 * time.Second},
+		queue:             &webhookQueue{path: filepath.Join(dataDir, "webhook_queue.json")},
+		deliveries:        make(chan WebhookDelivery, 256),
+		inFlight:          map[string]bool{},
+	}
+}
+
+// Run follows docker events and delivers them until ctx is done.
+func (w *Webhook) Run(ctx context.Context) {
+	w.running.Store(true)
+	defer w.running.Store(false)
+
+	for i := 0; i < webhookWorkers; i++ {
+		go w.work(ctx)
+	}
+
+	go func() {
+		requeue := time.NewTicker(webhookRequeuePeriod)
+		defer requeue.Stop()
+
+		// Deliveries left over by the previous run are retried right away.
+		w.requeue(ctx)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-requeue.C:
+				w.requeue(ctx)
+			}
+		}
+	}()
+
+	followDockerEvents(ctx, w.dockerClient, filters.NewArgs(), func(message events.Message) {
+		event := normalizeEvent(message)
+
+		for _, endpoint := range w.endpoints {
+			if !webhookMatches(endpoint.Events, event) {
+				continue
+			}
+
+			delivery := WebhookDelivery{
+				URL: endpoint.URL,
+				Payload: WebhookPayload{
+					DeliveryID: newRandomID(),
+					Webhook:    endpoint.Name,
+					Event:      event,
+				},
+			}
+
+			select {
+			case w.deliveries <- delivery:
+			default:
+				w.enqueue(delivery, errors.New("delivery buffer is full"))
+			}
+		}
+	})
+}
+
+func (w *Webhook) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery := <-w.deliveries:
+			w.deliver(ctx, delivery)
+		}
+	}
+}
+
+// deliver posts the payload, retrying with exponential backoff. Deliveries
+// that keep failing are moved to the persistent queue.
+func (w *Webhook) deliver(ctx context.Context, delivery WebhookDelivery) {
+	if delivery.queued {
+		defer func() {
+			w.inFlightMu.Lock()
+			delete(w.inFlight, delivery.Payload.DeliveryID)
+			w.inFlightMu.Unlock()
+		}()
+	}
+
+	backoff := webhookBackoffBase
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		delivery.Attempts++
+		err := w.post(ctx, delivery)
+		if err == nil {
+			if delivery.queued {
+				w.dequeue(delivery)
+			}
+			return
+		}
+		delivery.LastError = err.Error()
+
+		if attempt == webhookMaxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			w.enqueue(delivery, err)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = minDuration(backoff*2, webhookBackoffMax)
+	}
+
+	w.enqueue(delivery, errors.New(delivery.LastError))
+}
+
+func (w *Webhook) post(ctx context.Context, delivery WebhookDelivery) error {
+	config, err := w.getConfigFunction()
+	if err != nil {
+		return err
+	}
+	if config.ManagerToken == "" {
+		return ErrManagerTokenNotSet
+	}
+
+	body, err := json.Marshal(delivery.Payload)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(config.ManagerToken, timestamp, body))
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookEventHeader, delivery.Payload.Event.Type+"."+delivery.Payload.Event.Action)
+	request.Header.Set(WebhookDeliveryHeader, delivery.Payload.DeliveryID)
+
+	response, err := w.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func (w *Webhook) enqueue(delivery WebhookDelivery, cause error) {
+	if delivery.QueuedAt.IsZero() {
+		delivery.QueuedAt = time.Now()
+	} else if time.Since(delivery.QueuedAt) > webhookQueueRetention {
+		log.Err(cause).
+			Array("tags", zerolog.Arr().Str("webhook").Str("give_up")).
+			Str("webhook", delivery.Payload.Webhook).
+			Str("delivery_id", delivery.Payload.DeliveryID).
+			Int("attempts", delivery.Attempts).
+			Msg("webhook delivery kept failing, event is dropped")
+		w.dequeue(delivery)
+		return
+	}
+
+	log.Err(cause).
+		Array("tags", zerolog.Arr().Str("webhook").Str("enqueue")).
+		Str("webhook", delivery.Payload.Webhook).
+		Str("delivery_id", delivery.Payload.DeliveryID).
+		Int("attempts", delivery.Attempts).
+		Msg("webhook delivery failed, queued for later")
+
+	if err := w.queue.push(delivery); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("webhook").Str("queue_push")).
+			Str("delivery_id", delivery.Payload.DeliveryID).
+			Msg("error persisting webhook delivery, event is dropped")
+	}
+}
+
+func (w *Webhook) dequeue(delivery WebhookDelivery) {
+	if err := w.queue.remove(delivery.Payload.DeliveryID); err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("webhook").Str("queue_remove")).
+			Str("delivery_id", delivery.Payload.DeliveryID).
+			Msg("error removing webhook delivery from the queue, it may be delivered twice")
+	}
+}
+
+// requeue hands the queued deliveries not being retried yet back to the
+// workers. They stay queued until delivered, so none is lost on a restart.
+func (w *Webhook) requeue(ctx context.Context) int {
+	deliveries, err := w.queue.list()
+	if err != nil {
+		log.Err(err).
+			Array("tags", zerolog.Arr().Str("webhook").Str("queue_read")).
+			Msg("error reading webhook queue")
+		return 0
+	}
+
+	requeued := 0
+	for _, delivery := range deliveries {
+		w.inFlightMu.Lock()
+		inFlight := w.inFlight[delivery.Payload.DeliveryID]
+		w.inFlight[delivery.Payload.DeliveryID] = true
+		w.inFlightMu.Unlock()
+		if inFlight {
+			continue
+		}
+
+		delivery.queued = true
+		select {
+		case <-ctx.Done():
+			w.inFlightMu.Lock()
+			delete(w.inFlight, delivery.Payload.DeliveryID)
+			w.inFlightMu.Unlock()
+			return requeued
+		case w.deliveries <- delivery:
+			requeued++
+		}
+	}
+
+	return requeued
+}
+
+func (w *Webhook) List(c echo.Context) error {
+	type webhookSummary struct {
+		Name   string   `json:"name"`
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	data := []webhookSummary{}
+	for _, endpoint := range w.endpoints {
+		data = append(data, webhookSummary{Name: endpoint.Name, URL: endpoint.URL, Events: endpoint.Events})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": data,
+	})
+}
+
+func (w *Webhook) Queue(c echo.Context) error {
+	deliveries, err := w.queue.list()
+	if err != nil {
+		log.Err(err).Msg("error reading webhook queue")
+		return c.JSON(http.StatusInternalServerError, InternalServerErrorResponseBody())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": deliveries,
+	})
+}
+
+// Flush retries every queued delivery right away.
+func (w *Webhook) Flush(c echo.Context) error {
+	if !w.running.Load() {
+		return c.JSON(http.StatusUnprocessableEntity, UnprocessableEntityResponseBody("no webhook is configured"))
+	}
+
+	requeued := w.requeue(c.Request().Context())
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":  "Queued deliveries are being retried",
+		"requeued": requeued,
+	})
+}
+
+// SignWebhookPayload returns the signature header value for a payload:
+// `sha256=` followed by the hex HMAC-SHA256 of `<timestamp>.<body>`.
+func SignWebhookPayload(key, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookMatches reports whether the event matches one of the filters.
+// Filters are `<type>.<action>`, e.g. `container.die`, `container.*` or
+// `*`. Status specific filters like `container.health_status:unhealthy` are
+// supported too.
+func webhookMatches(eventFilters []string, event NormalizedEvent) bool {
+	for _, eventFilter := range eventFilters {
+		if eventFilter == "*" {
+			return true
+		}
+
+		eventType, action, found := strings.Cut(eventFilter, ".")
+		if !found || eventType != event.Type {
+			continue
+		}
+
+		action, status, hasStatus := strings.Cut(action, ":")
+		if action != "*" && action != event.Action {
+			continue
+		}
+		if hasStatus && status != event.Status {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomnius/agent/entity"
+)
+
+const testManagerToken = "manager-secret"
+
+func newTestWebhook(t *testing.T) *Webhook {
+	t.Helper()
+
+	base := webhookBackoffBase
+	webhookBackoffBase = time.Millisecond
+	t.Cleanup(func() { webhookBackoffBase = base })
+
+	return NewWebhook(nil, nil, func() (*entity.CconnectorConfig, error) {
+		return &entity.CconnectorConfig{ManagerToken: testManagerToken}, nil
+	}, t.TempDir())
+}
+
+func testWebhookDelivery(url string) WebhookDelivery {
+	return WebhookDelivery{
+		URL: url,
+		Payload: WebhookPayload{
+			DeliveryID: "delivery-1",
+			Webhook:    "ops",
+			Event:      NormalizedEvent{Type: "container", Action: "die"},
+		},
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	body := []byte(`{"delivery_id":"1"}`)
+
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := SignWebhookPayload("key", "1700000000", body); got != want {
+		t.Errorf("SignWebhookPayload = %s, want %s", got, want)
+	}
+	if got := SignWebhookPayload("other", "1700000000", body); got == want {
+		t.Errorf("signature does not depend on the key")
+	}
+}
+
+func TestWebhookDeliverSignsAndRetries(t *testing.T) {
+	var requests atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte(testManagerToken))
+		mac.Write([]byte(r.Header.Get(WebhookTimestampHeader) + "."))
+		mac.Write(body)
+		if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			t.Errorf("signature header %q does not match the body", r.Header.Get(WebhookSignatureHeader))
+		}
+		if got := r.Header.Get(WebhookEventHeader); got != "container.die" {
+			t.Errorf("event header = %q", got)
+		}
+
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil || payload.DeliveryID != "delivery-1" {
+			t.Errorf("payload = %s", body)
+		}
+
+		// Fails twice before accepting.
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	webhook := newTestWebhook(t)
+	webhook.deliver(context.Background(), testWebhookDelivery(receiver.URL))
+
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+	queued, err := webhook.queue.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 0 {
+		t.Errorf("queue = %+v, want empty", queued)
+	}
+}
+
+func TestWebhookQueueKeepsDeliveriesUntilDelivered(t *testing.T) {
+	var healthy atomic.Bool
+	var requests atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	webhook := newTestWebhook(t)
+	webhook.deliver(context.Background(), testWebhookDelivery(receiver.URL))
+
+	if got := requests.Load(); got != webhookMaxAttempts {
+		t.Errorf("requests = %d, want %d", got, webhookMaxAttempts)
+	}
+	queued, err := webhook.queue.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].Attempts != webhookMaxAttempts || queued[0].LastError == "" {
+		t.Fatalf("queue = %+v", queued)
+	}
+
+	// Handed back to the workers, but still on disk should the daemon stop
+	// before it is delivered.
+	if got := webhook.requeue(context.Background()); got != 1 {
+		t.Fatalf("requeued = %d, want 1", got)
+	}
+	if got := webhook.requeue(context.Background()); got != 0 {
+		t.Errorf("in flight delivery requeued again")
+	}
+	if queued, _ := webhook.queue.list(); len(queued) != 1 {
+		t.Fatalf("queue after requeue = %+v", queued)
+	}
+
+	healthy.Store(true)
+	webhook.deliver(context.Background(), <-webhook.deliveries)
+
+	if queued, _ := webhook.queue.list(); len(queued) != 0 {
+		t.Errorf("queue after delivery = %+v, want empty", queued)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	event := NormalizedEvent{Type: "container", Action: "health_status", Status: "unhealthy"}
+
+	tests := []struct {
+		filters []string
+		want    bool
+	}{
+		{filters: []string{"*"}, want: true},
+		{filters: []string{"container.*"}, want: true},
+		{filters: []string{"container.health_status"}, want: true},
+		{filters: []string{"container.health_status:unhealthy"}, want: true},
+		{filters: []string{"container.health_status:healthy"}, want: false},
+		{filters: []string{"image.*", "container.die"}, want: false},
+		{filters: []string{"container"}, want: false},
+		{filters: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := webhookMatches(tt.filters, event); got != tt.want {
+			t.Errorf("webhookMatches(%v) = %v, want %v", tt.filters, got, tt.want)
+		}
+	}
+}